@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	_ "github.com/rawkode/telegraf-plugin-pulumi-api/plugins/inputs/pulumi_api"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/agent"
+	"github.com/influxdata/telegraf/plugins/common/shim"
+	"github.com/influxdata/telegraf/plugins/serializers/influx"
+)
+
+var pollInterval = flag.Duration("poll_interval", 1*time.Second, "how often to send metrics")
+var pollIntervalDisabled = flag.Bool("poll_interval_disabled", false, "how often to send metrics")
+var configFile = flag.String("config", "", "path to the config file for this plugin")
+var testMode = flag.Bool("test", false, "gather once, print the metrics and exit")
+var err error
+
+func main() {
+	flag.Parse()
+	if *pollIntervalDisabled {
+		*pollInterval = shim.PollIntervalDisabled
+	}
+
+	shim := shim.New()
+
+	err = shim.LoadConfig(configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err loading input: %s\n", err)
+		os.Exit(1)
+	}
+
+	if *testMode {
+		if err := gatherOnce(shim); err != nil {
+			fmt.Fprintf(os.Stderr, "Err: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := shim.Run(*pollInterval); err != nil {
+		fmt.Fprintf(os.Stderr, "Err: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// gatherOnce prints the metrics of a single gather as line protocol, like
+// telegraf --test. Errors the plugin reports go to stderr.
+func gatherOnce(s *shim.Shim) error {
+	metrics := make(chan telegraf.Metric)
+	acc := agent.NewAccumulator(s, metrics)
+	acc.SetPrecision(time.Nanosecond)
+
+	gathered := make(chan error, 1)
+	go func() {
+		gathered <- s.Input.Gather(acc)
+		close(metrics)
+	}()
+
+	serializer := influx.NewSerializer()
+	for m := range metrics {
+		line, err := serializer.Serialize(m)
+		if err != nil {
+			s.Log().Errorf("Serializing %s: %s", m.Name(), err)
+			continue
+		}
+		os.Stdout.Write(line)
+	}
+
+	return <-gathered
+}
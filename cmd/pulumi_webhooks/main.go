@@ -6,7 +6,7 @@ import (
 	"os"
 	"time"
 
-	_ "github.com/rawkode/telegraf-plugin-pulumi-api/plugins/inputs/pulumi_api"
+	_ "github.com/rawkode/telegraf-plugin-pulumi-api/plugins/inputs/pulumi_webhooks"
 
 	"github.com/influxdata/telegraf/plugins/common/shim"
 )
@@ -2,4 +2,14 @@ module github.com/rawkode/telegraf-plugin-pulumi-api
 
 go 1.16
 
-require github.com/influxdata/telegraf v1.20.4
+require (
+	github.com/influxdata/telegraf v1.20.4
+	github.com/oschwald/geoip2-golang v1.5.0
+	github.com/stretchr/testify v1.7.0
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+	golang.org/x/time v0.0.0-20210723032227-1f47c861a9ac
+	gopkg.in/yaml.v2 v2.4.0
+)
@@ -0,0 +1,265 @@
+// Package fakepulumi is a fake Pulumi API serving canned fixtures, for
+// testing collectors without a real organization
+package fakepulumi
+
+import (
+	"embed"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Token is the only access token the fake API accepts
+const Token = "pul-fake-token"
+
+// IDToken is the only OIDC token the fake API exchanges, for Token
+const IDToken = "fake-id-token"
+
+//go:embed testdata
+var fixtures embed.FS
+
+// Server is a fake Pulumi API. Every organization gets the same fixtures.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []string
+	handlers map[string]http.HandlerFunc
+}
+
+func NewServer() *Server {
+	s := &Server{
+		handlers: make(map[string]http.HandlerFunc),
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+
+	return s
+}
+
+// Handle overrides the response for an endpoint, e.g. "auditlogs", to test
+// errors and edge cases
+func (s *Server) Handle(endpoint string, handler http.HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handlers[endpoint] = handler
+}
+
+// Requests returns the path and query of every request received, in order
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.requests...)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.URL.RequestURI())
+	s.mu.Unlock()
+
+	// Token exchange is the one endpoint called without a token
+	if r.URL.Path == "/api/oauth/token" {
+		s.mu.Lock()
+		handler, ok := s.handlers["oauth/token"]
+		s.mu.Unlock()
+
+		if ok {
+			handler(w, r)
+		} else {
+			exchangeToken(w, r)
+		}
+		return
+	}
+
+	if r.Header.Get("Authorization") != "token "+Token {
+		Error(w, http.StatusUnauthorized, "Unauthorized: No credentials provided or are invalid.")
+		return
+	}
+
+	endpoint, ok := endpointFor(r.URL.Path)
+	if !ok {
+		Error(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	s.mu.Lock()
+	handler, ok := s.handlers[endpoint]
+	s.mu.Unlock()
+
+	if ok {
+		handler(w, r)
+		return
+	}
+
+	switch endpoint {
+	case "auditlogs":
+		if r.URL.Query().Get("continuationToken") == "page-2" {
+			Fixture(w, "auditlogs_page2.json")
+		} else {
+			Fixture(w, "auditlogs_page1.json")
+		}
+	case "user":
+		Fixture(w, "user.json")
+	case "user/stacks":
+		Fixture(w, "stacks.json")
+	case "organization":
+		Fixture(w, "organization.json")
+	case "teams":
+		Fixture(w, "teams.json")
+	case "members":
+		Fixture(w, "members.json")
+	case "updates":
+		Fixture(w, "updates.json")
+	case "deployments/schedules":
+		if strings.HasSuffix(r.URL.Path, "/staging/deployments/schedules") {
+			Fixture(w, "schedules_ttl.json")
+		} else {
+			Fixture(w, "schedules.json")
+		}
+	case "deployments":
+		if strings.HasSuffix(r.URL.Path, "/production/deployments") {
+			Fixture(w, "deployments.json")
+		} else {
+			w.Write([]byte(`{"deployments":[],"itemsPerPage":100,"total":0}`))
+		}
+	case "deployments/settings":
+		if strings.HasSuffix(r.URL.Path, "/production/deployments/settings") {
+			Fixture(w, "deployment_settings.json")
+		} else {
+			Error(w, http.StatusNotFound, "Not found")
+		}
+	case "export":
+		if strings.HasSuffix(r.URL.Path, "/production/export") {
+			Fixture(w, "stack_export.json")
+		} else {
+			w.Write([]byte(`{"version":3,"deployment":{"manifest":{},"secrets_providers":{"type":"passphrase","state":{"salt":"v1:c2FsdA=="}}}}`))
+		}
+	case "billing/usage":
+		Fixture(w, "usage.json")
+	case "billing/usage/deployments":
+		Fixture(w, "usage_deployments.json")
+	case "auditlogs/export":
+		Fixture(w, "auditlogs_export.csv")
+	case "search/resourcesv2":
+		if r.URL.Query().Get("cursor") == "page-2" {
+			Fixture(w, "resources_page2.json")
+		} else {
+			Fixture(w, "resources_page1.json")
+		}
+	case "esc/environments":
+		Fixture(w, "esc_environments.json")
+	case "esc/environment":
+		Fixture(w, "esc_environment.yaml")
+	case "esc/environments/tags":
+		Fixture(w, "esc_tags.json")
+	case "esc/environments/open":
+		if strings.HasSuffix(r.URL.Path, "/broken/open") {
+			Fixture(w, "esc_open_diagnostics.json")
+		} else {
+			Fixture(w, "esc_open.json")
+		}
+	default:
+		// deployments/{id}/logs
+		if strings.HasPrefix(endpoint, "deployments/") && strings.HasSuffix(endpoint, "/logs") {
+			Fixture(w, "deployment_logs.json")
+			return
+		}
+
+		// update/{id}/events
+		if strings.HasPrefix(endpoint, "update/") && strings.HasSuffix(endpoint, "/events") {
+			Fixture(w, "update_events.json")
+			return
+		}
+
+		// teams/{team}
+		if strings.HasPrefix(endpoint, "teams/") {
+			Fixture(w, "team_"+strings.TrimPrefix(endpoint, "teams/")+".json")
+			return
+		}
+
+		Error(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// exchangeToken answers an OIDC token exchange for IDToken with Token
+func exchangeToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		Error(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if r.PostFormValue("grant_type") != "urn:ietf:params:oauth:grant-type:token-exchange" || r.PostFormValue("subject_token") != IDToken {
+		Error(w, http.StatusUnauthorized, "Invalid token exchange request")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"access_token":%q,"issued_token_type":%q,"token_type":"token","expires_in":7200}`,
+		Token, r.PostFormValue("requested_token_type"))
+}
+
+// endpointFor names the endpoint a path belongs to
+func endpointFor(path string) (string, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	// /api/user and /api/user/stacks
+	if len(parts) >= 2 && parts[0] == "api" && parts[1] == "user" {
+		return strings.Join(parts[1:], "/"), true
+	}
+
+	// /api/stacks/{organization}/{project}/{stack}/{endpoint...}
+	if len(parts) >= 6 && parts[0] == "api" && parts[1] == "stacks" {
+		return strings.Join(parts[5:], "/"), true
+	}
+
+	// /api/esc/environments/{organization} lists the environments, their
+	// own endpoints are under /{project}/{environment}/{endpoint...}
+	if len(parts) >= 4 && parts[0] == "api" && parts[1] == "esc" && parts[2] == "environments" {
+		switch {
+		case len(parts) == 4:
+			return "esc/environments", true
+		case len(parts) >= 7:
+			return "esc/environments/" + strings.Join(parts[6:], "/"), true
+		}
+		return "esc/environment", true
+	}
+
+	// /api/orgs/{organization} and its /{endpoint...}
+	if len(parts) == 3 && parts[0] == "api" && parts[1] == "orgs" {
+		return "organization", true
+	}
+	if len(parts) >= 4 && parts[0] == "api" && parts[1] == "orgs" {
+		return strings.Join(parts[3:], "/"), true
+	}
+
+	return "", false
+}
+
+// Fixture writes a canned response from testdata
+func Fixture(w http.ResponseWriter, name string) {
+	body, err := fixtures.ReadFile("testdata/" + name)
+	if err != nil {
+		Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if strings.HasSuffix(name, ".csv") {
+		w.Header().Set("Content-Type", "text/csv")
+	} else if strings.HasSuffix(name, ".yaml") {
+		w.Header().Set("Content-Type", "application/x-yaml")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Write(body)
+}
+
+// Error writes an error in the shape the Pulumi API uses
+func Error(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"code":%d,"message":%q}`, code, message)
+}
@@ -0,0 +1,61 @@
+package pulumi
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DeployEventMeasurement holds one point per completed update, tagged like
+// the update, with the title and text fields Grafana shows on an
+// annotation
+const DeployEventMeasurement = "pulumi_deploy_events"
+
+// DeployEvent reports whether the update is worth an annotation, one that
+// is done and could have changed the stack
+func (u StackUpdate) DeployEvent() bool {
+	switch u.Result {
+	case "", "in-progress", "not-started":
+		return false
+	}
+
+	return u.Kind != "preview"
+}
+
+// DeployEventFields describes the update, e.g. "website/production update
+// succeeded" with "Update 42 of acme/website/production succeeded after
+// 1m30s: 2 create, 1 update"
+func (u StackUpdate) DeployEventFields() map[string]interface{} {
+	update := strings.Title(u.Kind)
+	if u.Version > 0 {
+		update = fmt.Sprintf("%s %d", update, u.Version)
+	}
+
+	text := fmt.Sprintf("%s of %s/%s/%s %s", update, u.Organization, u.Project, u.Stack, u.Result)
+	if !u.StartTime.IsZero() && !u.EndTime.IsZero() {
+		text = fmt.Sprintf("%s after %s", text, u.EndTime.Sub(u.StartTime).Round(time.Second))
+	}
+
+	// Unchanged resources would drown out the changes
+	var operations []string
+	for operation, count := range u.ResourceChanges {
+		if operation != "same" && count > 0 {
+			operations = append(operations, operation)
+		}
+	}
+	sort.Strings(operations)
+
+	var changes []string
+	for _, operation := range operations {
+		changes = append(changes, fmt.Sprintf("%d %s", u.ResourceChanges[operation], operation))
+	}
+	if len(changes) > 0 {
+		text = fmt.Sprintf("%s: %s", text, strings.Join(changes, ", "))
+	}
+
+	return map[string]interface{}{
+		"title": fmt.Sprintf("%s/%s %s %s", u.Project, u.Stack, u.Kind, u.Result),
+		"text":  text,
+	}
+}
@@ -0,0 +1,93 @@
+// Package pulumi holds the metric schemas shared between the pulumi_api
+// and pulumi_webhooks inputs, so dashboards work the same whether data was
+// polled or pushed
+package pulumi
+
+import "time"
+
+const StackUpdateMeasurement = "pulumi_stack_update"
+
+// StackUpdate is a single update, preview, refresh or destroy of a stack
+type StackUpdate struct {
+	Organization string
+	Project      string
+	Stack        string
+
+	// Kind is the kind of update, e.g. update, preview, refresh or destroy
+	Kind string
+	// Result is succeeded, failed or in-progress
+	Result string
+
+	// Initiator is what started the update, cli, ci, automation_api,
+	// deployments or drift_remediation, if known
+	Initiator string
+
+	// FailureReason is why a failed update did, cancelled,
+	// policy_violation, timeout, provider_error or unknown, with the
+	// message saying so, when classified
+	FailureReason  string
+	FailureMessage string
+
+	Version   int64
+	StartTime time.Time
+	EndTime   time.Time
+
+	ResourceChanges map[string]int
+}
+
+func (u StackUpdate) Tags() map[string]string {
+	tags := map[string]string{
+		"organization": u.Organization,
+		"project":      u.Project,
+		"stack":        u.Stack,
+		"kind":         u.Kind,
+		"result":       u.Result,
+	}
+
+	if u.Initiator != "" {
+		tags["initiator"] = u.Initiator
+	}
+
+	if u.FailureReason != "" {
+		tags["failure_reason"] = u.FailureReason
+	}
+
+	return tags
+}
+
+func (u StackUpdate) Fields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"count": 1,
+	}
+
+	if u.Version > 0 {
+		fields["version"] = u.Version
+	}
+
+	if !u.StartTime.IsZero() && !u.EndTime.IsZero() {
+		fields["duration"] = u.EndTime.Sub(u.StartTime).Seconds()
+	}
+
+	for operation, count := range u.ResourceChanges {
+		fields["resource_changes_"+operation] = count
+	}
+
+	if u.FailureMessage != "" {
+		fields["failure_message"] = u.FailureMessage
+	}
+
+	return fields
+}
+
+// Time is when the update finished, or started if it's still running
+func (u StackUpdate) Time() time.Time {
+	if !u.EndTime.IsZero() {
+		return u.EndTime
+	}
+
+	if !u.StartTime.IsZero() {
+		return u.StartTime
+	}
+
+	return time.Now()
+}
@@ -0,0 +1,210 @@
+package pulumi_api
+
+import (
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/filter"
+)
+
+// taggingAccumulator adds the same tags to every metric passing through
+type taggingAccumulator struct {
+	telegraf.Accumulator
+	tags map[string]string
+}
+
+func newTaggingAccumulator(acc telegraf.Accumulator, tags map[string]string) *taggingAccumulator {
+	return &taggingAccumulator{
+		Accumulator: acc,
+		tags:        tags,
+	}
+}
+
+// withTags copies tags rather than adding to them, the caller may reuse
+// its map
+func (a *taggingAccumulator) withTags(tags map[string]string) map[string]string {
+	merged := make(map[string]string, len(tags)+len(a.tags))
+	for key, value := range tags {
+		merged[key] = value
+	}
+	for key, value := range a.tags {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+func (a *taggingAccumulator) AddFields(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	a.Accumulator.AddFields(measurement, fields, a.withTags(tags), t...)
+}
+
+func (a *taggingAccumulator) AddGauge(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	a.Accumulator.AddGauge(measurement, fields, a.withTags(tags), t...)
+}
+
+func (a *taggingAccumulator) AddCounter(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	a.Accumulator.AddCounter(measurement, fields, a.withTags(tags), t...)
+}
+
+func (a *taggingAccumulator) AddSummary(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	a.Accumulator.AddSummary(measurement, fields, a.withTags(tags), t...)
+}
+
+func (a *taggingAccumulator) AddHistogram(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	a.Accumulator.AddHistogram(measurement, fields, a.withTags(tags), t...)
+}
+
+func (a *taggingAccumulator) AddMetric(m telegraf.Metric) {
+	for key, value := range a.tags {
+		m.AddTag(key, value)
+	}
+
+	a.Accumulator.AddMetric(m)
+}
+
+// sourceTaggingAccumulator adds the repository and branch tags to the
+// metrics of the organization's stacks deploying from a repository, those
+// tagged with their project and stack
+type sourceTaggingAccumulator struct {
+	telegraf.Accumulator
+	org *organization
+}
+
+func newSourceTaggingAccumulator(acc telegraf.Accumulator, org *organization) *sourceTaggingAccumulator {
+	return &sourceTaggingAccumulator{
+		Accumulator: acc,
+		org:         org,
+	}
+}
+
+func (a *sourceTaggingAccumulator) sourceTags(tags map[string]string) map[string]string {
+	project, ok := tags["project"]
+	if !ok {
+		return nil
+	}
+
+	return a.org.sources[project+"/"+tags["stack"]]
+}
+
+// withTags copies tags rather than adding to them, the caller may reuse
+// its map
+func (a *sourceTaggingAccumulator) withTags(tags map[string]string) map[string]string {
+	sources := a.sourceTags(tags)
+	if len(sources) == 0 {
+		return tags
+	}
+
+	merged := make(map[string]string, len(tags)+len(sources))
+	for key, value := range tags {
+		merged[key] = value
+	}
+	for key, value := range sources {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+func (a *sourceTaggingAccumulator) AddFields(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	a.Accumulator.AddFields(measurement, fields, a.withTags(tags), t...)
+}
+
+func (a *sourceTaggingAccumulator) AddGauge(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	a.Accumulator.AddGauge(measurement, fields, a.withTags(tags), t...)
+}
+
+func (a *sourceTaggingAccumulator) AddCounter(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	a.Accumulator.AddCounter(measurement, fields, a.withTags(tags), t...)
+}
+
+func (a *sourceTaggingAccumulator) AddSummary(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	a.Accumulator.AddSummary(measurement, fields, a.withTags(tags), t...)
+}
+
+func (a *sourceTaggingAccumulator) AddHistogram(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	a.Accumulator.AddHistogram(measurement, fields, a.withTags(tags), t...)
+}
+
+func (a *sourceTaggingAccumulator) AddMetric(m telegraf.Metric) {
+	for key, value := range a.sourceTags(m.Tags()) {
+		m.AddTag(key, value)
+	}
+
+	a.Accumulator.AddMetric(m)
+}
+
+// fieldFilterAccumulator drops the fields field_include and field_exclude
+// don't let through, and metrics left without any
+type fieldFilterAccumulator struct {
+	telegraf.Accumulator
+	filter filter.Filter
+}
+
+func newFieldFilterAccumulator(acc telegraf.Accumulator, f filter.Filter) *fieldFilterAccumulator {
+	return &fieldFilterAccumulator{
+		Accumulator: acc,
+		filter:      f,
+	}
+}
+
+// withFields copies fields rather than deleting from them, the caller may
+// reuse its map
+func (a *fieldFilterAccumulator) withFields(fields map[string]interface{}) map[string]interface{} {
+	filtered := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		if a.filter.Match(key) {
+			filtered[key] = value
+		}
+	}
+
+	return filtered
+}
+
+func (a *fieldFilterAccumulator) AddFields(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	if fields = a.withFields(fields); len(fields) > 0 {
+		a.Accumulator.AddFields(measurement, fields, tags, t...)
+	}
+}
+
+func (a *fieldFilterAccumulator) AddGauge(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	if fields = a.withFields(fields); len(fields) > 0 {
+		a.Accumulator.AddGauge(measurement, fields, tags, t...)
+	}
+}
+
+func (a *fieldFilterAccumulator) AddCounter(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	if fields = a.withFields(fields); len(fields) > 0 {
+		a.Accumulator.AddCounter(measurement, fields, tags, t...)
+	}
+}
+
+func (a *fieldFilterAccumulator) AddSummary(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	if fields = a.withFields(fields); len(fields) > 0 {
+		a.Accumulator.AddSummary(measurement, fields, tags, t...)
+	}
+}
+
+func (a *fieldFilterAccumulator) AddHistogram(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	if fields = a.withFields(fields); len(fields) > 0 {
+		a.Accumulator.AddHistogram(measurement, fields, tags, t...)
+	}
+}
+
+// AddMetric removes the fields only once it has gone through them all, as
+// RemoveField shifts the field list being read
+func (a *fieldFilterAccumulator) AddMetric(m telegraf.Metric) {
+	var excluded []string
+	for _, field := range m.FieldList() {
+		if !a.filter.Match(field.Key) {
+			excluded = append(excluded, field.Key)
+		}
+	}
+
+	for _, key := range excluded {
+		m.RemoveField(key)
+	}
+
+	if len(m.FieldList()) > 0 {
+		a.Accumulator.AddMetric(m)
+	}
+}
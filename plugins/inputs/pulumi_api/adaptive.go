@@ -0,0 +1,81 @@
+package pulumi_api
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// adaptivePoll schedules an organization's realtime polls with
+// adaptive_polling, from the rate its audit events have been coming in at.
+// Only the realtime loop uses it.
+type adaptivePoll struct {
+	interval time.Duration
+	next     time.Time
+
+	// rate is the smoothed events per second, as of the poll at last, when
+	// the organization had emitted emitted events
+	rate    float64
+	last    time.Time
+	emitted int64
+}
+
+// collectDueAuditLogs collects the audit logs of the organization if its
+// next poll is due, setting polled if it was
+func (p *PulumiApiConfig) collectDueAuditLogs(acc telegraf.Accumulator, org *organization, polled *int32) {
+	if time.Now().Before(org.poll.next) {
+		return
+	}
+
+	p.collectAuditLogs(acc, org)
+	p.adaptPollInterval(org, time.Now())
+
+	atomic.StoreInt32(polled, 1)
+}
+
+// adaptPollInterval picks the interval to the organization's next poll, so
+// each collects about adaptive_target_events. It at most halves or doubles
+// per poll, so one burst or lull doesn't swing it from bound to bound.
+func (p *PulumiApiConfig) adaptPollInterval(org *organization, now time.Time) {
+	poll := &org.poll
+	if poll.interval == 0 {
+		poll.interval = time.Duration(p.RealtimeInterval)
+	}
+
+	emitted := atomic.LoadInt64(&org.auditEvents)
+
+	// The first poll catches up on whatever happened while the plugin was
+	// down, which says nothing about the rate
+	if !poll.last.IsZero() {
+		if elapsed := now.Sub(poll.last).Seconds(); elapsed > 0 {
+			poll.rate = (poll.rate + float64(emitted-poll.emitted)/elapsed) / 2
+		}
+
+		interval := 2 * poll.interval
+		if poll.rate > 0 {
+			interval = time.Duration(float64(p.AdaptiveTargetEvents) / poll.rate * float64(time.Second))
+		}
+
+		if interval < poll.interval/2 {
+			interval = poll.interval / 2
+		}
+		if interval > 2*poll.interval {
+			interval = 2 * poll.interval
+		}
+		if interval < time.Duration(p.RealtimeMinInterval) {
+			interval = time.Duration(p.RealtimeMinInterval)
+		}
+		if interval > time.Duration(p.RealtimeMaxInterval) {
+			interval = time.Duration(p.RealtimeMaxInterval)
+		}
+
+		if interval != poll.interval {
+			p.Log.Debugf("Polling the audit logs of %s every %s, at %.2f events per second", org.name, interval, poll.rate)
+		}
+		poll.interval = interval
+	}
+
+	poll.last, poll.emitted = now, emitted
+	poll.next = now.Add(poll.interval)
+}
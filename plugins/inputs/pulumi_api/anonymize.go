@@ -0,0 +1,72 @@
+package pulumi_api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// pseudonym replaces an identifier with a keyed hash of it. The same value
+// always gets the same pseudonym, so events can still be grouped by user,
+// but without the salt it can't be brute forced back, not even for IPs.
+func (p *PulumiApiConfig) pseudonym(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, []byte(p.AnonymizeSalt))
+	mac.Write([]byte(value))
+
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// anonymizeEvent pseudonymizes everything identifying a person in an
+// event, and drops their avatar, which would give them away regardless.
+// Descriptions often name the user or token too, so what the event says
+// about them is replaced in it as well.
+func (p *PulumiApiConfig) anonymizeEvent(auditLogEvent AuditLogEvent) AuditLogEvent {
+	auditLogEvent.Description = p.scrub(auditLogEvent.Description,
+		auditLogEvent.SourceIP, auditLogEvent.User.Name, auditLogEvent.User.GitHubLogin, auditLogEvent.TokenName)
+
+	auditLogEvent.SourceIP = p.pseudonym(auditLogEvent.SourceIP)
+	auditLogEvent.TokenName = p.pseudonym(auditLogEvent.TokenName)
+	auditLogEvent.User = User{
+		Name:        p.pseudonym(auditLogEvent.User.Name),
+		GitHubLogin: p.pseudonym(auditLogEvent.User.GitHubLogin),
+	}
+
+	return auditLogEvent
+}
+
+// scrub replaces each of values in text with its pseudonym, as whole words
+// and ignoring case. Longer values go first, so a token named after its
+// owner's login is replaced whole rather than around the login.
+func (p *PulumiApiConfig) scrub(text string, values ...string) string {
+	pseudonyms := make(map[string]string, len(values))
+	patterns := make([]string, 0, len(values))
+	for _, value := range values {
+		key := strings.ToLower(value)
+		if value == "" || pseudonyms[key] != "" {
+			continue
+		}
+
+		pseudonyms[key] = p.pseudonym(value)
+		patterns = append(patterns, regexp.QuoteMeta(value))
+	}
+	if text == "" || len(patterns) == 0 {
+		return text
+	}
+
+	sort.Slice(patterns, func(i, j int) bool { return len(patterns[i]) > len(patterns[j]) })
+	re := regexp.MustCompile(`(?i)\b(?:` + strings.Join(patterns, "|") + `)\b`)
+
+	return re.ReplaceAllStringFunc(text, func(match string) string {
+		if pseudonym, ok := pseudonyms[strings.ToLower(match)]; ok {
+			return pseudonym
+		}
+		return p.pseudonym(match)
+	})
+}
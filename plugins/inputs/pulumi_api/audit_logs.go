@@ -0,0 +1,452 @@
+package pulumi_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	neturl "net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+type AuditLogsResponse struct {
+	ContinuationToken ContinuationToken `json:"continuationToken"`
+	AuditLogEvents    []AuditLogEvent   `json:"auditLogEvents"`
+}
+
+// ContinuationToken is opaque to us, the audit log endpoint has returned it
+// as a number while other endpoints use strings, so accept either
+type ContinuationToken string
+
+func (t *ContinuationToken) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*t = ""
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*t = ContinuationToken(s)
+		return nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("continuation token must be a string or number: %s", data)
+	}
+
+	// Zero was how the numeric encoding said there are no more pages
+	if n == "0" {
+		*t = ""
+	} else {
+		*t = ContinuationToken(n)
+	}
+
+	return nil
+}
+
+type AuditLogEvent struct {
+	Timestamp   int64  `json:"timestamp"`
+	SourceIP    string `json:"sourceIP"`
+	Event       string `json:"event"`
+	Description string `json:"description"`
+	User        User   `json:"user"`
+
+	// The access token the event was made with, if it wasn't made through
+	// the console
+	TokenID   string `json:"tokenID,omitempty"`
+	TokenName string `json:"tokenName,omitempty"`
+}
+
+type User struct {
+	Name        string `json:"name"`
+	GitHubLogin string `json:"githubLogin"`
+	AvatarUrl   string `json:"avatarUrl"`
+}
+
+// userAttributes are the attributes of an event's user, by the name
+// user_attributes configures them with and the name they're emitted as
+var userAttributes = []struct {
+	attribute string
+	key       string
+	value     func(User) string
+}{
+	{"name", "user", func(u User) string { return u.Name }},
+	{"githubLogin", "github_login", func(u User) string { return u.GitHubLogin }},
+	{"avatarUrl", "avatar_url", func(u User) string { return u.AvatarUrl }},
+}
+
+// The avatar is the same URL on every event of a user, not worth storing
+var defaultUserAttributes = map[string]string{
+	"name":        "tag",
+	"githubLogin": "tag",
+	"avatarUrl":   "drop",
+}
+
+// buildUserAttributes fills in the default of every attribute not
+// configured, and checks the configured ones
+func buildUserAttributes(configured map[string]string) (map[string]string, error) {
+	attributes := make(map[string]string, len(defaultUserAttributes))
+	for attribute, mode := range defaultUserAttributes {
+		attributes[attribute] = mode
+	}
+
+	for attribute, mode := range configured {
+		if _, ok := defaultUserAttributes[attribute]; !ok {
+			return nil, fmt.Errorf("invalid user_attributes attribute %q, must be name, githubLogin or avatarUrl", attribute)
+		}
+
+		switch mode {
+		case "tag", "field", "drop":
+		default:
+			return nil, fmt.Errorf("invalid user_attributes mode %q of %s, must be tag, field or drop", mode, attribute)
+		}
+
+		attributes[attribute] = mode
+	}
+
+	return attributes, nil
+}
+
+// addUserAttributes adds the event's user as configured by user_attributes
+func (p *PulumiApiConfig) addUserAttributes(tags map[string]string, fields map[string]interface{}, user User) {
+	for _, attribute := range userAttributes {
+		switch p.UserAttributes[attribute.attribute] {
+		case "tag":
+			tags[attribute.key] = attribute.value(user)
+		case "field":
+			if value := attribute.value(user); value != "" {
+				fields[attribute.key] = value
+			}
+		}
+	}
+}
+
+// logFields reshapes an event's fields into a log line, its description
+// as the message and the other text fields moved to the tags
+func logFields(tags map[string]string, fields map[string]interface{}, auditLogEvent AuditLogEvent) map[string]interface{} {
+	for key, value := range fields {
+		if text, ok := value.(string); ok && key != "payload" {
+			tags[key] = text
+		}
+	}
+
+	message := auditLogEvent.Description
+	if message == "" {
+		message = auditLogEvent.Event
+	}
+
+	return map[string]interface{}{
+		"message": message,
+	}
+}
+
+func (p *PulumiApiConfig) gatherAuditLogs(acc telegraf.Accumulator, org *organization) {
+	p.Log.Debugf("Fetching audit logs for %s", org.name)
+
+	// A continuation token means we're resuming a capped fetch, of the
+	// same window if windows are aligned
+	if org.continuationToken == "" {
+		org.newestEvent = org.lastFetch
+
+		if p.WindowAlignment > 0 {
+			org.windowEnd = time.Now().Truncate(time.Duration(p.WindowAlignment))
+
+			if !org.windowEnd.After(org.lastFetch) {
+				p.Log.Debugf("No complete window to fetch for %s yet", org.name)
+
+				// Waiting for the window is as caught up as it gets
+				if !org.lastFetch.IsZero() {
+					org.fetchedAt = time.Now()
+				}
+				return
+			}
+		}
+	}
+
+	if err := p.fetchAuditLogs(acc, org); err != nil {
+		// Leave lastFetch alone so the next gather retries this window
+		org.continuationToken = ""
+		p.addFetchError(acc, org, "audit_logs", "", err)
+		return
+	}
+	org.fetchedAt = time.Now()
+
+	if org.continuationToken != "" {
+		return
+	}
+
+	// A window is done as of its end, whether or not it had events
+	if !org.windowEnd.IsZero() {
+		org.lastFetch = org.windowEnd
+		org.windowEnd = time.Time{}
+	} else {
+		org.lastFetch = org.newestEvent
+	}
+	org.pruneSeen(p.Overlap)
+}
+
+// Reasons audit events are dropped for, always all emitted so a reason
+// dropping nothing shows as zero rather than missing
+var dropReasons = []string{"duplicate", "event_filter", "decode_error", "anonymize_error"}
+
+// addDroppedEventsMetric emits the counts of events dropped since the last
+// time, by reason
+func (p *PulumiApiConfig) addDroppedEventsMetric(acc telegraf.Accumulator, org *organization) {
+	for _, reason := range dropReasons {
+		tags := map[string]string{
+			"organization": org.name,
+			"reason":       reason,
+		}
+
+		acc.AddCounter("pulumi_api_dropped_events", map[string]interface{}{"count": org.dropped[reason]}, tags)
+	}
+
+	org.dropped = make(map[string]int)
+}
+
+// addLagMetric emits how far the audit log cursor is behind now. Nothing
+// is emitted before the first successful fetch, the cursor could be
+// anywhere until then.
+func (p *PulumiApiConfig) addLagMetric(acc telegraf.Accumulator, org *organization) {
+	if org.fetchedAt.IsZero() {
+		return
+	}
+
+	now := time.Now()
+	fields := map[string]interface{}{
+		"newest_event":          org.lastFetch.Unix(),
+		"lag_seconds":           now.Sub(org.lastFetch).Seconds(),
+		"since_success_seconds": now.Sub(org.fetchedAt).Seconds(),
+	}
+
+	acc.AddGauge("pulumi_api_lag", fields, map[string]string{"organization": org.name})
+}
+
+// Event name prefixes of each category, the first match wins
+var eventCategories = []struct {
+	category string
+	prefixes []string
+}{
+	// Tokens come first, as their names start with what they belong to
+	{"token", []string{"access-token-", "org-token-", "team-token-", "personal-token-", "deployment-token-"}},
+	{"stack", []string{"stack-", "update-", "deployment-", "webhook-"}},
+	{"policy", []string{"policy-"}},
+	{"member", []string{"member-", "team-", "invite-", "role-"}},
+	{"environment", []string{"environment-", "esc-"}},
+	{"billing", []string{"billing-", "subscription-"}},
+}
+
+// eventCategory groups an event by what it acted on
+func eventCategory(event string) string {
+	for _, group := range eventCategories {
+		for _, prefix := range group.prefixes {
+			if strings.HasPrefix(event, prefix) {
+				return group.category
+			}
+		}
+	}
+
+	return "other"
+}
+
+// Audit log events carry no ID, so identify them by their content
+func auditLogEventKey(auditLogEvent AuditLogEvent) string {
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%d|%s|%s|%s|%s|%s", auditLogEvent.Timestamp, auditLogEvent.Event, auditLogEvent.User.GitHubLogin, auditLogEvent.User.Name, auditLogEvent.SourceIP, auditLogEvent.Description)
+
+	return fmt.Sprintf("%x", hash.Sum64())
+}
+
+func (p *PulumiApiConfig) auditLogUrl(org *organization) string {
+	url := fmt.Sprintf("%s/api/orgs/%s/auditlogs?startTime=%d", org.tenant.url, org.name, org.startTime(p.Overlap).Unix())
+
+	if !org.windowEnd.IsZero() {
+		url = fmt.Sprintf("%s&endTime=%d", url, org.windowEnd.Unix())
+	}
+
+	if p.PageSize > 0 {
+		url = fmt.Sprintf("%s&pageSize=%d", url, p.PageSize)
+	}
+
+	for _, stack := range p.AuditLogStacks {
+		url = fmt.Sprintf("%s&stackFilter=%s", url, neturl.QueryEscape(stack))
+	}
+
+	if org.continuationToken != "" {
+		url = fmt.Sprintf("%s&continuationToken=%s", url, neturl.QueryEscape(string(org.continuationToken)))
+	}
+
+	p.Log.Debugf("audit_log_url: %s", url)
+
+	return url
+}
+
+// fetchAuditLogs follows continuation tokens until the last page, or until
+// max_pages is reached, leaving the continuation token set to resume from
+func (p *PulumiApiConfig) fetchAuditLogs(acc telegraf.Accumulator, org *organization) error {
+	for page := 1; ; page++ {
+		continuationToken, err := p.fetchAuditLogPage(acc, org)
+		if err != nil {
+			return fmt.Errorf("page %d: %w", page, err)
+		}
+		org.stats.pages.Incr(1)
+
+		org.continuationToken = continuationToken
+		if continuationToken == "" {
+			break
+		}
+
+		if p.DryRun {
+			p.Log.Infof("Dry run, not fetching the audit logs of %s past the first page", org.name)
+			return nil
+		}
+
+		if p.MaxPages > 0 && page >= p.MaxPages {
+			p.Log.Warnf("Reached max_pages (%d) for %s, remaining pages will be fetched on the next gather", p.MaxPages, org.name)
+			return nil
+		}
+
+		p.Log.Info("Response was paginated, sending additional request with continuation token")
+	}
+
+	p.Log.Debugf("Finished fetching audit logs for %s", org.name)
+	return nil
+}
+
+func (p *PulumiApiConfig) fetchAuditLogPage(acc telegraf.Accumulator, org *organization) (ContinuationToken, error) {
+	p.Log.Debug("Sending Audit Log Request")
+
+	// Events are emitted as they're decoded, so auditLogsResponse only
+	// ends up holding the continuation token
+	var auditLogsResponse AuditLogsResponse
+
+	req := apiRequest{
+		acc:          acc,
+		tenant:       org.tenant,
+		stats:        org.stats,
+		organization: org.name,
+		endpoint:     "auditlogs",
+		url:          p.auditLogUrl(org),
+	}
+
+	err := p.get(req, func(body io.Reader) error {
+		return org.drift.decodeStream("auditlogs", body, &auditLogsResponse, "auditLogEvents", func(raw json.RawMessage) error {
+			var auditLogEvent AuditLogEvent
+			if err := org.drift.decode("auditlogs.auditLogEvents[]", raw, &auditLogEvent); err != nil {
+				org.drift.report("auditlogs.auditLogEvents[]", "dropping element: %s", err)
+				org.dropped["decode_error"]++
+				return nil
+			}
+
+			p.addAuditLogEvent(acc, org, auditLogEvent, raw)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return auditLogsResponse.ContinuationToken, nil
+}
+
+func (p *PulumiApiConfig) addAuditLogEvent(acc telegraf.Accumulator, org *organization, auditLogEvent AuditLogEvent, raw json.RawMessage) {
+	timestamp := p.eventTime(auditLogEvent.Timestamp)
+
+	key := auditLogEventKey(auditLogEvent)
+	if _, ok := org.seen[key]; ok {
+		p.Log.Debugf("Skipping already collected event %s", key)
+		org.dropped["duplicate"]++
+		return
+	}
+	org.seen[key] = timestamp
+
+	if timestamp.After(org.newestEvent) {
+		org.newestEvent = timestamp
+	}
+
+	// Filtered events still move the cursor, they aren't coming back
+	if p.eventFilter != nil && !p.eventFilter.Match(auditLogEvent.Event) {
+		org.dropped["event_filter"]++
+		return
+	}
+
+	// Enrichment needs the real source IP and login, even when they aren't
+	// emitted
+	sourceIP := auditLogEvent.SourceIP
+
+	var team string
+	if p.TeamTag && auditLogEvent.User.GitHubLogin != "" {
+		team = p.userTeams(acc, org, auditLogEvent.User.GitHubLogin)
+	}
+
+	var hostname string
+	if p.reverseDNS != nil && sourceIP != "" {
+		hostname = p.reverseDNS.lookup(p.ctx, sourceIP)
+	}
+
+	if p.Anonymize {
+		auditLogEvent = p.anonymizeEvent(auditLogEvent)
+		hostname = p.pseudonym(hostname)
+
+		// The raw payload holds the very identifiers being hidden
+		anonymized, err := json.Marshal(auditLogEvent)
+		if err != nil {
+			p.Log.Errorf("Dropping event that failed to anonymize: %s", err)
+			org.dropped["anonymize_error"]++
+			return
+		}
+		raw = anonymized
+	}
+
+	if org.members != nil && auditLogEvent.User.GitHubLogin != "" {
+		org.members.record(auditLogEvent.User.GitHubLogin, timestamp)
+	}
+
+	tags := map[string]string{
+		"organization": org.name,
+		"event":        auditLogEvent.Event,
+		"category":     eventCategory(auditLogEvent.Event),
+		"source_ip":    auditLogEvent.SourceIP,
+	}
+
+	// Tells apart the pipelines acting as the same user
+	if auditLogEvent.TokenName != "" {
+		tags["token_name"] = auditLogEvent.TokenName
+	}
+
+	if team != "" {
+		tags["team"] = team
+	}
+
+	p.addGeoIPTags(tags, sourceIP)
+
+	// count is what most queries can sum, unlike the payload
+	fields := map[string]interface{}{
+		"count":   1,
+		"payload": string(raw),
+	}
+
+	p.addUserAttributes(tags, fields, auditLogEvent.User)
+
+	if hostname != "" {
+		fields["source_hostname"] = hostname
+	}
+
+	p.addSIEMFields(fields, auditLogEvent, timestamp)
+
+	if p.EventFormat == "log" {
+		fields = logFields(tags, fields, auditLogEvent)
+	}
+
+	p.Log.Debugf("Event with tags %v and fields %v", tags, fields)
+
+	acc.AddFields("pulumi_api", fields, tags, p.metricTime(fields, timestamp))
+	org.stats.eventsEmitted.Incr(1)
+	atomic.AddInt64(&org.auditEvents, 1)
+}
@@ -0,0 +1,169 @@
+package pulumi_api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// parseBackfillTime accepts a date, taken as midnight UTC, or a full
+// RFC3339 timestamp
+func parseBackfillTime(option string, value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q, must be a date or RFC3339 timestamp", option, value)
+	}
+
+	return t, nil
+}
+
+// backfillAuditLogs imports the history between backfill_from and the start
+// of the live cursor from the CSV export, once per organization. Paging the
+// live endpoint over months of history takes thousands of requests.
+func (p *PulumiApiConfig) backfillAuditLogs(acc telegraf.Accumulator, org *organization) {
+	if p.backfillFrom.IsZero() {
+		return
+	}
+
+	// Already done from this far back, or further
+	if !org.backfilledFrom.IsZero() && !org.backfilledFrom.After(p.backfillFrom) {
+		return
+	}
+
+	endTime := org.startTime(p.Overlap)
+	if !p.backfillFrom.Before(endTime) {
+		org.backfilledFrom = p.backfillFrom
+		return
+	}
+
+	p.Log.Infof("Backfilling audit logs for %s from %s to %s", org.name, p.backfillFrom.Format(time.RFC3339), endTime.Format(time.RFC3339))
+
+	req := apiRequest{
+		acc:          acc,
+		tenant:       org.tenant,
+		stats:        org.stats,
+		organization: org.name,
+		endpoint:     "auditlogs/export",
+		url:          fmt.Sprintf("%s/api/orgs/%s/auditlogs/export?format=csv&startTime=%d&endTime=%d", org.tenant.url, org.name, p.backfillFrom.Unix(), endTime.Unix()),
+	}
+
+	var count int
+	err := p.get(req, func(body io.Reader) error {
+		return p.decodeAuditLogExport(body, func(auditLogEvent AuditLogEvent) {
+			raw, err := json.Marshal(auditLogEvent)
+			if err != nil {
+				return
+			}
+
+			p.addAuditLogEvent(acc, org, auditLogEvent, raw)
+			count++
+		})
+	})
+
+	if err != nil {
+		// Events emitted before the error are deduplicated on the retry
+		p.addFetchError(acc, org, "audit_log_export", "", err)
+		return
+	}
+
+	org.backfilledFrom = p.backfillFrom
+
+	p.Log.Infof("Backfilled %d audit log events for %s", count, org.name)
+}
+
+// decodeAuditLogExport reads the CSV export a row at a time. Columns are
+// found by their header, ignoring case, spaces and underscores.
+func (p *PulumiApiConfig) decodeAuditLogExport(r io.Reader, each func(AuditLogEvent)) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.NewReplacer(" ", "", "_", "").Replace(strings.ToLower(name))
+		columns[name] = i
+	}
+
+	column := func(record []string, names ...string) string {
+		for _, name := range names {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return record[i]
+			}
+		}
+		return ""
+	}
+
+	if _, ok := columns["timestamp"]; !ok {
+		return fmt.Errorf("export has no timestamp column")
+	}
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		timestamp, err := p.exportTimestamp(column(record, "timestamp"))
+		if err != nil {
+			p.Log.Warnf("Skipping audit log export line %d: %s", line, err)
+			continue
+		}
+
+		each(AuditLogEvent{
+			Timestamp:   timestamp,
+			SourceIP:    column(record, "sourceip"),
+			Event:       column(record, "event"),
+			Description: column(record, "description"),
+			TokenID:     column(record, "tokenid"),
+			TokenName:   column(record, "tokenname"),
+			User: User{
+				Name:        column(record, "username", "user"),
+				GitHubLogin: column(record, "userlogin", "githublogin"),
+			},
+		})
+	}
+}
+
+// exportTimestamp converts an export timestamp, either numeric like the
+// live endpoint's or RFC3339, to the live endpoint's representation
+func (p *PulumiApiConfig) exportTimestamp(value string) (int64, error) {
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return n, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", value)
+	}
+
+	switch p.TimestampPrecision {
+	case "ms":
+		return t.UnixNano() / int64(time.Millisecond), nil
+	case "us":
+		return t.UnixNano() / int64(time.Microsecond), nil
+	case "ns":
+		return t.UnixNano(), nil
+	default:
+		return t.Unix(), nil
+	}
+}
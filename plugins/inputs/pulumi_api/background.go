@@ -0,0 +1,51 @@
+package pulumi_api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// startBackground polls every background_interval until Stop, buffering
+// what it collects for Gather to flush, so a slow API can't hold up the
+// agent. In realtime mode the audit logs are left to the realtime loop.
+func (p *PulumiApiConfig) startBackground() {
+	p.backgroundDone = make(chan struct{})
+
+	go func() {
+		defer close(p.backgroundDone)
+
+		ticker := time.NewTicker(time.Duration(p.BackgroundInterval))
+		defer ticker.Stop()
+
+		for {
+			p.gatherOrganizations(p.buffer, func(acc telegraf.Accumulator, org *organization) {
+				if !p.Realtime {
+					p.collectAuditLogs(acc, org)
+				}
+				p.gatherCollectors(acc, org)
+			})
+
+			p.addRateLimitMetrics(p.buffer)
+			p.addDeprecationMetrics(p.buffer)
+			if p.ClockSkewMetric {
+				p.addClockSkewMetrics(p.buffer)
+			}
+
+			if !p.Realtime {
+				if err := p.saveStateFile(); err != nil {
+					p.buffer.AddError(fmt.Errorf("saving state: %s", err))
+				}
+			}
+
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	p.Log.Infof("Polling every %s in the background", time.Duration(p.BackgroundInterval))
+}
@@ -0,0 +1,85 @@
+package pulumi_api
+
+import (
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// circuitBreaker stops collecting from an organization for a cool-down
+// after too many gathers in a row failed. Once it's over, a single gather
+// decides whether collection resumes or the breaker opens again.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// allow reports whether the organization may be collected from now
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return !now.Before(b.openUntil)
+}
+
+// record counts the outcome of a gather, reporting whether it opened the
+// breaker
+func (b *circuitBreaker) record(failed bool, threshold int, cooldown time.Duration, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.failures = 0
+		return false
+	}
+
+	b.failures++
+	if b.failures < threshold {
+		return false
+	}
+
+	b.openUntil = now.Add(cooldown)
+	return true
+}
+
+// guardGather runs gather for org unless its breaker is open, and keeps
+// the breaker up to date with how it went
+func (p *PulumiApiConfig) guardGather(acc telegraf.Accumulator, org *organization, gather func(telegraf.Accumulator, *organization)) {
+	if p.CircuitBreakerThreshold <= 0 {
+		gather(acc, org)
+		return
+	}
+
+	if org.breaker.allow(time.Now()) {
+		errors := org.stats.errors.Get()
+		gather(acc, org)
+
+		failed := org.stats.errors.Get() > errors
+		if org.breaker.record(failed, p.CircuitBreakerThreshold, time.Duration(p.CircuitBreakerCooldown), time.Now()) {
+			p.Log.Warnf("Pausing collection from %s for %s after %d failed gathers in a row", org.name, time.Duration(p.CircuitBreakerCooldown), p.CircuitBreakerThreshold)
+		}
+	}
+
+	p.addCircuitBreakerMetric(acc, org)
+}
+
+func (p *PulumiApiConfig) addCircuitBreakerMetric(acc telegraf.Accumulator, org *organization) {
+	org.breaker.mu.Lock()
+	failures, openUntil := org.breaker.failures, org.breaker.openUntil
+	org.breaker.mu.Unlock()
+
+	open := time.Now().Before(openUntil)
+
+	fields := map[string]interface{}{
+		"open":                 open,
+		"consecutive_failures": failures,
+	}
+
+	if open {
+		fields["seconds_until_retry"] = time.Until(openUntil).Seconds()
+	}
+
+	acc.AddGauge("pulumi_api_circuit_breaker", fields, map[string]string{"organization": org.name})
+}
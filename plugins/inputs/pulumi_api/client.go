@@ -0,0 +1,514 @@
+package pulumi_api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// rateLimit is the request budget reported by the most recent response
+type rateLimit struct {
+	Present   bool
+	Limit     int64
+	Remaining int64
+	Reset     time.Time
+}
+
+func (r rateLimit) String() string {
+	if !r.Present {
+		return "no rate limit information"
+	}
+
+	s := fmt.Sprintf("%d of %d requests remaining", r.Remaining, r.Limit)
+	if !r.Reset.IsZero() {
+		s = fmt.Sprintf("%s, resets at %s", s, r.Reset.Format(time.RFC3339))
+	}
+
+	return s
+}
+
+// rateLimitedError is returned when the API answers 429 Too Many Requests
+type rateLimitedError struct {
+	retryAfter time.Duration
+	rateLimit  rateLimit
+}
+
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited, retry after %s (%s)", e.retryAfter, e.rateLimit)
+}
+
+// statusError is an unsuccessful response, for callers that handle some
+// statuses, such as a 404 for something not configured, differently
+type statusError struct {
+	statusCode int
+	err        error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func isNotFound(err error) bool {
+	var status *statusError
+	return errors.As(err, &status) && status.statusCode == http.StatusNotFound
+}
+
+// cachedResponse is the last body returned for a URL, along with its ETag.
+// The realtime loop and Gather can fetch the same URL at once.
+type cachedResponse struct {
+	mu   sync.Mutex
+	etag string
+	body []byte
+}
+
+func (c *cachedResponse) get() (string, []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.etag, c.body
+}
+
+func (c *cachedResponse) set(etag string, body []byte) {
+	c.mu.Lock()
+	c.etag, c.body = etag, body
+	c.mu.Unlock()
+}
+
+// apiRequest is a single call to the Pulumi API, which may take several
+// attempts to complete
+type apiRequest struct {
+	acc    telegraf.Accumulator
+	tenant *tenant
+	stats  *stats
+
+	organization string
+
+	// endpoint names what is being called in request metrics, unlike the
+	// URL it has to be low cardinality
+	endpoint string
+	url      string
+
+	// method is GET unless set
+	method string
+
+	// once sends the request a single time, for those not safe to repeat
+	once bool
+
+	// roundTrip, if set, is given how long the last attempt took from
+	// sending the request to reading the body, without the waits before it
+	roundTrip *time.Duration
+
+	cached *cachedResponse
+}
+
+func (r apiRequest) httpMethod() string {
+	if r.method == "" {
+		return http.MethodGet
+	}
+
+	return r.method
+}
+
+// get sends an authenticated request to the Pulumi API and streams the body
+// of a successful response to decode. Network errors and 5xx responses are
+// retried with exponential backoff.
+func (p *PulumiApiConfig) get(req apiRequest, decode func(io.Reader) error) error {
+	return p.request(req, decode)
+}
+
+// post is get for the few endpoints that evaluate something rather than
+// read it, like opening an ESC environment. They're never cached, and
+// never retried, as every call has effects of its own.
+func (p *PulumiApiConfig) post(req apiRequest, decode func(io.Reader) error) error {
+	req.method = http.MethodPost
+	req.once = true
+	return p.request(req, decode)
+}
+
+// getConditional is get for slow-changing data. The last response is kept
+// and revalidated with If-None-Match, so when the API answers 304 Not
+// Modified the cached body is decoded again without costing any quota.
+func (p *PulumiApiConfig) getConditional(req apiRequest, decode func(io.Reader) error) error {
+	p.mu.Lock()
+	cached, ok := p.responseCache[req.url]
+	if !ok {
+		cached = &cachedResponse{}
+		p.responseCache[req.url] = cached
+	}
+	p.mu.Unlock()
+
+	req.cached = cached
+	return p.request(req, decode)
+}
+
+func (p *PulumiApiConfig) request(req apiRequest, decode func(io.Reader) error) error {
+	var lastErr error
+
+	for attempt := 0; attempt <= p.MaxRetries; attempt++ {
+		if attempt > 0 {
+			delay := p.retryDelay(attempt)
+
+			var rateLimited *rateLimitedError
+			if errors.As(lastErr, &rateLimited) && rateLimited.retryAfter > 0 {
+				delay = rateLimited.retryAfter
+			}
+
+			p.Log.Debugf("Retrying request in %s (attempt %d of %d): %s", delay, attempt, p.MaxRetries, lastErr)
+
+			select {
+			case <-p.ctx.Done():
+				return p.ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		retryable, err := p.attempt(req, decode)
+
+		// A rotated token is picked up without waiting for a restart, an
+		// exchanged one is exchanged again
+		if isUnauthorized(err) && (p.reloadToken(req.tenant) || req.tenant.expireToken()) {
+			retryable, err = p.attempt(req, decode)
+		}
+
+		if err == nil {
+			return nil
+		}
+
+		if !retryable || req.once {
+			return err
+		}
+
+		// Waiting out a long rate limit would stall the whole gather, let
+		// the next interval try again instead
+		var rateLimited *rateLimitedError
+		if errors.As(err, &rateLimited) && rateLimited.retryAfter > time.Duration(p.MaxRetryAfter) {
+			return err
+		}
+
+		lastErr = err
+	}
+
+	return fmt.Errorf("giving up after %d retries: %w", p.MaxRetries, lastErr)
+}
+
+// attempt makes a single request in a span of its own
+func (p *PulumiApiConfig) attempt(req apiRequest, decode func(io.Reader) error) (bool, error) {
+	// Every attempt, retries included, comes out of the same budget
+	if p.limiter != nil {
+		if err := p.limiter.Wait(p.ctx); err != nil {
+			return false, err
+		}
+	}
+
+	// Only errors the API itself rejected aren't worth trying again
+	if err := p.refreshToken(req.tenant); err != nil {
+		var status *statusError
+		return !errors.As(err, &status) || status.statusCode >= http.StatusInternalServerError, err
+	}
+
+	ctx, span := p.startSpan(req)
+	retryable, err := p.doGet(ctx, req, decode)
+	endSpan(span, err)
+
+	return retryable, err
+}
+
+func (p *PulumiApiConfig) retryDelay(attempt int) time.Duration {
+	delay := time.Duration(p.RetryBaseDelay) << (attempt - 1)
+
+	if p.RetryJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(p.RetryJitter)))
+	}
+
+	return delay
+}
+
+// doGet makes a single request, reporting whether a failure is worth retrying.
+// Failures while decoding aren't, as part of the body may have been emitted.
+func (p *PulumiApiConfig) doGet(ctx context.Context, req apiRequest, decode func(io.Reader) error) (bool, error) {
+	cached := req.cached
+
+	// The ETag sent and the body a 304 stands for have to go together
+	var etag string
+	var cachedBody []byte
+	if cached != nil {
+		etag, cachedBody = cached.get()
+	}
+
+	// ctx derives from the plugin context so Stop aborts the request, the
+	// client timeout bounds each individual attempt
+	request, err := http.NewRequestWithContext(ctx, req.httpMethod(), req.url, nil)
+
+	if err != nil {
+		return false, err
+	}
+
+	request.Header.Set("Accept", "application/vnd.pulumi+8")
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", p.UserAgent)
+	request.Header.Set("Authorization", fmt.Sprintf("token %s", p.token(req.tenant)))
+
+	// Setting Accept-Encoding ourselves stops the transport from doing it
+	// transparently, so we get to see the compressed size on the wire
+	if p.Compression == "gzip" {
+		request.Header.Set("Accept-Encoding", "gzip")
+	} else {
+		request.Header.Set("Accept-Encoding", "identity")
+	}
+
+	if etag != "" {
+		request.Header.Set("If-None-Match", etag)
+	}
+
+	injectTraceContext(ctx, request)
+
+	req.stats.requests.Incr(1)
+
+	start := time.Now()
+	statusCode := 0
+	received := &countingReader{stat: req.stats.bytesReceived}
+
+	if req.roundTrip != nil {
+		defer func() {
+			*req.roundTrip = time.Since(start)
+		}()
+	}
+
+	// Requests made during Init have nowhere to report to
+	if p.RequestMetrics && req.acc != nil {
+		defer func() {
+			p.addRequestMetric(req, statusCode, time.Since(start), received.n)
+		}()
+	}
+
+	resp, err := p.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+
+	defer resp.Body.Close()
+
+	statusCode = resp.StatusCode
+	received.reader = resp.Body
+
+	trace.SpanFromContext(ctx).SetAttributes(semconv.HTTPStatusCodeKey.Int(statusCode))
+
+	decompressed, err := responseBody(resp, received)
+	if err != nil {
+		return true, err
+	}
+	defer decompressed.Close()
+
+	var body io.Reader = decompressed
+	if p.MaxResponseSize > 0 {
+		body = &limitedReader{reader: body, remaining: int64(p.MaxResponseSize)}
+	}
+
+	if p.DumpResponsesDir != "" {
+		var dump bytes.Buffer
+		body = io.TeeReader(body, &dump)
+
+		defer func() {
+			p.dumpResponse(req, request, resp, dump.Bytes())
+		}()
+	}
+
+	limit := parseRateLimit(resp.Header)
+
+	if limit.Present {
+		p.mu.Lock()
+		req.tenant.rateLimit = limit
+		p.mu.Unlock()
+	}
+
+	p.recordDeprecation(req, resp.Header)
+	p.recordClockSkew(req, resp.Header, start, time.Now())
+
+	if resp.StatusCode == http.StatusNotModified && etag != "" {
+		p.Log.Debugf("Not modified, using cached response: %s", req.url)
+		return false, decode(bytes.NewReader(cachedBody))
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		if cached == nil {
+			return false, decode(body)
+		}
+
+		var buffer bytes.Buffer
+		if err := decode(io.TeeReader(body, &buffer)); err != nil {
+			return false, err
+		}
+
+		// Only cache bodies that decoded, a 304 for a broken one would
+		// otherwise break us until the data next changes
+		cached.set(resp.Header.Get("ETag"), buffer.Bytes())
+
+		return false, nil
+	}
+
+	bytes, err := io.ReadAll(body)
+	if err != nil {
+		return true, err
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+		if retryAfter == 0 && !limit.Reset.IsZero() {
+			retryAfter = time.Until(limit.Reset)
+		}
+
+		p.Log.Warnf("Rate limited by the Pulumi API, %s", limit)
+
+		return true, &rateLimitedError{retryAfter: retryAfter, rateLimit: limit}
+	}
+
+	retryable := resp.StatusCode >= http.StatusInternalServerError
+
+	var apiErrorResponse ApiError
+	err = json.Unmarshal(bytes, &apiErrorResponse)
+
+	if err != nil {
+		// Ruhoh
+		return retryable, &statusError{statusCode: resp.StatusCode, err: fmt.Errorf("status %d: %s", resp.StatusCode, err)}
+	}
+
+	return retryable, &statusError{statusCode: resp.StatusCode, err: fmt.Errorf("error code %d: %s", apiErrorResponse.Code, apiErrorResponse.Message)}
+}
+
+// responseBody decompresses the body read through received if needed
+func responseBody(resp *http.Response, received io.Reader) (io.ReadCloser, error) {
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return io.NopCloser(received), nil
+	}
+
+	return gzip.NewReader(received)
+}
+
+// limitedReader fails the read going over max_response_size rather than
+// truncating, a cut off body would only fail to decode further on
+type limitedReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (r *limitedReader) Read(b []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, errResponseTooLarge
+	}
+
+	// Reading one byte past the limit tells a body of exactly the limit
+	// from one that's larger
+	if int64(len(b)) > r.remaining+1 {
+		b = b[:r.remaining+1]
+	}
+
+	n, err := r.reader.Read(b)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n + int(r.remaining), errResponseTooLarge
+	}
+
+	return n, err
+}
+
+var errResponseTooLarge = errors.New("response larger than max_response_size")
+
+// addRequestMetric records a single attempt, with a status code of 0 meaning
+// no response was received at all
+func (p *PulumiApiConfig) addRequestMetric(req apiRequest, statusCode int, responseTime time.Duration, responseBytes int64) {
+	tags := map[string]string{
+		"endpoint":    req.endpoint,
+		"status_code": strconv.Itoa(statusCode),
+	}
+	if req.organization != "" {
+		tags["organization"] = req.organization
+	}
+
+	fields := map[string]interface{}{
+		"response_time":  responseTime.Seconds(),
+		"response_bytes": responseBytes,
+		"success":        statusCode == http.StatusOK || statusCode == http.StatusNotModified,
+	}
+
+	req.acc.AddFields("pulumi_api_request", fields, tags)
+}
+
+// addRateLimitMetrics reports the request budget of every tenant
+func (p *PulumiApiConfig) addRateLimitMetrics(acc telegraf.Accumulator) {
+	for _, t := range p.tenants {
+		p.addRateLimitMetric(acc, t)
+	}
+}
+
+// addRateLimitMetric reports the request budget from the latest response
+func (p *PulumiApiConfig) addRateLimitMetric(acc telegraf.Accumulator, t *tenant) {
+	p.mu.Lock()
+	limit := t.rateLimit
+	p.mu.Unlock()
+
+	if !limit.Present {
+		return
+	}
+
+	fields := map[string]interface{}{
+		"limit":     limit.Limit,
+		"remaining": limit.Remaining,
+	}
+
+	if !limit.Reset.IsZero() {
+		fields["reset"] = limit.Reset.Unix()
+		fields["seconds_until_reset"] = time.Until(limit.Reset).Seconds()
+	}
+
+	if limit.Limit > 0 {
+		fields["used_percent"] = 100 * float64(limit.Limit-limit.Remaining) / float64(limit.Limit)
+	}
+
+	acc.AddGauge("pulumi_api_rate_limit", fields, t.tags())
+}
+
+func parseRateLimit(header http.Header) rateLimit {
+	var r rateLimit
+
+	r.Present = header.Get("X-RateLimit-Limit") != "" || header.Get("X-RateLimit-Remaining") != ""
+	r.Limit, _ = strconv.ParseInt(header.Get("X-RateLimit-Limit"), 10, 64)
+	r.Remaining, _ = strconv.ParseInt(header.Get("X-RateLimit-Remaining"), 10, 64)
+
+	if reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil && reset > 0 {
+		r.Reset = time.Unix(reset, 0)
+	}
+
+	return r
+}
+
+// Retry-After is either a number of seconds or an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,77 @@
+package pulumi_api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// clockSkew is how far the local clock is ahead of the API's, from the Date
+// header of the latest response, negative if it's behind
+type clockSkew struct {
+	skew   time.Duration
+	known  bool
+	warned bool
+}
+
+// measureClockSkew compares the Date header with the local time halfway
+// through the request. The header only has whole seconds, so it's taken to
+// be the middle of its second, which leaves half a second of error either way
+// on top of the network's.
+func measureClockSkew(header http.Header, start time.Time, end time.Time) (time.Duration, bool) {
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		return 0, false
+	}
+
+	local := start.Add(end.Sub(start) / 2)
+	return local.Sub(date.Add(500 * time.Millisecond)), true
+}
+
+// recordClockSkew keeps the tenant's clock skew, warning when it grows past
+// max_clock_skew. The audit logs cursor mixes local and API times, so a skew
+// that large can make it skip or repeat events.
+func (p *PulumiApiConfig) recordClockSkew(req apiRequest, header http.Header, start time.Time, end time.Time) {
+	skew, ok := measureClockSkew(header, start, end)
+	if !ok {
+		return
+	}
+
+	max := time.Duration(p.MaxClockSkew)
+	large := max > 0 && (skew > max || skew < -max)
+
+	p.mu.Lock()
+	c := &req.tenant.clockSkew
+	warn := large && !c.warned
+	recovered := !large && c.warned
+	c.skew, c.known, c.warned = skew, true, large
+	p.mu.Unlock()
+
+	if warn {
+		p.Log.Warnf("The local clock is %s off the Pulumi API's, more than max_clock_skew; audit events may be skipped or collected twice, check the host's time sync", skew.Round(time.Second))
+	}
+	if recovered {
+		p.Log.Infof("The local clock is back within max_clock_skew of the Pulumi API's, %s off", skew.Round(time.Second))
+	}
+}
+
+// addClockSkewMetrics reports the clock skew of every tenant measured yet
+func (p *PulumiApiConfig) addClockSkewMetrics(acc telegraf.Accumulator) {
+	for _, t := range p.tenants {
+		p.mu.Lock()
+		c := t.clockSkew
+		p.mu.Unlock()
+
+		if !c.known {
+			continue
+		}
+
+		fields := map[string]interface{}{
+			"skew_seconds": c.skew.Seconds(),
+			"exceeded":     c.warned,
+		}
+
+		acc.AddGauge("pulumi_api_clock_skew", fields, t.tags())
+	}
+}
@@ -0,0 +1,153 @@
+package pulumi_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// Collector gathers one part of the Pulumi API, other than the audit logs,
+// for a single organization. Every organization gets instances of its own,
+// so a collector is free to keep state between gathers.
+type Collector interface {
+	// Name identifies the collector's state, it mustn't change
+	Name() string
+
+	Gather(acc telegraf.Accumulator)
+
+	// Interval is the least time between two gathers, zero to run on
+	// every gather
+	Interval() time.Duration
+
+	// State is a pointer to what needs to survive a restart, marshalled
+	// into the plugin's state as JSON, or nil
+	State() interface{}
+}
+
+// collectorFactory returns the organization's instance of a collector, or
+// nil when it isn't enabled
+type collectorFactory func(p *PulumiApiConfig, org *organization) Collector
+
+// collectors run in this order, a new one only needs adding here
+var collectors = []collectorFactory{
+	newStacksCollector,
+	newUsageCollector,
+	newRetentionCollector,
+	newStackUsageCollector,
+	newESCCollector,
+	newMembersCollector,
+	newInsightsCollector,
+}
+
+// funcCollector is a Collector without state that runs on every gather
+type funcCollector struct {
+	name   string
+	gather func(acc telegraf.Accumulator)
+}
+
+func (c *funcCollector) Name() string {
+	return c.name
+}
+
+func (c *funcCollector) Gather(acc telegraf.Accumulator) {
+	c.gather(acc)
+}
+
+func (c *funcCollector) Interval() time.Duration {
+	return 0
+}
+
+func (c *funcCollector) State() interface{} {
+	return nil
+}
+
+// scheduledCollector remembers when its collector last ran
+type scheduledCollector struct {
+	Collector
+	gatheredAt time.Time
+}
+
+func (c *scheduledCollector) due(now time.Time) bool {
+	return c.Interval() <= 0 || now.Sub(c.gatheredAt) >= c.Interval()
+}
+
+// newCollectors instantiates the enabled collectors for org, only those
+// sharded per stack when another shard owns it
+func (p *PulumiApiConfig) newCollectors(org *organization) {
+	org.collectors = nil
+
+	for _, factory := range collectors {
+		collector := factory(p, org)
+		if collector == nil {
+			continue
+		}
+
+		if sharded, ok := collector.(shardedCollector); !org.owned && (!ok || !sharded.Sharded()) {
+			continue
+		}
+
+		org.collectors = append(org.collectors, &scheduledCollector{Collector: collector})
+	}
+}
+
+// gatherCollectors runs every collector of org that's due
+func (p *PulumiApiConfig) gatherCollectors(acc telegraf.Accumulator, org *organization) {
+	now := time.Now()
+
+	if p.SourceTags {
+		acc = newSourceTaggingAccumulator(acc, org)
+	}
+
+	for _, collector := range org.collectors {
+		if !collector.due(now) {
+			continue
+		}
+
+		collector.gatheredAt = now
+		collector.Gather(acc)
+	}
+}
+
+// collectorState marshals the state of org's collectors, by name
+func (o *organization) collectorState() map[string]json.RawMessage {
+	var states map[string]json.RawMessage
+
+	for _, collector := range o.collectors {
+		state := collector.State()
+		if state == nil {
+			continue
+		}
+
+		bytes, err := json.Marshal(state)
+		if err != nil {
+			continue
+		}
+
+		if states == nil {
+			states = make(map[string]json.RawMessage)
+		}
+		states[collector.Name()] = bytes
+	}
+
+	return states
+}
+
+// setCollectorState restores the state of org's collectors, collectors
+// without any saved keep their defaults
+func (o *organization) setCollectorState(states map[string]json.RawMessage) error {
+	for _, collector := range o.collectors {
+		raw, ok := states[collector.Name()]
+		state := collector.State()
+		if !ok || state == nil {
+			continue
+		}
+
+		if err := json.Unmarshal(raw, state); err != nil {
+			return fmt.Errorf("invalid state of the %s collector: %s", collector.Name(), err)
+		}
+	}
+
+	return nil
+}
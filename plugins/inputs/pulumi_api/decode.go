@@ -0,0 +1,238 @@
+package pulumi_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/selfstat"
+)
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// schemaDrift decodes API responses field by field, so a renamed field or a
+// changed type costs us that one value rather than the whole response. Every
+// anomaly is counted, but only logged the first time it is seen.
+type schemaDrift struct {
+	log       telegraf.Logger
+	anomalies selfstat.Stat
+
+	mu       sync.Mutex
+	reported map[string]bool
+}
+
+func newSchemaDrift(log telegraf.Logger, anomalies selfstat.Stat) *schemaDrift {
+	return &schemaDrift{
+		log:       log,
+		anomalies: anomalies,
+		reported:  make(map[string]bool),
+	}
+}
+
+func (d *schemaDrift) report(path string, format string, args ...interface{}) {
+	d.anomalies.Incr(1)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.reported[path] {
+		return
+	}
+	d.reported[path] = true
+
+	d.log.Warnf("Unexpected API response schema at %s: %s", path, fmt.Sprintf(format, args...))
+}
+
+// decode fills v, a pointer to a struct, from the JSON object in data. It
+// only fails when data isn't an object at all.
+func (d *schemaDrift) decode(path string, data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v).Elem()
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	fields := jsonFields(rv.Type())
+
+	for key, value := range raw {
+		index, ok := lookupField(fields, key)
+		if !ok {
+			d.report(path+"."+key, "unknown field")
+			continue
+		}
+
+		d.decodeValue(path+"."+key, value, rv.Field(index))
+	}
+
+	return nil
+}
+
+// decodeStream is decode reading from r, except that the array under key is
+// handed to each an element at a time as it is read, rather than buffered
+func (d *schemaDrift) decodeStream(path string, r io.Reader, v interface{}, key string, each func(json.RawMessage) error) error {
+	rv := reflect.ValueOf(v).Elem()
+	fields := jsonFields(rv.Type())
+
+	decoder := json.NewDecoder(r)
+	if err := expectDelim(decoder, '{'); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		name := token.(string)
+
+		if name == key {
+			if err := decodeArrayStream(decoder, each); err != nil {
+				return fmt.Errorf("%s.%s: %s", path, name, err)
+			}
+			continue
+		}
+
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return fmt.Errorf("%s.%s: %s", path, name, err)
+		}
+
+		index, ok := lookupField(fields, name)
+		if !ok {
+			d.report(path+"."+name, "unknown field")
+			continue
+		}
+
+		d.decodeValue(path+"."+name, value, rv.Field(index))
+	}
+
+	if err := expectDelim(decoder, '}'); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	return nil
+}
+
+func decodeArrayStream(decoder *json.Decoder, each func(json.RawMessage) error) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("expected an array, got %v", token)
+	}
+
+	for decoder.More() {
+		var element json.RawMessage
+		if err := decoder.Decode(&element); err != nil {
+			return err
+		}
+
+		if err := each(element); err != nil {
+			return err
+		}
+	}
+
+	return expectDelim(decoder, ']')
+}
+
+func expectDelim(decoder *json.Decoder, expected json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	if delim, ok := token.(json.Delim); !ok || delim != expected {
+		return fmt.Errorf("expected %s, got %v", expected, token)
+	}
+
+	return nil
+}
+
+func (d *schemaDrift) decodeValue(path string, data []byte, field reflect.Value) {
+	ptr := field.Addr().Interface()
+
+	if isPlainStruct(field.Type()) {
+		if err := d.decode(path, data, ptr); err != nil {
+			d.report(path, "%s", err)
+		}
+		return
+	}
+
+	// Decode slices of objects element by element, so one bad element
+	// doesn't take the rest of the page with it
+	if field.Kind() == reflect.Slice && isPlainStruct(field.Type().Elem()) {
+		var elements []json.RawMessage
+		if err := json.Unmarshal(data, &elements); err != nil {
+			d.report(path, "%s", err)
+			return
+		}
+
+		slice := reflect.MakeSlice(field.Type(), 0, len(elements))
+		for _, element := range elements {
+			value := reflect.New(field.Type().Elem())
+
+			if err := d.decode(path+"[]", element, value.Interface()); err != nil {
+				d.report(path+"[]", "dropping element: %s", err)
+				continue
+			}
+
+			slice = reflect.Append(slice, value.Elem())
+		}
+
+		field.Set(slice)
+		return
+	}
+
+	if err := json.Unmarshal(data, ptr); err != nil {
+		d.report(path, "%s", err)
+	}
+}
+
+func isPlainStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && !reflect.PtrTo(t).Implements(jsonUnmarshalerType)
+}
+
+func lookupField(fields map[string]int, key string) (int, bool) {
+	if index, ok := fields[key]; ok {
+		return index, true
+	}
+
+	index, ok := fields[strings.ToLower(key)]
+	return index, ok
+}
+
+// jsonFields maps JSON keys, exact and lower cased, to struct field indexes
+func jsonFields(t reflect.Type) map[string]int {
+	fields := make(map[string]int)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := field.Name
+		if tag := field.Tag.Get("json"); tag != "" {
+			name = strings.Split(tag, ",")[0]
+		}
+		if name == "-" {
+			continue
+		}
+
+		fields[name] = i
+		if _, ok := fields[strings.ToLower(name)]; !ok {
+			fields[strings.ToLower(name)] = i
+		}
+	}
+
+	return fields
+}
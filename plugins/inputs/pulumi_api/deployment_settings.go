@@ -0,0 +1,199 @@
+package pulumi_api
+
+import (
+	"fmt"
+	"io"
+	neturl "net/url"
+	"strings"
+
+	"github.com/influxdata/telegraf"
+)
+
+// Environment variables holding long-lived cloud credentials, the ones
+// OIDC makes unnecessary
+var staticCredentialVariables = []string{
+	"AWS_ACCESS_KEY_ID",
+	"AWS_SECRET_ACCESS_KEY",
+	"ARM_CLIENT_SECRET",
+	"AZURE_CLIENT_SECRET",
+	"GOOGLE_CREDENTIALS",
+	"GOOGLE_APPLICATION_CREDENTIALS",
+}
+
+type DeploymentSettings struct {
+	SourceContext    SourceContext    `json:"sourceContext"`
+	OperationContext OperationContext `json:"operationContext"`
+}
+
+type SourceContext struct {
+	Git GitSource `json:"git"`
+}
+
+type GitSource struct {
+	RepoURL string `json:"repoUrl"`
+	Branch  string `json:"branch"`
+	RepoDir string `json:"repoDir"`
+}
+
+type OperationContext struct {
+	// Provider configuration is only checked for presence
+	OIDC                 map[string]map[string]interface{} `json:"oidc"`
+	EnvironmentVariables map[string]interface{}            `json:"environmentVariables"`
+}
+
+// sourceTags are the repository and branch the stack deploys from, the
+// repository without scheme or .git suffix so it matches however it's
+// cloned, and the branch without refs/heads/
+func (s GitSource) sourceTags() map[string]string {
+	tags := make(map[string]string)
+
+	if s.RepoURL != "" {
+		repository := strings.TrimSuffix(s.RepoURL, ".git")
+		if i := strings.Index(repository, "://"); i >= 0 {
+			repository = repository[i+3:]
+		}
+		tags["repository"] = repository
+	}
+
+	if s.Branch != "" {
+		tags["branch"] = strings.TrimPrefix(s.Branch, "refs/heads/")
+	}
+
+	return tags
+}
+
+func (s DeploymentSettings) usesOIDC() bool {
+	for _, provider := range s.OperationContext.OIDC {
+		if len(provider) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s DeploymentSettings) usesStaticCredentials() bool {
+	for _, name := range staticCredentialVariables {
+		if _, ok := s.OperationContext.EnvironmentVariables[name]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// listDeploymentSettings returns the deployment settings of the stacks
+// that have Pulumi Deployments configured, by project/stack. Stacks whose
+// settings failed to fetch are reported and left out.
+func (p *PulumiApiConfig) listDeploymentSettings(acc telegraf.Accumulator, org *organization, stacks []StackSummary) map[string]DeploymentSettings {
+	configured := make(map[string]DeploymentSettings)
+
+	for _, stack := range stacks {
+		settings, ok, err := p.fetchDeploymentSettings(acc, org, stack)
+		if err != nil {
+			p.addFetchError(acc, org, "deployment_settings", stack.Key(), err)
+			continue
+		}
+		if ok {
+			configured[stack.Key()] = settings
+		}
+	}
+
+	return configured
+}
+
+// updateStackSources keeps the source tags of the stacks deploying from a
+// repository, for source_tags
+func (o *organization) updateStackSources(settings map[string]DeploymentSettings) {
+	o.sources = make(map[string]map[string]string, len(settings))
+
+	for key, stackSettings := range settings {
+		if tags := stackSettings.SourceContext.Git.sourceTags(); len(tags) > 0 {
+			o.sources[key] = tags
+		}
+	}
+}
+
+// gatherDeploymentSettings emits whether each stack with Pulumi Deployments
+// configured gets its cloud credentials through OIDC or static secrets,
+// along with the counts per organization
+func (p *PulumiApiConfig) gatherDeploymentSettings(acc telegraf.Accumulator, org *organization, stacks []StackSummary, configured map[string]DeploymentSettings) {
+	oidc, static := 0, 0
+
+	for _, stack := range stacks {
+		settings, ok := configured[stack.Key()]
+		if !ok {
+			continue
+		}
+
+		usesOIDC := settings.usesOIDC()
+		usesStatic := settings.usesStaticCredentials()
+
+		if usesOIDC {
+			oidc++
+		}
+		if usesStatic {
+			static++
+		}
+
+		tags := map[string]string{
+			"organization": org.name,
+			"project":      stack.ProjectName,
+			"stack":        stack.StackName,
+		}
+
+		fields := map[string]interface{}{
+			"oidc":               usesOIDC,
+			"static_credentials": usesStatic,
+		}
+
+		acc.AddGauge("pulumi_deployment_settings", fields, tags)
+	}
+
+	tags := map[string]string{
+		"organization": org.name,
+	}
+	p.addShardTag(tags)
+
+	fields := map[string]interface{}{
+		"stacks":                   len(stacks),
+		"configured_stacks":        len(configured),
+		"oidc_stacks":              oidc,
+		"static_credential_stacks": static,
+	}
+
+	acc.AddGauge("pulumi_deployment_settings", fields, tags)
+}
+
+// fetchDeploymentSettings returns the stack's deployment settings, which
+// don't exist when Pulumi Deployments isn't set up for it
+func (p *PulumiApiConfig) fetchDeploymentSettings(acc telegraf.Accumulator, org *organization, stack StackSummary) (DeploymentSettings, bool, error) {
+	req := apiRequest{
+		acc:          acc,
+		tenant:       org.tenant,
+		stats:        org.stats,
+		organization: org.name,
+		endpoint:     "deployments/settings",
+		url: fmt.Sprintf("%s/api/stacks/%s/%s/%s/deployments/settings", org.tenant.url,
+			neturl.PathEscape(org.name), neturl.PathEscape(stack.ProjectName), neturl.PathEscape(stack.StackName)),
+	}
+
+	var settings DeploymentSettings
+	err := p.getConditional(req, func(body io.Reader) error {
+		bytes, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+
+		return org.drift.decode("deployments/settings", bytes, &settings)
+	})
+
+	if isNotFound(err) {
+		return DeploymentSettings{}, false, nil
+	}
+	if err != nil {
+		return DeploymentSettings{}, false, err
+	}
+
+	return settings, true, nil
+}
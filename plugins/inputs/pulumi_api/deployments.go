@@ -0,0 +1,273 @@
+package pulumi_api
+
+import (
+	"fmt"
+	"io"
+	neturl "net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// Queued and running deployments are the newest, so one page of this size
+// holds them all short of a badly stalled pipeline
+const deploymentsPageSize = 100
+
+type DeploymentsResponse struct {
+	Deployments []Deployment `json:"deployments"`
+}
+
+type Deployment struct {
+	ID       string `json:"id"`
+	Created  string `json:"created"`
+	Modified string `json:"modified"`
+	Status   string `json:"status"`
+	Version  int64  `json:"version"`
+}
+
+func (d Deployment) queued() bool {
+	return d.Status == "not-started" || d.Status == "accepted"
+}
+
+func (d Deployment) running() bool {
+	return d.Status == "running"
+}
+
+type DeploymentLogsResponse struct {
+	Lines     []DeploymentLogLine `json:"lines"`
+	NextToken string              `json:"nextToken"`
+}
+
+type DeploymentLogLine struct {
+	Header    string `json:"header"`
+	Timestamp string `json:"timestamp"`
+	Line      string `json:"line"`
+}
+
+// gatherDeployments lists each stack's deployments once for
+// pending_deployments and deployment_logs
+func (p *PulumiApiConfig) gatherDeployments(acc telegraf.Accumulator, org *organization, stacks []StackSummary) {
+	for _, stack := range stacks {
+		deployments, err := p.fetchDeployments(acc, org, stack)
+		if err != nil {
+			p.addFetchError(acc, org, "deployments", stack.Key(), err)
+			continue
+		}
+
+		if p.PendingDeployments {
+			p.addPendingDeployments(acc, org, stack, deployments)
+		}
+
+		if p.DeploymentLogs {
+			p.scanFailedDeployments(acc, org, stack, deployments)
+		}
+	}
+}
+
+// addPendingDeployments emits how many deployments the stack has queued or
+// running, and how long the oldest of them has been waiting, so stalled
+// pipelines stand out
+func (p *PulumiApiConfig) addPendingDeployments(acc telegraf.Accumulator, org *organization, stack StackSummary, deployments []Deployment) {
+	queued, running := 0, 0
+	var oldest time.Time
+
+	for _, deployment := range deployments {
+		switch {
+		case deployment.queued():
+			queued++
+		case deployment.running():
+			running++
+		default:
+			continue
+		}
+
+		created, err := time.Parse(time.RFC3339, deployment.Created)
+		if err == nil && (oldest.IsZero() || created.Before(oldest)) {
+			oldest = created
+		}
+	}
+
+	tags := map[string]string{
+		"organization": org.name,
+		"project":      stack.ProjectName,
+		"stack":        stack.StackName,
+	}
+
+	fields := map[string]interface{}{
+		"queued":  queued,
+		"running": running,
+	}
+
+	if !oldest.IsZero() {
+		fields["oldest_pending_seconds"] = time.Since(oldest).Seconds()
+	}
+
+	acc.AddGauge("pulumi_pending_deployments", fields, tags)
+}
+
+// scanFailedDeployments emits the error lines in the logs of the stack's
+// deployments that failed since the last scan. The first time a stack is
+// seen only its newest failure is scanned, rather than its whole history.
+func (p *PulumiApiConfig) scanFailedDeployments(acc telegraf.Accumulator, org *organization, stack StackSummary, deployments []Deployment) {
+	sorted := append([]Deployment(nil), deployments...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+
+	scanned, ok := org.scannedDeployments[stack.Key()]
+
+	var newestFailure int64
+	if !ok {
+		for _, deployment := range sorted {
+			if deployment.Status == "failed" {
+				newestFailure = deployment.Version
+			}
+		}
+	}
+
+	for _, deployment := range sorted {
+		if deployment.Version <= scanned {
+			continue
+		}
+
+		// Deployments run one at a time, so the cursor stops at the first
+		// one that hasn't finished
+		if deployment.queued() || deployment.running() {
+			break
+		}
+
+		if deployment.Status == "failed" && deployment.Version >= newestFailure {
+			lines, err := p.fetchDeploymentLogs(acc, org, stack, deployment)
+			if err != nil {
+				p.addFetchError(acc, org, "deployments/logs", stack.Key(), err)
+				break
+			}
+
+			p.addDeploymentErrors(acc, org, stack, deployment, lines)
+		}
+
+		scanned = deployment.Version
+	}
+
+	org.scannedDeployments[stack.Key()] = scanned
+}
+
+// deploymentError returns the message of a diagnostic error line, the CLI
+// prints them indented under the resource they're about
+func deploymentError(line string) (string, bool) {
+	trimmed := strings.TrimSpace(line)
+	if len(trimmed) < len("error:") || !strings.EqualFold(trimmed[:len("error:")], "error:") {
+		return "", false
+	}
+
+	return strings.TrimSpace(trimmed[len("error:"):]), true
+}
+
+func (p *PulumiApiConfig) addDeploymentErrors(acc telegraf.Accumulator, org *organization, stack StackSummary, deployment Deployment, lines []DeploymentLogLine) {
+	errorLines := 0
+	firstError := ""
+
+	for _, line := range lines {
+		message, ok := deploymentError(line.Line)
+		if !ok {
+			continue
+		}
+
+		if errorLines == 0 {
+			firstError = message
+		}
+		errorLines++
+	}
+
+	tags := map[string]string{
+		"organization": org.name,
+		"project":      stack.ProjectName,
+		"stack":        stack.StackName,
+	}
+
+	fields := map[string]interface{}{
+		"deployment_id": deployment.ID,
+		"version":       deployment.Version,
+		"error_lines":   errorLines,
+	}
+	if firstError != "" {
+		fields["first_error"] = firstError
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, deployment.Modified)
+	if err != nil {
+		timestamp = time.Now()
+	}
+
+	acc.AddFields("pulumi_deployment_errors", fields, tags, p.metricTime(fields, timestamp))
+}
+
+// fetchDeployments returns the stack's most recent deployments, newest first
+func (p *PulumiApiConfig) fetchDeployments(acc telegraf.Accumulator, org *organization, stack StackSummary) ([]Deployment, error) {
+	req := apiRequest{
+		acc:          acc,
+		tenant:       org.tenant,
+		stats:        org.stats,
+		organization: org.name,
+		endpoint:     "deployments",
+		url: fmt.Sprintf("%s/api/stacks/%s/%s/%s/deployments?page=1&pageSize=%d", org.tenant.url,
+			neturl.PathEscape(org.name), neturl.PathEscape(stack.ProjectName), neturl.PathEscape(stack.StackName),
+			deploymentsPageSize),
+	}
+
+	var deployments DeploymentsResponse
+	err := p.get(req, func(body io.Reader) error {
+		bytes, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+
+		return org.drift.decode("deployments", bytes, &deployments)
+	})
+
+	return deployments.Deployments, err
+}
+
+// fetchDeploymentLogs returns every line of the deployment's logs,
+// following the next token to the end
+func (p *PulumiApiConfig) fetchDeploymentLogs(acc telegraf.Accumulator, org *organization, stack StackSummary, deployment Deployment) ([]DeploymentLogLine, error) {
+	var lines []DeploymentLogLine
+
+	err := p.getPages(acc, org, pager{
+		endpoint: "deployments/logs",
+		url: func(token string) string {
+			url := fmt.Sprintf("%s/api/stacks/%s/%s/%s/deployments/%s/logs", org.tenant.url,
+				neturl.PathEscape(org.name), neturl.PathEscape(stack.ProjectName), neturl.PathEscape(stack.StackName),
+				neturl.PathEscape(deployment.ID))
+			if token != "" {
+				url = fmt.Sprintf("%s?continuationToken=%s", url, neturl.QueryEscape(token))
+			}
+			return url
+		},
+		decode: func(body io.Reader) (string, error) {
+			bytes, err := io.ReadAll(body)
+			if err != nil {
+				return "", err
+			}
+
+			var logs DeploymentLogsResponse
+			if err := org.drift.decode("deployments/logs", bytes, &logs); err != nil {
+				return "", err
+			}
+			lines = append(lines, logs.Lines...)
+
+			// A page without lines would only hand back another token
+			if len(logs.Lines) == 0 {
+				return "", nil
+			}
+			return logs.NextToken, nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return lines, nil
+}
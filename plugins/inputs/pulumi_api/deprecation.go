@@ -0,0 +1,152 @@
+package pulumi_api
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// deprecation is what a response said about its endpoint going away, from
+// the Deprecation and Sunset headers of RFC 9745 and RFC 8594, or a 299
+// Warning
+type deprecation struct {
+	deprecatedAt time.Time
+	sunset       time.Time
+	message      string
+}
+
+// parseDeprecation reads the deprecation headers, reporting whether there
+// were any
+func parseDeprecation(header http.Header) (deprecation, bool) {
+	var d deprecation
+	present := false
+
+	// Either a structured date, "@" and seconds since the epoch, or "true"
+	// from the drafts before it
+	if value := strings.TrimSpace(header.Get("Deprecation")); value != "" && value != "false" {
+		present = true
+
+		if strings.HasPrefix(value, "@") {
+			if seconds, err := strconv.ParseInt(value[1:], 10, 64); err == nil {
+				d.deprecatedAt = time.Unix(seconds, 0)
+			}
+		} else if date, err := http.ParseTime(value); err == nil {
+			d.deprecatedAt = date
+		}
+	}
+
+	if value := header.Get("Sunset"); value != "" {
+		if date, err := http.ParseTime(value); err == nil {
+			present = true
+			d.sunset = date
+		}
+	}
+
+	for _, value := range header.Values("Warning") {
+		if strings.HasPrefix(value, "299 ") {
+			present = true
+			d.message = warningText(value)
+			break
+		}
+	}
+
+	return d, present
+}
+
+// warningText is the quoted text of a Warning header, 299 - "text"
+func warningText(value string) string {
+	start := strings.Index(value, `"`)
+	if start < 0 {
+		return value
+	}
+
+	text, err := strconv.Unquote(value[start : strings.LastIndex(value, `"`)+1])
+	if err != nil {
+		return strings.Trim(value[start:], `"`)
+	}
+	return text
+}
+
+func (d deprecation) String() string {
+	var parts []string
+
+	if !d.sunset.IsZero() {
+		parts = append(parts, "removal on "+d.sunset.UTC().Format(time.RFC3339))
+	}
+	if d.message != "" {
+		parts = append(parts, d.message)
+	}
+
+	if len(parts) == 0 {
+		return "no removal date given"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// recordDeprecation keeps what the latest response of each endpoint said
+// about its deprecation, warning once when an endpoint is first deprecated
+// or its sunset moves
+func (p *PulumiApiConfig) recordDeprecation(req apiRequest, header http.Header) {
+	d, present := parseDeprecation(header)
+
+	p.mu.Lock()
+	previous, known := req.tenant.deprecations[req.endpoint]
+	if present {
+		if req.tenant.deprecations == nil {
+			req.tenant.deprecations = make(map[string]deprecation)
+		}
+		req.tenant.deprecations[req.endpoint] = d
+	} else {
+		delete(req.tenant.deprecations, req.endpoint)
+	}
+	p.mu.Unlock()
+
+	if present && (!known || !previous.sunset.Equal(d.sunset)) {
+		p.Log.Warnf("The Pulumi API endpoint %s is deprecated, %s: %s", req.endpoint, d, req.url)
+	}
+}
+
+// addDeprecationMetrics reports every endpoint of every tenant whose latest
+// response said it's deprecated
+func (p *PulumiApiConfig) addDeprecationMetrics(acc telegraf.Accumulator) {
+	for _, t := range p.tenants {
+		p.mu.Lock()
+		endpoints := make([]string, 0, len(t.deprecations))
+		deprecations := make(map[string]deprecation, len(t.deprecations))
+		for endpoint, d := range t.deprecations {
+			endpoints = append(endpoints, endpoint)
+			deprecations[endpoint] = d
+		}
+		p.mu.Unlock()
+
+		sort.Strings(endpoints)
+
+		for _, endpoint := range endpoints {
+			d := deprecations[endpoint]
+
+			tags := t.tags()
+			tags["endpoint"] = endpoint
+
+			fields := map[string]interface{}{
+				"deprecated": true,
+			}
+
+			if !d.deprecatedAt.IsZero() {
+				fields["deprecated_at"] = d.deprecatedAt.Unix()
+			}
+			if !d.sunset.IsZero() {
+				fields["sunset"] = d.sunset.Unix()
+				fields["seconds_until_sunset"] = time.Until(d.sunset).Seconds()
+			}
+			if d.message != "" {
+				fields["message"] = d.message
+			}
+
+			acc.AddGauge("pulumi_api_deprecation", fields, tags)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package pulumi_api
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// dialContext is how the client connects when dialer settings are given,
+// nil for the transport's default. With unix_socket every connection goes
+// to the socket, whatever the host of the URL, for APIs only reachable
+// through a local sidecar proxy.
+func (p *PulumiApiConfig) dialContext() func(ctx context.Context, network string, address string) (net.Conn, error) {
+	if p.UnixSocket == "" && p.DialTimeout == 0 && p.DialKeepAlive == 0 {
+		return nil
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(p.DialTimeout),
+		KeepAlive: time.Duration(p.DialKeepAlive),
+	}
+
+	if p.UnixSocket == "" {
+		return dialer.DialContext
+	}
+
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", p.UnixSocket)
+	}
+}
@@ -0,0 +1,63 @@
+package pulumi_api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var dumpSequence uint64
+
+// dumpResponse writes a request and its raw response to dump_responses_dir,
+// with the token redacted wherever it appears
+func (p *PulumiApiConfig) dumpResponse(req apiRequest, request *http.Request, resp *http.Response, body []byte) {
+	var dump bytes.Buffer
+
+	fmt.Fprintf(&dump, "%s %s\n", request.Method, request.URL)
+	writeHeaders(&dump, request.Header)
+
+	fmt.Fprintf(&dump, "\n%s %s\n", resp.Proto, resp.Status)
+	writeHeaders(&dump, resp.Header)
+
+	dump.WriteString("\n")
+	dump.Write(body)
+
+	contents := dump.String()
+	if token := p.token(req.tenant); token != "" {
+		contents = strings.ReplaceAll(contents, token, "[REDACTED]")
+	}
+
+	name := fmt.Sprintf("%s-%06d-%s", time.Now().UTC().Format("20060102T150405.000000000"), atomic.AddUint64(&dumpSequence, 1), req.endpoint)
+	if req.organization != "" {
+		name = fmt.Sprintf("%s-%s", name, req.organization)
+	}
+
+	path := filepath.Join(p.DumpResponsesDir, name+".http")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		p.Log.Warnf("Failed to dump response to %s: %s", path, err)
+	}
+}
+
+func writeHeaders(dump *bytes.Buffer, header http.Header) {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		for _, value := range header[key] {
+			if key == "Authorization" {
+				value = "[REDACTED]"
+			}
+
+			fmt.Fprintf(dump, "%s: %s\n", key, value)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package pulumi_api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/influxdata/telegraf"
+)
+
+// addFetchError reports a failed fetch of org, of a single stack's if stack
+// isn't empty. With error_metrics it's emitted as a pulumi_api_errors
+// metric rather than an accumulator error, which only reaches the log.
+func (p *PulumiApiConfig) addFetchError(acc telegraf.Accumulator, org *organization, fetch string, stack string, err error) {
+	org.stats.errors.Incr(1)
+
+	if !p.ErrorMetrics {
+		if stack != "" {
+			acc.AddError(fmt.Errorf("[organization=%s,stack=%s,fetch=%s]: %s", org.name, stack, fetch, err))
+		} else {
+			acc.AddError(fmt.Errorf("[organization=%s,fetch=%s]: %s", org.name, fetch, err))
+		}
+		return
+	}
+
+	tags := map[string]string{
+		"organization": org.name,
+		"endpoint":     fetch,
+		"class":        errorClass(err),
+	}
+	if stack != "" {
+		tags["stack"] = stack
+	}
+
+	fields := map[string]interface{}{
+		"count":   1,
+		"message": err.Error(),
+	}
+
+	acc.AddFields("pulumi_api_errors", fields, tags)
+}
+
+// errorClass groups errors by what an operator would do about them
+func errorClass(err error) string {
+	var rateLimited *rateLimitedError
+	if errors.As(err, &rateLimited) {
+		return "rate_limited"
+	}
+
+	var status *statusError
+	if errors.As(err, &status) {
+		switch {
+		case status.statusCode == http.StatusUnauthorized || status.statusCode == http.StatusForbidden:
+			return "auth"
+		case status.statusCode == http.StatusNotFound:
+			return "not_found"
+		case status.statusCode >= http.StatusInternalServerError:
+			return "server"
+		}
+		return "client"
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return "timeout"
+	}
+	if netErr != nil {
+		return "network"
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return "decode"
+	}
+
+	return "other"
+}
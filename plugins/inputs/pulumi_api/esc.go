@@ -0,0 +1,331 @@
+package pulumi_api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"gopkg.in/yaml.v2"
+)
+
+type ESCEnvironmentsResponse struct {
+	Environments []ESCEnvironment `json:"environments"`
+	NextToken    string           `json:"nextToken"`
+}
+
+type ESCEnvironment struct {
+	Organization string `json:"organization"`
+	Project      string `json:"project"`
+	Name         string `json:"name"`
+	Created      string `json:"created"`
+	Modified     string `json:"modified"`
+}
+
+// Key identifies an environment within its organization
+func (e ESCEnvironment) Key() string {
+	return e.Project + "/" + e.Name
+}
+
+type ESCOpenResponse struct {
+	ID          string          `json:"id"`
+	Diagnostics []ESCDiagnostic `json:"diagnostics"`
+}
+
+type ESCDiagnostic struct {
+	Summary string `json:"summary"`
+	Path    string `json:"path"`
+}
+
+type ESCTagsResponse struct {
+	Tags map[string]ESCTag `json:"tags"`
+}
+
+type ESCTag struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// ESCDefinition is the part of an environment's YAML the inventory reads.
+// Imports are either a name or a name mapped to its options.
+type ESCDefinition struct {
+	Imports []interface{} `yaml:"imports"`
+	Values  interface{}   `yaml:"values"`
+}
+
+// providers returns the dynamic providers the definition opens, whether
+// with fn::open::<provider> or fn::open and a provider property
+func (d ESCDefinition) providers() []string {
+	found := make(map[string]bool)
+
+	var walk func(value interface{})
+	walk = func(value interface{}) {
+		switch value := value.(type) {
+		case map[interface{}]interface{}:
+			for key, child := range value {
+				name, _ := key.(string)
+
+				if strings.HasPrefix(name, "fn::open::") {
+					found[strings.TrimPrefix(name, "fn::open::")] = true
+				} else if name == "fn::open" {
+					if options, ok := child.(map[interface{}]interface{}); ok {
+						if provider, ok := options["provider"].(string); ok {
+							found[provider] = true
+						}
+					}
+				}
+
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range value {
+				walk(child)
+			}
+		}
+	}
+	walk(d.Values)
+
+	providers := make([]string, 0, len(found))
+	for provider := range found {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+
+	return providers
+}
+
+func newESCCollector(p *PulumiApiConfig, org *organization) Collector {
+	if !p.ESCEvaluation && !p.ESCInventory {
+		return nil
+	}
+
+	return &funcCollector{
+		name: "esc",
+		gather: func(acc telegraf.Accumulator) {
+			p.gatherESC(acc, org)
+		},
+	}
+}
+
+// gatherESC lists the organization's ESC environments once for every
+// collector working per environment
+func (p *PulumiApiConfig) gatherESC(acc telegraf.Accumulator, org *organization) {
+	environments, err := p.listESCEnvironments(acc, org)
+	if err != nil {
+		p.addFetchError(acc, org, "esc/environments", "", err)
+		return
+	}
+
+	if p.ESCEvaluation {
+		p.gatherESCEvaluations(acc, org, environments)
+	}
+
+	if p.ESCInventory {
+		p.gatherESCInventory(acc, org, environments)
+	}
+}
+
+// listESCEnvironments returns every ESC environment of the organization,
+// following the next token to the last page
+func (p *PulumiApiConfig) listESCEnvironments(acc telegraf.Accumulator, org *organization) ([]ESCEnvironment, error) {
+	var environments []ESCEnvironment
+
+	err := p.getPages(acc, org, pager{
+		endpoint: "esc/environments",
+		url: func(token string) string {
+			url := fmt.Sprintf("%s/api/esc/environments/%s", org.tenant.url, neturl.PathEscape(org.name))
+			if token != "" {
+				url = fmt.Sprintf("%s?continuationToken=%s", url, neturl.QueryEscape(token))
+			}
+			return url
+		},
+		decode: func(body io.Reader) (string, error) {
+			bytes, err := io.ReadAll(body)
+			if err != nil {
+				return "", err
+			}
+
+			var response ESCEnvironmentsResponse
+			if err := org.drift.decode("esc/environments", bytes, &response); err != nil {
+				return "", err
+			}
+			environments = append(environments, response.Environments...)
+
+			if len(response.Environments) == 0 {
+				return "", nil
+			}
+			return response.NextToken, nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return environments, nil
+}
+
+// gatherESCEvaluations opens every environment the way a CI login would,
+// emitting how long it took and whether evaluation produced diagnostics.
+// Opening runs the environment's providers, so it mints credentials too.
+func (p *PulumiApiConfig) gatherESCEvaluations(acc telegraf.Accumulator, org *organization, environments []ESCEnvironment) {
+	for _, environment := range environments {
+		tags := map[string]string{
+			"organization": org.name,
+			"project":      environment.Project,
+			"environment":  environment.Name,
+		}
+
+		opened, duration, err := p.openESCEnvironment(acc, org, environment)
+
+		// The API refuses to open an environment that doesn't evaluate
+		var status *statusError
+		if errors.As(err, &status) && (status.statusCode == http.StatusBadRequest || status.statusCode == http.StatusUnprocessableEntity) {
+			fields := map[string]interface{}{
+				"duration": duration.Seconds(),
+				"success":  false,
+				"error":    err.Error(),
+			}
+
+			acc.AddGauge("pulumi_esc_evaluation", fields, tags)
+			continue
+		}
+
+		if err != nil {
+			p.addFetchError(acc, org, "esc/environments/open", environment.Key(), err)
+			continue
+		}
+
+		fields := map[string]interface{}{
+			"duration":    duration.Seconds(),
+			"success":     len(opened.Diagnostics) == 0,
+			"diagnostics": len(opened.Diagnostics),
+		}
+		if len(opened.Diagnostics) > 0 {
+			fields["error"] = opened.Diagnostics[0].Summary
+		}
+
+		acc.AddGauge("pulumi_esc_evaluation", fields, tags)
+	}
+}
+
+// gatherESCInventory emits each environment's tags, along with how many
+// environments it imports and dynamic providers it opens, to follow the
+// growth of the dependency graph
+func (p *PulumiApiConfig) gatherESCInventory(acc telegraf.Accumulator, org *organization, environments []ESCEnvironment) {
+	for _, environment := range environments {
+		definition, err := p.fetchESCDefinition(acc, org, environment)
+		if err != nil {
+			p.addFetchError(acc, org, "esc/environment", environment.Key(), err)
+			continue
+		}
+
+		environmentTags, err := p.fetchESCTags(acc, org, environment)
+		if err != nil {
+			p.addFetchError(acc, org, "esc/environments/tags", environment.Key(), err)
+			continue
+		}
+
+		tags := map[string]string{
+			"organization": org.name,
+			"project":      environment.Project,
+			"environment":  environment.Name,
+		}
+
+		// Prefixed so a tag can't replace one of ours
+		for _, tag := range environmentTags {
+			tags["tag_"+tag.Name] = tag.Value
+		}
+
+		fields := map[string]interface{}{
+			"imports":   len(definition.Imports),
+			"providers": len(definition.providers()),
+			"tags":      len(environmentTags),
+		}
+
+		acc.AddGauge("pulumi_esc_environment", fields, tags)
+	}
+}
+
+// fetchESCDefinition returns the environment's definition, which rarely
+// changes, so the request is conditional
+func (p *PulumiApiConfig) fetchESCDefinition(acc telegraf.Accumulator, org *organization, environment ESCEnvironment) (ESCDefinition, error) {
+	req := apiRequest{
+		acc:          acc,
+		tenant:       org.tenant,
+		stats:        org.stats,
+		organization: org.name,
+		endpoint:     "esc/environment",
+		url: fmt.Sprintf("%s/api/esc/environments/%s/%s/%s", org.tenant.url,
+			neturl.PathEscape(org.name), neturl.PathEscape(environment.Project), neturl.PathEscape(environment.Name)),
+	}
+
+	var definition ESCDefinition
+	err := p.getConditional(req, func(body io.Reader) error {
+		bytes, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+
+		return yaml.Unmarshal(bytes, &definition)
+	})
+
+	return definition, err
+}
+
+func (p *PulumiApiConfig) fetchESCTags(acc telegraf.Accumulator, org *organization, environment ESCEnvironment) (map[string]ESCTag, error) {
+	req := apiRequest{
+		acc:          acc,
+		tenant:       org.tenant,
+		stats:        org.stats,
+		organization: org.name,
+		endpoint:     "esc/environments/tags",
+		url: fmt.Sprintf("%s/api/esc/environments/%s/%s/%s/tags", org.tenant.url,
+			neturl.PathEscape(org.name), neturl.PathEscape(environment.Project), neturl.PathEscape(environment.Name)),
+	}
+
+	var response ESCTagsResponse
+	err := p.getConditional(req, func(body io.Reader) error {
+		bytes, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+
+		return org.drift.decode("esc/environments/tags", bytes, &response)
+	})
+
+	return response.Tags, err
+}
+
+// openESCEnvironment opens a session on the environment, which is left to
+// expire on its own, returning how long the API took to evaluate it
+func (p *PulumiApiConfig) openESCEnvironment(acc telegraf.Accumulator, org *organization, environment ESCEnvironment) (ESCOpenResponse, time.Duration, error) {
+	var duration time.Duration
+
+	req := apiRequest{
+		acc:          acc,
+		tenant:       org.tenant,
+		stats:        org.stats,
+		organization: org.name,
+		endpoint:     "esc/environments/open",
+		url: fmt.Sprintf("%s/api/esc/environments/%s/%s/%s/open?duration=5m", org.tenant.url,
+			neturl.PathEscape(org.name), neturl.PathEscape(environment.Project), neturl.PathEscape(environment.Name)),
+		roundTrip: &duration,
+	}
+
+	var opened ESCOpenResponse
+	err := p.post(req, func(body io.Reader) error {
+		bytes, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+
+		return org.drift.decode("esc/environments/open", bytes, &opened)
+	})
+
+	return opened, duration, err
+}
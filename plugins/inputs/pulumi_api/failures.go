@@ -0,0 +1,141 @@
+package pulumi_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	neturl "net/url"
+	"strings"
+
+	"github.com/influxdata/telegraf"
+)
+
+// Failure messages are cut to this many bytes, some diagnostics run to
+// whole stack traces
+const maxFailureMessage = 1024
+
+type UpdateEventsResponse struct {
+	ContinuationToken ContinuationToken `json:"continuationToken"`
+	Events            []EngineEvent     `json:"events"`
+}
+
+// EngineEvent is one event of an update, only the kinds telling why it
+// failed are decoded
+type EngineEvent struct {
+	CancelEvent     *struct{}        `json:"cancelEvent"`
+	DiagnosticEvent *DiagnosticEvent `json:"diagnosticEvent"`
+	PolicyEvent     *PolicyEvent     `json:"policyEvent"`
+}
+
+type DiagnosticEvent struct {
+	URN      string `json:"urn"`
+	Message  string `json:"message"`
+	Severity string `json:"severity"`
+}
+
+type PolicyEvent struct {
+	PolicyName       string `json:"policyName"`
+	PolicyPackName   string `json:"policyPackName"`
+	Description      string `json:"description"`
+	Message          string `json:"message"`
+	EnforcementLevel string `json:"enforcementLevel"`
+}
+
+// classifyFailure tells why an update failed from its events, as one of
+// cancelled, policy_violation, timeout, provider_error or unknown, along
+// with the message that says so
+func classifyFailure(events []EngineEvent) (string, string) {
+	var policy, timeout, provider, other string
+	cancelled := false
+
+	for _, event := range events {
+		switch {
+		case event.CancelEvent != nil:
+			cancelled = true
+		case event.PolicyEvent != nil && event.PolicyEvent.EnforcementLevel == "mandatory":
+			if policy == "" {
+				policy = fmt.Sprintf("%s/%s: %s", event.PolicyEvent.PolicyPackName, event.PolicyEvent.PolicyName, event.PolicyEvent.Message)
+			}
+		case event.DiagnosticEvent != nil && event.DiagnosticEvent.Severity == "error":
+			message := strings.TrimSpace(event.DiagnosticEvent.Message)
+			lower := strings.ToLower(message)
+
+			switch {
+			case strings.Contains(lower, "timeout") || strings.Contains(lower, "timed out") || strings.Contains(lower, "deadline exceeded"):
+				if timeout == "" {
+					timeout = message
+				}
+			case event.DiagnosticEvent.URN != "":
+				// Errors about a resource come from its provider
+				if provider == "" {
+					provider = message
+				}
+			default:
+				if other == "" {
+					other = message
+				}
+			}
+		}
+	}
+
+	switch {
+	case cancelled:
+		return "cancelled", other
+	case policy != "":
+		return "policy_violation", policy
+	case timeout != "":
+		return "timeout", timeout
+	case provider != "":
+		return "provider_error", provider
+	}
+
+	return "unknown", other
+}
+
+// updateFailure classifies why the failed update did, from its events. A
+// failure to fetch them is reported, and classified as unknown.
+func (p *PulumiApiConfig) updateFailure(acc telegraf.Accumulator, org *organization, stack StackSummary, update UpdateInfo) (string, string) {
+	if update.UpdateID == "" {
+		return "unknown", ""
+	}
+
+	var events []EngineEvent
+	err := p.getPages(acc, org, pager{
+		endpoint: "update/events",
+		url: func(token string) string {
+			url := fmt.Sprintf("%s/api/stacks/%s/%s/%s/update/%s/events", org.tenant.url,
+				neturl.PathEscape(org.name), neturl.PathEscape(stack.ProjectName), neturl.PathEscape(stack.StackName),
+				neturl.PathEscape(update.UpdateID))
+			if token != "" {
+				url = fmt.Sprintf("%s?continuationToken=%s", url, neturl.QueryEscape(token))
+			}
+			return url
+		},
+		decode: func(body io.Reader) (string, error) {
+			var eventsResponse UpdateEventsResponse
+			err := org.drift.decodeStream("update/events", body, &eventsResponse, "events", func(raw json.RawMessage) error {
+				var event EngineEvent
+				if err := org.drift.decode("update/events.events[]", raw, &event); err != nil {
+					org.drift.report("update/events.events[]", "dropping element: %s", err)
+					return nil
+				}
+
+				events = append(events, event)
+				return nil
+			})
+
+			return string(eventsResponse.ContinuationToken), err
+		},
+	})
+	if err != nil {
+		p.addFetchError(acc, org, "update_events", stack.Key(), err)
+		return "unknown", ""
+	}
+
+	reason, message := classifyFailure(events)
+	if len(message) > maxFailureMessage {
+		message = strings.ToValidUTF8(message[:maxFailureMessage], "")
+	}
+
+	return reason, message
+}
@@ -0,0 +1,59 @@
+package pulumi_api
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+func (p *PulumiApiConfig) openGeoIP() error {
+	if p.GeoIPDatabase == "" {
+		return nil
+	}
+
+	reader, err := geoip2.Open(p.GeoIPDatabase)
+	if err != nil {
+		return fmt.Errorf("opening geoip_database: %s", err)
+	}
+
+	p.geoip = reader
+	return nil
+}
+
+// addGeoIPTags tags an event with where its source IP is, as far as the
+// GeoLite2 City database knows
+func (p *PulumiApiConfig) addGeoIPTags(tags map[string]string, sourceIP string) {
+	if p.geoip == nil {
+		return
+	}
+
+	ip := net.ParseIP(sourceIP)
+	if ip == nil {
+		return
+	}
+
+	city, err := p.geoip.City(ip)
+	if err != nil {
+		p.Log.Debugf("GeoIP lookup of %s failed: %s", sourceIP, err)
+		return
+	}
+
+	if city.Country.IsoCode != "" {
+		tags["country"] = city.Country.IsoCode
+	}
+
+	if name := city.City.Names["en"]; name != "" {
+		tags["city"] = name
+	}
+}
+
+func (p *PulumiApiConfig) closeGeoIP() {
+	if p.geoip == nil {
+		return
+	}
+
+	if err := p.geoip.Close(); err != nil {
+		p.Log.Errorf("Error closing the GeoIP database: %s", err)
+	}
+}
@@ -0,0 +1,272 @@
+package pulumi_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	neturl "net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// InsightsConfig selects a resource type to report on from Insights, and
+// the properties to group its resources by
+type InsightsConfig struct {
+	Type       string   `toml:"type"`
+	Properties []string `toml:"properties"`
+}
+
+type ResourceSearchResponse struct {
+	Resources  []Resource               `json:"resources"`
+	Pagination ResourceSearchPagination `json:"pagination"`
+}
+
+type ResourceSearchPagination struct {
+	Cursor string `json:"cursor"`
+}
+
+// Resource is a resource found by Insights resource search
+type Resource struct {
+	Type       string                 `json:"type"`
+	Name       string                 `json:"name"`
+	Project    string                 `json:"project"`
+	Stack      string                 `json:"stack"`
+	Created    string                 `json:"created"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// createdAt is when the resource was created, zero if Insights doesn't know
+func (r Resource) createdAt() time.Time {
+	created, err := time.Parse(time.RFC3339, r.Created)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return created
+}
+
+// property is the value of a property, following dots into objects, as a
+// tag value, empty if it's missing or not a scalar
+func (r Resource) property(path string) string {
+	var value interface{} = r.Properties
+
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[key]
+	}
+
+	switch value := value.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	}
+
+	return ""
+}
+
+func newInsightsCollector(p *PulumiApiConfig, org *organization) Collector {
+	if len(p.Insights) == 0 {
+		return nil
+	}
+
+	return &insightsCollector{p: p, org: org}
+}
+
+// insightsCollector searches Insights for the configured resource types,
+// which takes a page per few hundred resources, so only every
+// insights_interval
+type insightsCollector struct {
+	p   *PulumiApiConfig
+	org *organization
+}
+
+func (c *insightsCollector) Name() string {
+	return "insights"
+}
+
+func (c *insightsCollector) Interval() time.Duration {
+	return time.Duration(c.p.InsightsInterval)
+}
+
+func (c *insightsCollector) State() interface{} {
+	return nil
+}
+
+func (c *insightsCollector) Gather(acc telegraf.Accumulator) {
+	for _, insights := range c.p.Insights {
+		resources, err := c.p.searchResources(acc, c.org, insights.Type)
+		if err != nil {
+			c.p.addFetchError(acc, c.org, "resources", "", err)
+			continue
+		}
+
+		c.p.addResourceCounts(acc, c.org, insights, resources)
+
+		if c.p.ResourceAge {
+			c.p.addResourceAges(acc, c.org, insights, resources, time.Now())
+		}
+	}
+}
+
+// searchResources returns every resource of the type, with its properties,
+// following the cursor to the last page
+func (p *PulumiApiConfig) searchResources(acc telegraf.Accumulator, org *organization, resourceType string) ([]Resource, error) {
+	var resources []Resource
+
+	err := p.getPages(acc, org, pager{
+		endpoint: "search/resourcesv2",
+		url: func(token string) string {
+			url := fmt.Sprintf("%s/api/orgs/%s/search/resourcesv2?query=%s&properties=true", org.tenant.url,
+				neturl.PathEscape(org.name), neturl.QueryEscape("type:"+resourceType))
+			if token != "" {
+				url = fmt.Sprintf("%s&cursor=%s", url, neturl.QueryEscape(token))
+			}
+			return url
+		},
+		decode: func(body io.Reader) (string, error) {
+			var response ResourceSearchResponse
+			err := org.drift.decodeStream("search/resourcesv2", body, &response, "resources", func(raw json.RawMessage) error {
+				var resource Resource
+				if err := org.drift.decode("search/resourcesv2.resources[]", raw, &resource); err != nil {
+					org.drift.report("search/resourcesv2.resources[]", "dropping element: %s", err)
+					return nil
+				}
+
+				// The query matches on more than the exact type
+				if resource.Type == resourceType {
+					resources = append(resources, resource)
+				}
+				return nil
+			})
+
+			return response.Pagination.Cursor, err
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resources, nil
+}
+
+// addResourceCounts emits how many resources of the type there are with
+// each combination of values of the configured properties, each property
+// a tag of its own
+func (p *PulumiApiConfig) addResourceCounts(acc telegraf.Accumulator, org *organization, insights InsightsConfig, resources []Resource) {
+	type group struct {
+		tags  map[string]string
+		count int
+	}
+	groups := make(map[string]*group)
+
+	// A type without resources still has a count, of zero
+	if len(resources) == 0 {
+		groups[""] = &group{tags: map[string]string{"organization": org.name, "type": insights.Type}}
+	}
+
+	for _, resource := range resources {
+		tags := map[string]string{
+			"organization": org.name,
+			"type":         insights.Type,
+		}
+
+		values := make([]string, len(insights.Properties))
+		for i, property := range insights.Properties {
+			values[i] = resource.property(property)
+			if values[i] != "" {
+				tags[property] = values[i]
+			}
+		}
+
+		key := strings.Join(values, "\x00")
+		if groups[key] == nil {
+			groups[key] = &group{tags: tags}
+		}
+		groups[key].count++
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		acc.AddGauge("pulumi_resources", map[string]interface{}{"count": groups[key].count}, groups[key].tags)
+	}
+}
+
+// addResourceAges emits, per stack, when its oldest resource of the type was
+// created and how many are older than resource_age_threshold, to find the
+// long-lived resources that predate current standards
+func (p *PulumiApiConfig) addResourceAges(acc telegraf.Accumulator, org *organization, insights InsightsConfig, resources []Resource, now time.Time) {
+	type stackAges struct {
+		project, stack string
+		oldest         time.Time
+		resources      int
+		old            int
+	}
+	stacks := make(map[string]*stackAges)
+
+	threshold := time.Duration(p.ResourceAgeThreshold)
+
+	for _, resource := range resources {
+		created := resource.createdAt()
+		if created.IsZero() {
+			continue
+		}
+
+		key := resource.Project + "/" + resource.Stack
+		ages, ok := stacks[key]
+		if !ok {
+			ages = &stackAges{project: resource.Project, stack: resource.Stack, oldest: created}
+			stacks[key] = ages
+		}
+
+		ages.resources++
+		if created.Before(ages.oldest) {
+			ages.oldest = created
+		}
+		if threshold > 0 && now.Sub(created) > threshold {
+			ages.old++
+		}
+	}
+
+	keys := make([]string, 0, len(stacks))
+	for key := range stacks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		ages := stacks[key]
+
+		tags := map[string]string{
+			"organization": org.name,
+			"type":         insights.Type,
+			"project":      ages.project,
+			"stack":        ages.stack,
+		}
+
+		fields := map[string]interface{}{
+			"resources":          ages.resources,
+			"oldest_created":     ages.oldest.Unix(),
+			"oldest_age_seconds": now.Sub(ages.oldest).Seconds(),
+		}
+		if threshold > 0 {
+			fields["older_than_threshold"] = ages.old
+		}
+
+		acc.AddGauge("pulumi_resource_age", fields, tags)
+	}
+}
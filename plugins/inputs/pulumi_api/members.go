@@ -0,0 +1,201 @@
+package pulumi_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	neturl "net/url"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+type MembersResponse struct {
+	ContinuationToken ContinuationToken `json:"continuationToken"`
+	Members           []Member          `json:"members"`
+}
+
+type Member struct {
+	Role string `json:"role"`
+	User User   `json:"user"`
+}
+
+// memberActivity is when each member was last seen in the audit logs, by
+// login as emitted, so pseudonyms with anonymize. The audit logs record it
+// while the members collector reads it, possibly at the same time.
+type memberActivity struct {
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+func (m *memberActivity) record(login string, timestamp time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if timestamp.After(m.lastSeen[login]) {
+		m.lastSeen[login] = timestamp
+	}
+}
+
+func (m *memberActivity) seen(login string) (time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	timestamp, ok := m.lastSeen[login]
+	return timestamp, ok
+}
+
+// forget drops whoever is no longer a member, so the state doesn't grow
+// with everyone who ever was
+func (m *memberActivity) forget(members map[string]bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for login := range m.lastSeen {
+		if !members[login] {
+			delete(m.lastSeen, login)
+		}
+	}
+}
+
+// memberActivityState is kept so members seen before a restart don't look
+// dormant after it
+type memberActivityState struct {
+	LastSeen map[string]time.Time `json:"last_seen,omitempty"`
+}
+
+func (m *memberActivity) MarshalJSON() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return json.Marshal(memberActivityState{LastSeen: m.lastSeen})
+}
+
+func (m *memberActivity) UnmarshalJSON(data []byte) error {
+	var state memberActivityState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastSeen = make(map[string]time.Time, len(state.LastSeen))
+	for login, timestamp := range state.LastSeen {
+		m.lastSeen[login] = timestamp
+	}
+
+	return nil
+}
+
+// membersCollector emits how long ago each member was last seen in the
+// audit logs, to find dormant accounts. Activity is only known from when
+// collection started, or backfill_start.
+type membersCollector struct {
+	p   *PulumiApiConfig
+	org *organization
+}
+
+func newMembersCollector(p *PulumiApiConfig, org *organization) Collector {
+	if !p.MemberActivity {
+		return nil
+	}
+
+	org.members = &memberActivity{lastSeen: make(map[string]time.Time)}
+
+	return &membersCollector{p: p, org: org}
+}
+
+func (c *membersCollector) Name() string {
+	return "member_activity"
+}
+
+func (c *membersCollector) Interval() time.Duration {
+	return 0
+}
+
+func (c *membersCollector) State() interface{} {
+	return c.org.members
+}
+
+func (c *membersCollector) Gather(acc telegraf.Accumulator) {
+	p, org := c.p, c.org
+
+	members, err := p.listMembers(acc, org)
+	if err != nil {
+		p.addFetchError(acc, org, "members", "", err)
+		return
+	}
+
+	now := time.Now()
+	current := make(map[string]bool, len(members))
+
+	for _, member := range members {
+		login := member.User.GitHubLogin
+		if p.Anonymize {
+			login = p.pseudonym(login)
+		}
+		current[login] = true
+
+		tags := map[string]string{
+			"organization": org.name,
+			"github_login": login,
+			"role":         member.Role,
+		}
+		if p.TeamTag {
+			if team := p.userTeams(acc, org, member.User.GitHubLogin); team != "" {
+				tags["team"] = team
+			}
+		}
+
+		lastSeen, seen := org.members.seen(login)
+		fields := map[string]interface{}{
+			"seen": seen,
+		}
+		if seen {
+			fields["last_seen"] = lastSeen.Unix()
+			fields["last_seen_seconds"] = now.Sub(lastSeen).Seconds()
+		}
+
+		acc.AddGauge("pulumi_member", fields, tags)
+	}
+
+	org.members.forget(current)
+}
+
+// listMembers returns every member of the organization, following
+// continuation tokens to the last page
+func (p *PulumiApiConfig) listMembers(acc telegraf.Accumulator, org *organization) ([]Member, error) {
+	var members []Member
+
+	err := p.getPages(acc, org, pager{
+		endpoint: "members",
+		url: func(token string) string {
+			url := fmt.Sprintf("%s/api/orgs/%s/members?type=backend", org.tenant.url, neturl.PathEscape(org.name))
+			if token != "" {
+				url = fmt.Sprintf("%s&continuationToken=%s", url, neturl.QueryEscape(token))
+			}
+			return url
+		},
+		decode: func(body io.Reader) (string, error) {
+			bytes, err := io.ReadAll(body)
+			if err != nil {
+				return "", err
+			}
+
+			var membersResponse MembersResponse
+			if err := org.drift.decode("members", bytes, &membersResponse); err != nil {
+				return "", err
+			}
+
+			members = append(members, membersResponse.Members...)
+			return string(membersResponse.ContinuationToken), nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
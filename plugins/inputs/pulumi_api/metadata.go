@@ -0,0 +1,76 @@
+package pulumi_api
+
+import (
+	"fmt"
+	"io"
+	neturl "net/url"
+
+	"github.com/influxdata/telegraf"
+)
+
+// OrganizationResponse is the organization's details, of which the display
+// name and plan tier become tags
+type OrganizationResponse struct {
+	GitHubLogin string `json:"githubLogin"`
+	Name        string `json:"name"`
+	Tier        string `json:"tier"`
+}
+
+// orgTags are the tags going on every metric of the organization: the
+// tenant's, and its metadata once fetched with organization_metadata
+func (p *PulumiApiConfig) orgTags(acc telegraf.Accumulator, org *organization) map[string]string {
+	tags := org.tenant.tags()
+
+	if p.OrganizationMetadata {
+		for key, value := range p.organizationMetadata(acc, org) {
+			tags[key] = value
+		}
+	}
+
+	return tags
+}
+
+// organizationMetadata returns the tags from the organization's details,
+// fetched the first time only. A failure is reported and tried again on
+// the next gather, the metrics going without the tags meanwhile.
+func (p *PulumiApiConfig) organizationMetadata(acc telegraf.Accumulator, org *organization) map[string]string {
+	org.metadataMu.Lock()
+	defer org.metadataMu.Unlock()
+
+	if org.metadata != nil {
+		return org.metadata
+	}
+
+	req := apiRequest{
+		acc:          acc,
+		tenant:       org.tenant,
+		stats:        org.stats,
+		organization: org.name,
+		endpoint:     "organization",
+		url:          fmt.Sprintf("%s/api/orgs/%s", org.tenant.url, neturl.PathEscape(org.name)),
+	}
+
+	var details OrganizationResponse
+	err := p.get(req, func(body io.Reader) error {
+		bytes, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+
+		return org.drift.decode("organization", bytes, &details)
+	})
+	if err != nil {
+		p.addFetchError(acc, org, "organization", "", err)
+		return nil
+	}
+
+	org.metadata = make(map[string]string)
+	if details.Name != "" {
+		org.metadata["organization_name"] = details.Name
+	}
+	if details.Tier != "" {
+		org.metadata["plan"] = details.Tier
+	}
+
+	return org.metadata
+}
@@ -0,0 +1,189 @@
+package pulumi_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf/config"
+)
+
+// OIDCConfig exchanges a workload identity token, such as a Kubernetes
+// service account token, for a short-lived Pulumi access token in place of
+// a long-lived one
+type OIDCConfig struct {
+	OIDCTokenFile          string          `toml:"oidc_token_file"`
+	OIDCOrganization       string          `toml:"oidc_organization"`
+	OIDCRequestedTokenType string          `toml:"oidc_requested_token_type"`
+	OIDCScope              string          `toml:"oidc_scope"`
+	OIDCTokenExpiration    config.Duration `toml:"oidc_token_expiration"`
+}
+
+// Tokens are exchanged again once this much of their lifetime has passed,
+// leaving time to retry before they expire
+const oidcRefreshAfter = 0.8
+
+// oidcDefaultLifetime is how long a token is taken to last when the
+// exchange doesn't say and oidc_token_expiration isn't set
+const oidcDefaultLifetime = time.Hour
+
+// tokenExchange is the tenant's exchanged token, guarded by its own mutex
+// so that only one request exchanges it at a time
+type tokenExchange struct {
+	config OIDCConfig
+
+	mu        sync.Mutex
+	refreshAt time.Time
+}
+
+type tokenExchangeResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func newTokenExchange(c OIDCConfig, organizationNames []string) (*tokenExchange, error) {
+	if c.OIDCTokenFile == "" {
+		return nil, nil
+	}
+
+	// The audience defaults to the first organization named
+	if c.OIDCOrganization == "" {
+		for _, name := range organizationNames {
+			if name != "*" {
+				c.OIDCOrganization = name
+				break
+			}
+		}
+	}
+	if c.OIDCOrganization == "" {
+		return nil, fmt.Errorf("oidc_organization is required with organizations = [\"*\"]")
+	}
+
+	switch c.OIDCRequestedTokenType {
+	case "":
+		c.OIDCRequestedTokenType = "organization"
+	case "organization", "team", "personal":
+	default:
+		return nil, fmt.Errorf("invalid oidc_requested_token_type %q, must be organization, team or personal", c.OIDCRequestedTokenType)
+	}
+
+	if c.OIDCTokenExpiration < 0 {
+		return nil, fmt.Errorf("invalid oidc_token_expiration %s, must not be negative", time.Duration(c.OIDCTokenExpiration))
+	}
+
+	return &tokenExchange{config: c}, nil
+}
+
+// refreshToken exchanges the tenant's token again when it's due, a no-op
+// for tenants with a token of their own
+func (p *PulumiApiConfig) refreshToken(t *tenant) error {
+	if t.exchange == nil {
+		return nil
+	}
+
+	t.exchange.mu.Lock()
+	defer t.exchange.mu.Unlock()
+
+	if time.Now().Before(t.exchange.refreshAt) {
+		return nil
+	}
+
+	token, expiresIn, err := p.exchangeToken(t)
+	if err != nil {
+		return fmt.Errorf("exchanging OIDC token: %w", err)
+	}
+
+	p.mu.Lock()
+	*t.token = token
+	p.mu.Unlock()
+
+	// Without an expires_in every request would exchange it again
+	if expiresIn <= 0 {
+		expiresIn = time.Duration(t.exchange.config.OIDCTokenExpiration)
+		if expiresIn <= 0 {
+			expiresIn = oidcDefaultLifetime
+		}
+	}
+
+	t.exchange.refreshAt = time.Now().Add(time.Duration(float64(expiresIn) * oidcRefreshAfter))
+	p.Log.Debugf("Exchanged OIDC token for %s, valid for %s", t.url, expiresIn)
+
+	return nil
+}
+
+// expireToken makes the next request exchange the token again, after the
+// API rejected it. It reports whether there's an exchange to retry with.
+func (t *tenant) expireToken() bool {
+	if t.exchange == nil {
+		return false
+	}
+
+	t.exchange.mu.Lock()
+	defer t.exchange.mu.Unlock()
+
+	t.exchange.refreshAt = time.Time{}
+	return true
+}
+
+// exchangeToken trades the identity token, read again every time as the
+// platform rotates it, for a Pulumi access token and how long it's valid
+func (p *PulumiApiConfig) exchangeToken(t *tenant) (string, time.Duration, error) {
+	c := t.exchange.config
+
+	subjectToken, err := readTokenFile(c.OIDCTokenFile)
+	if err != nil {
+		return "", 0, err
+	}
+
+	form := neturl.Values{
+		"audience":             {"urn:pulumi:org:" + c.OIDCOrganization},
+		"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"subject_token_type":   {"urn:ietf:params:oauth:token-type:id_token"},
+		"requested_token_type": {"urn:pulumi:token-type:access_token:" + c.OIDCRequestedTokenType},
+		"subject_token":        {subjectToken},
+	}
+	if c.OIDCScope != "" {
+		form.Set("scope", c.OIDCScope)
+	}
+	if c.OIDCTokenExpiration > 0 {
+		form.Set("expiration", strconv.FormatInt(int64(time.Duration(c.OIDCTokenExpiration)/time.Second), 10))
+	}
+
+	request, err := http.NewRequestWithContext(p.ctx, http.MethodPost, t.url+"/api/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("User-Agent", p.UserAgent)
+
+	resp, err := p.client.Do(request)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiError ApiError
+		if err := json.NewDecoder(resp.Body).Decode(&apiError); err != nil || apiError.Message == "" {
+			return "", 0, &statusError{statusCode: resp.StatusCode, err: fmt.Errorf("status %d", resp.StatusCode)}
+		}
+
+		return "", 0, &statusError{statusCode: resp.StatusCode, err: fmt.Errorf("error code %d: %s", apiError.Code, apiError.Message)}
+	}
+
+	var exchanged tokenExchangeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&exchanged); err != nil {
+		return "", 0, fmt.Errorf("decoding response: %s", err)
+	}
+	if exchanged.AccessToken == "" {
+		return "", 0, fmt.Errorf("no access token in the response")
+	}
+
+	return exchanged.AccessToken, time.Duration(exchanged.ExpiresIn) * time.Second, nil
+}
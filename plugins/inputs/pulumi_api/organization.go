@@ -0,0 +1,138 @@
+package pulumi_api
+
+import (
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+)
+
+// organization is a Pulumi organization being collected from, along with
+// its audit log cursor
+type organization struct {
+	name   string
+	tenant *tenant
+	stats  *stats
+	drift  *schemaDrift
+
+	lastFetch         time.Time
+	newestEvent       time.Time
+	windowEnd         time.Time
+	continuationToken ContinuationToken
+	seen              map[string]time.Time
+
+	// fetchedAt is when the audit logs were last fetched successfully
+	fetchedAt time.Time
+
+	// dropped counts the audit events not emitted since the last gather,
+	// by reason
+	dropped map[string]int
+
+	// backfilledFrom is how far back the export has been imported from
+	backfilledFrom time.Time
+
+	// backfillStart is how far back the first collection of each stack's
+	// updates goes, when it's further back than the success rate window
+	backfillStart time.Time
+
+	breaker circuitBreaker
+
+	// owned is whether this agent's shard collects the organization's
+	// audit logs and other per-organization metrics
+	owned bool
+
+	// teams are the teams of each member by login, as of teamsFetchedAt.
+	// The audit logs and the members collector both look them up, which
+	// can happen at once in realtime mode.
+	teamsMu        sync.Mutex
+	teams          map[string]string
+	teamsFetchedAt time.Time
+
+	// metadata are the tags from the organization's details, nil until
+	// they've been fetched
+	metadataMu sync.Mutex
+	metadata   map[string]string
+
+	collectors []*scheduledCollector
+
+	// poll is when the realtime loop next collects the audit logs, with
+	// adaptive_polling, going by auditEvents, the audit events emitted,
+	// which unlike eventsEmitted leaves out the stack updates
+	poll        adaptivePoll
+	auditEvents int64
+
+	// tracked are the gathers of audit events not yet delivered, oldest
+	// first, and delivered the cursor as of the last one that was. Both are
+	// only used with delivery_tracking, guarded by the plugin's mutex.
+	tracked   []trackedGather
+	delivered *OrganizationState
+
+	// stackList is the last stack list, as of stacksListedAt, only kept
+	// with stack_list_cache_ttl
+	stackList      []StackSummary
+	stacksListedAt time.Time
+
+	// stacks is the update history of each stack, by project/stack
+	stacks map[string]*stackHistory
+
+	// members is when each member was last seen, with member_activity
+	members *memberActivity
+
+	// sources are the repository and branch tags of the stacks deploying
+	// from one, by project/stack, as of the last listing
+	sources map[string]map[string]string
+
+	// scannedDeployments is the version of each stack's newest finished
+	// deployment whose logs don't need scanning, by project/stack
+	scannedDeployments map[string]int64
+
+	// secretsProviders is the secrets provider of each stack by
+	// project/stack, as of its last update, with secrets_providers
+	secretsProviders map[string]stackSecretsProvider
+}
+
+func newOrganization(t *tenant, name string, log telegraf.Logger) *organization {
+	tags := t.tags()
+	delete(tags, "token_owner")
+	tags["organization"] = name
+	stats := newStats(tags)
+
+	return &organization{
+		name:      name,
+		tenant:    t,
+		stats:     stats,
+		drift:     newSchemaDrift(log, stats.decodeAnomalies),
+		lastFetch: time.Now().Add(time.Duration(-1) * time.Hour),
+		seen:      make(map[string]time.Time),
+		dropped:   make(map[string]int),
+		stacks:    make(map[string]*stackHistory),
+
+		scannedDeployments: make(map[string]int64),
+	}
+}
+
+// stateKey identifies the organization in the state, those of endpoints
+// are prefixed with the endpoint's name as names can repeat across them
+func (o *organization) stateKey() string {
+	if o.tenant.name == "" {
+		return o.name
+	}
+
+	return o.tenant.name + "/" + o.name
+}
+
+func (o *organization) startTime(overlap config.Duration) time.Time {
+	return o.lastFetch.Add(-time.Duration(overlap))
+}
+
+// pruneSeen forgets events that are older than the next query can return
+func (o *organization) pruneSeen(overlap config.Duration) {
+	startTime := o.startTime(overlap)
+
+	for key, timestamp := range o.seen {
+		if timestamp.Before(startTime) {
+			delete(o.seen, key)
+		}
+	}
+}
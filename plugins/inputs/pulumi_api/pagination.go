@@ -0,0 +1,61 @@
+package pulumi_api
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/influxdata/telegraf"
+)
+
+// pager describes an endpoint listed a page at a time. Authentication,
+// retries, rate limiting and error decoding are all left to get.
+type pager struct {
+	endpoint string
+
+	// url returns the URL of the page after token, the first page's token
+	// is empty
+	url func(token string) string
+
+	// decode consumes a page, returning the token of the next one or an
+	// empty token after the last
+	decode func(body io.Reader) (string, error)
+}
+
+// getPages fetches every page of an organization's endpoint. It stops
+// early if the API hands back the token it was just given, which would
+// otherwise loop forever.
+func (p *PulumiApiConfig) getPages(acc telegraf.Accumulator, org *organization, pages pager) error {
+	token := ""
+
+	for page := 1; ; page++ {
+		req := apiRequest{
+			acc:          acc,
+			tenant:       org.tenant,
+			stats:        org.stats,
+			organization: org.name,
+			endpoint:     pages.endpoint,
+			url:          pages.url(token),
+		}
+
+		next := ""
+		err := p.get(req, func(body io.Reader) error {
+			var err error
+			next, err = pages.decode(body)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("page %d: %w", page, err)
+		}
+		org.stats.pages.Incr(1)
+
+		if next == "" || next == token {
+			return nil
+		}
+
+		if p.DryRun {
+			p.Log.Debugf("Dry run, not fetching %s of %s past the first page", pages.endpoint, org.name)
+			return nil
+		}
+		token = next
+	}
+}
@@ -0,0 +1,80 @@
+package pulumi_api
+
+import (
+	"sort"
+
+	"github.com/influxdata/telegraf"
+)
+
+// projectRollup is what's summed up of a project's stacks
+type projectRollup struct {
+	stacks    int
+	resources int
+
+	updates           int
+	successfulUpdates int
+	failedStacks      int
+}
+
+// addProjectRollups emits the pulumi_project gauge, each project's stacks
+// summed up, for views per project without a series per stack. The update
+// counts are those of the success rate window, with stack_updates.
+func (p *PulumiApiConfig) addProjectRollups(acc telegraf.Accumulator, org *organization, stacks []StackSummary) {
+	projects := make(map[string]*projectRollup)
+
+	for _, stack := range stacks {
+		project, ok := projects[stack.ProjectName]
+		if !ok {
+			project = &projectRollup{}
+			projects[stack.ProjectName] = project
+		}
+
+		project.stacks++
+		project.resources += stack.ResourceCount
+
+		history, ok := org.stacks[stack.Key()]
+		if !p.StackUpdates || !ok {
+			continue
+		}
+
+		for _, update := range history.updates {
+			project.updates++
+			if update.succeeded {
+				project.successfulUpdates++
+			}
+		}
+		if history.lastResult == "failed" {
+			project.failedStacks++
+		}
+	}
+
+	names := make([]string, 0, len(projects))
+	for name := range projects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		project := projects[name]
+
+		tags := map[string]string{
+			"organization": org.name,
+			"project":      name,
+		}
+		p.addShardTag(tags)
+
+		fields := map[string]interface{}{
+			"stacks":    project.stacks,
+			"resources": project.resources,
+		}
+
+		if p.StackUpdates {
+			fields["updates"] = project.updates
+			fields["successful_updates"] = project.successfulUpdates
+			fields["failed_updates"] = project.updates - project.successfulUpdates
+			fields["failed_stacks"] = project.failedStacks
+		}
+
+		acc.AddGauge("pulumi_project", fields, tags)
+	}
+}
@@ -2,30 +2,270 @@ package pulumi_api
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
+	"math/rand"
+	"net"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/filter"
 	httpconfig "github.com/influxdata/telegraf/plugins/common/http"
 	"github.com/influxdata/telegraf/plugins/inputs"
+	"github.com/influxdata/telegraf/selfstat"
+	"github.com/oschwald/geoip2-golang"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
+// Version identifies the build in the default User-Agent, set with
+// -ldflags "-X github.com/rawkode/telegraf-plugin-pulumi-api/plugins/inputs/pulumi_api.Version=v1.2.3"
+var Version = "dev"
+
 type PulumiApiConfig struct {
-	Url          string `toml:"url"`
-	Organization string `toml:"organization"`
-	Token        string `toml:"token"`
+	Url           string   `toml:"url"`
+	Organization  string   `toml:"organization"`
+	Organizations []string `toml:"organizations"`
+	Token         string   `toml:"token"`
+	TokenFile     string   `toml:"token_file"`
+	StateFile     string   `toml:"state_file"`
+
+	OIDCConfig
+
+	ValidateCredentials bool `toml:"validate_credentials"`
+	TokenOwnerTag       bool `toml:"token_owner_tag"`
+
+	// DryRun checks the config against the API with a single page of
+	// everything, leaving the state file alone
+	DryRun bool `toml:"dry_run"`
+
+	OrganizationMetadata bool `toml:"organization_metadata"`
+
+	// ShardIndex and ShardCount split the organizations and their stacks
+	// between several agents
+	ShardIndex int `toml:"shard_index"`
+	ShardCount int `toml:"shard_count"`
+
+	MaxConcurrentRequests int `toml:"max_concurrent_requests"`
+	MaxRequestsPerMinute  int `toml:"max_requests_per_minute"`
+
+	PollJitter config.Duration `toml:"poll_jitter"`
+
+	CircuitBreakerThreshold int             `toml:"circuit_breaker_threshold"`
+	CircuitBreakerCooldown  config.Duration `toml:"circuit_breaker_cooldown"`
+
+	// Overlap is how far before the newest event already seen we start the
+	// next query, to pick up events the API ingested late
+	Overlap config.Duration `toml:"overlap"`
+
+	// WindowAlignment bounds each query with an endTime, a multiple of it,
+	// so every agent fetches the same windows
+	WindowAlignment config.Duration `toml:"window_alignment"`
+
+	MaxPages int `toml:"max_pages"`
+
+	// PageSize is passed to the endpoints that take one, 0 leaves each
+	// endpoint's default
+	PageSize int `toml:"page_size"`
+
+	AuditLogStacks []string `toml:"audit_log_stacks"`
+
+	FieldInclude []string `toml:"field_include"`
+	FieldExclude []string `toml:"field_exclude"`
+
+	EventInclude        []string `toml:"event_include"`
+	EventExclude        []string `toml:"event_exclude"`
+	DroppedEventsMetric bool     `toml:"dropped_events_metric"`
+	LagMetric           bool     `toml:"lag_metric"`
+
+	MaxClockSkew    config.Duration `toml:"max_clock_skew"`
+	ClockSkewMetric bool            `toml:"clock_skew_metric"`
+
+	RetentionWatermark         bool            `toml:"retention_watermark"`
+	RetentionWatermarkInterval config.Duration `toml:"retention_watermark_interval"`
+
+	BackfillFrom string `toml:"backfill_from"`
+
+	// BackfillStart is where collection starts from on the first run,
+	// rather than an hour ago
+	BackfillStart string `toml:"backfill_start"`
+
+	// StackTag selects the stacks collected from per stack by a stack tag,
+	// as name=value, or just name for any value
+	StackTag string `toml:"stack_tag"`
+
+	// StackListCacheTTL is how long the stack list is reused for before
+	// listing the stacks again, zero to list them on every gather
+	StackListCacheTTL config.Duration `toml:"stack_list_cache_ttl"`
+
+	StackUpdates      bool            `toml:"stack_updates"`
+	SuccessRateWindow config.Duration `toml:"success_rate_window"`
+
+	IncludeDeletedStacks bool `toml:"include_deleted_stacks"`
+
+	DurationPercentiles []float64 `toml:"duration_percentiles"`
+
+	DeployEvents bool `toml:"deploy_events"`
+
+	FailureReasons bool `toml:"failure_reasons"`
+
+	FailedStacks bool `toml:"failed_stacks"`
+
+	ProjectRollups bool `toml:"project_rollups"`
+
+	StackTTL bool `toml:"stack_ttl"`
+
+	DeploymentSettings bool `toml:"deployment_settings"`
+	SourceTags         bool `toml:"source_tags"`
+
+	PendingDeployments bool `toml:"pending_deployments"`
+	DeploymentLogs     bool `toml:"deployment_logs"`
+
+	SecretsProviders bool `toml:"secrets_providers"`
+
+	MemberActivity bool `toml:"member_activity"`
+
+	Usage         bool `toml:"usage"`
+	UsagePerStack bool `toml:"usage_per_stack"`
+
+	ESCEvaluation bool `toml:"esc_evaluation"`
+	ESCInventory  bool `toml:"esc_inventory"`
+
+	Insights         []InsightsConfig `toml:"insights"`
+	InsightsInterval config.Duration  `toml:"insights_interval"`
+
+	ResourceAge          bool            `toml:"resource_age"`
+	ResourceAgeThreshold config.Duration `toml:"resource_age_threshold"`
+
+	MaxRetries     int             `toml:"max_retries"`
+	RetryBaseDelay config.Duration `toml:"retry_base_delay"`
+	RetryJitter    config.Duration `toml:"retry_jitter"`
+	MaxRetryAfter  config.Duration `toml:"max_retry_after"`
+
+	TimestampPrecision string `toml:"timestamp_precision"`
+	TimestampSource    string `toml:"timestamp_source"`
+
+	Compression     string      `toml:"compression"`
+	MaxResponseSize config.Size `toml:"max_response_size"`
+	UserAgent       string      `toml:"user_agent"`
+
+	MaxIdleConns        int  `toml:"max_idle_conns"`
+	MaxIdleConnsPerHost int  `toml:"max_idle_conns_per_host"`
+	PreferHTTP2         bool `toml:"prefer_http2"`
+
+	UnixSocket    string          `toml:"unix_socket"`
+	DialTimeout   config.Duration `toml:"dial_timeout"`
+	DialKeepAlive config.Duration `toml:"dial_keep_alive"`
+
+	RequestMetrics bool `toml:"request_metrics"`
+
+	ErrorMetrics bool `toml:"error_metrics"`
 
-	lastFetch         time.Time
-	continuationToken uint64
+	DumpResponsesDir string `toml:"dump_responses_dir"`
+
+	Endpoints []EndpointConfig `toml:"endpoints"`
+
+	// Tokens are the tokens of organizations that token doesn't cover, by
+	// organization
+	Tokens map[string]string `toml:"tokens"`
+
+	// UserAttributes maps each attribute of an audit event's user to
+	// "tag", "field" or "drop"
+	UserAttributes map[string]string `toml:"user_attributes"`
+
+	// EventFormat shapes audit events as "metric", with the raw payload,
+	// or as "log" lines with a message field for log backends
+	EventFormat string `toml:"event_format"`
+
+	SIEMFormat        string            `toml:"siem_format"`
+	SeverityOverrides map[string]string `toml:"severity_overrides"`
+
+	GeoIPDatabase string `toml:"geoip_database"`
+
+	// Anonymize pseudonymizes user names, logins, token names and source
+	// IPs of audit events, salted so they can't be reversed
+	Anonymize     bool   `toml:"anonymize"`
+	AnonymizeSalt string `toml:"anonymize_salt"`
+
+	ReverseDNS         bool            `toml:"reverse_dns"`
+	ReverseDNSTimeout  config.Duration `toml:"reverse_dns_timeout"`
+	ReverseDNSCacheTTL config.Duration `toml:"reverse_dns_cache_ttl"`
+
+	TeamTag      bool            `toml:"team_tag"`
+	TeamCacheTTL config.Duration `toml:"team_cache_ttl"`
+
+	Tracing         bool   `toml:"tracing"`
+	TracingEndpoint string `toml:"tracing_endpoint"`
+
+	// Realtime polls on an internal loop rather than once per Gather, which
+	// only flushes what the loop buffered since the last one
+	Realtime            bool            `toml:"realtime"`
+	RealtimeInterval    config.Duration `toml:"realtime_interval"`
+	RealtimeBufferLimit int             `toml:"realtime_buffer_limit"`
+
+	// AdaptivePolling moves each organization's realtime interval between
+	// the bounds to collect about AdaptiveTargetEvents per poll
+	AdaptivePolling      bool            `toml:"adaptive_polling"`
+	RealtimeMinInterval  config.Duration `toml:"realtime_min_interval"`
+	RealtimeMaxInterval  config.Duration `toml:"realtime_max_interval"`
+	AdaptiveTargetEvents int             `toml:"adaptive_target_events"`
+
+	BackgroundPolling  bool            `toml:"background_polling"`
+	BackgroundInterval config.Duration `toml:"background_interval"`
+
+	DeliveryTracking       bool `toml:"delivery_tracking"`
+	MaxUndeliveredMessages int  `toml:"max_undelivered_messages"`
+
+	tenants       []*tenant
+	organizations []*organization
+	backfillFrom  time.Time
+	stackTagName  string
+	stackTagValue string
+
+	gathering      int32
+	gathersSkipped selfstat.Stat
+
+	// inFlight is held by a running Gather, for Stop to wait it out
+	inFlight sync.Mutex
+
+	buffer       *buffer
+	realtimeOnce sync.Once
+	realtimeDone chan struct{}
+
+	backgroundOnce sync.Once
+	backgroundDone chan struct{}
+
+	// tracking is set by Start with delivery_tracking, deliveries holds the
+	// outcomes not yet settled and abandoned those no longer waited for
+	tracking   telegraf.TrackingAccumulator
+	deliveries map[telegraf.TrackingID]bool
+	abandoned  map[telegraf.TrackingID]bool
 
 	ctx    context.Context
 	cancel context.CancelFunc
 
-	client *http.Client
+	eventFilter       filter.Filter
+	fieldFilter       filter.Filter
+	severityOverrides []severityOverride
+
+	client  *http.Client
+	limiter *rate.Limiter
+
+	tracer         trace.Tracer
+	tracerProvider *sdktrace.TracerProvider
+
+	geoip      *geoip2.Reader
+	reverseDNS *reverseDNS
+
+	mu            sync.Mutex
+	responseCache map[string]*cachedResponse
+
 	httpconfig.HTTPClientConfig
 
 	Log telegraf.Logger `toml:"-"`
@@ -36,47 +276,332 @@ type ApiError struct {
 	Message string
 }
 
-type AuditLogsResponse struct {
-	ContinuationToken uint64          `json:"continuationToken"`
-	AuditLogEvents    []AuditLogEvent `json:"auditLogEvents"`
-}
-
-type AuditLogEvent struct {
-	Timestamp   int64  `json:"timestamp"`
-	SourceIP    string `json:"sourceIP"`
-	Event       string `json:"event"`
-	Description string `json:"description"`
-	User        User   `json:"user"`
-}
-
-type User struct {
-	Name        string `json:"name"`
-	GitHubLogin string `json:"githubLogin"`
-	AvatarUrl   string `json:"avatarUrl"`
-}
-
 func init() {
 	inputs.Add("pulumi_api", func() telegraf.Input {
 		return &PulumiApiConfig{
 			Url: "https://api.pulumi.com",
+
+			ValidateCredentials: true,
+
+			Overlap:  config.Duration(5 * time.Minute),
+			MaxPages: 100,
+
+			ReverseDNSTimeout:  config.Duration(time.Second),
+			ReverseDNSCacheTTL: config.Duration(time.Hour),
+			TeamCacheTTL:       config.Duration(time.Hour),
+
+			RetentionWatermarkInterval: config.Duration(24 * time.Hour),
+			InsightsInterval:           config.Duration(time.Hour),
+
+			SuccessRateWindow:   config.Duration(24 * time.Hour),
+			DurationPercentiles: []float64{50, 95},
+
+			MaxConcurrentRequests: 4,
+
+			CircuitBreakerCooldown: config.Duration(5 * time.Minute),
+
+			MaxRetries:     3,
+			RetryBaseDelay: config.Duration(time.Second),
+			RetryJitter:    config.Duration(500 * time.Millisecond),
+			MaxRetryAfter:  config.Duration(time.Minute),
+
+			TimestampPrecision: "auto",
+			TimestampSource:    "event",
+			EventFormat:        "metric",
+
+			MaxClockSkew: config.Duration(time.Minute),
+
+			Compression:     "gzip",
+			MaxResponseSize: config.Size(64 * 1024 * 1024),
+
+			MaxIdleConns: 100,
+			PreferHTTP2:  true,
+
+			RealtimeInterval:    config.Duration(10 * time.Second),
+			RealtimeMinInterval: config.Duration(time.Second),
+			RealtimeMaxInterval: config.Duration(5 * time.Minute),
+			RealtimeBufferLimit: 10000,
+
+			AdaptiveTargetEvents: 100,
+
+			BackgroundInterval: config.Duration(time.Minute),
+
+			MaxUndeliveredMessages: 1000,
 		}
 	})
 }
 
 func (p *PulumiApiConfig) Init() error {
+	switch p.TimestampPrecision {
+	case "auto", "s", "ms", "us", "ns":
+	default:
+		return fmt.Errorf("invalid timestamp_precision %q, must be one of auto, s, ms, us or ns", p.TimestampPrecision)
+	}
+
+	switch p.TimestampSource {
+	case "event", "collection":
+	default:
+		return fmt.Errorf("invalid timestamp_source %q, must be event or collection", p.TimestampSource)
+	}
+
+	switch p.Compression {
+	case "gzip", "none":
+	default:
+		return fmt.Errorf("invalid compression %q, must be gzip or none", p.Compression)
+	}
+
+	if p.UserAgent == "" {
+		p.UserAgent = "telegraf-plugin-pulumi-api/" + Version
+	}
+
+	switch p.SIEMFormat {
+	case "", "cef", "leef":
+	default:
+		return fmt.Errorf("invalid siem_format %q, must be cef or leef", p.SIEMFormat)
+	}
+
+	switch p.EventFormat {
+	case "metric":
+	case "log":
+		if p.SIEMFormat != "" {
+			return fmt.Errorf("siem_format can't be used with event_format = \"log\"")
+		}
+	default:
+		return fmt.Errorf("invalid event_format %q, must be metric or log", p.EventFormat)
+	}
+
+	if p.PageSize < 0 {
+		return fmt.Errorf("invalid page_size %d, must not be negative", p.PageSize)
+	}
+
+	if err := p.validateSettings(); err != nil {
+		return err
+	}
+
+	severityOverrides, err := compileSeverityOverrides(p.SeverityOverrides)
+	if err != nil {
+		return err
+	}
+	p.severityOverrides = severityOverrides
+
+	for _, percentile := range p.DurationPercentiles {
+		if percentile <= 0 || percentile > 100 {
+			return fmt.Errorf("invalid duration_percentiles %v, must be above 0 and at most 100", percentile)
+		}
+	}
+
+	if p.Anonymize && p.AnonymizeSalt == "" {
+		return fmt.Errorf("anonymize_salt is required to anonymize")
+	}
+
+	userAttributes, err := buildUserAttributes(p.UserAttributes)
+	if err != nil {
+		return err
+	}
+	p.UserAttributes = userAttributes
+
+	for _, stack := range p.AuditLogStacks {
+		if parts := strings.Split(stack, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid audit_log_stacks entry %q, must be project/stack", stack)
+		}
+	}
+
+	if p.StackTag != "" {
+		parts := strings.SplitN(p.StackTag, "=", 2)
+		p.stackTagName = parts[0]
+		if len(parts) == 2 {
+			p.stackTagValue = parts[1]
+		}
+
+		if p.stackTagName == "" {
+			return fmt.Errorf("invalid stack_tag %q, must be name=value or name", p.StackTag)
+		}
+	}
+
+	if len(p.FieldInclude) > 0 || len(p.FieldExclude) > 0 {
+		p.fieldFilter, err = filter.NewIncludeExcludeFilter(p.FieldInclude, p.FieldExclude)
+		if err != nil {
+			return fmt.Errorf("compiling field filters: %s", err)
+		}
+	}
+
+	if len(p.EventInclude) > 0 || len(p.EventExclude) > 0 {
+		p.eventFilter, err = filter.NewIncludeExcludeFilter(p.EventInclude, p.EventExclude)
+		if err != nil {
+			return fmt.Errorf("compiling event filters: %s", err)
+		}
+	}
+
+	if p.BackfillFrom != "" {
+		backfillFrom, err := parseBackfillTime("backfill_from", p.BackfillFrom)
+		if err != nil {
+			return err
+		}
+		p.backfillFrom = backfillFrom
+	}
+
+	var backfillStart time.Time
+	if p.BackfillStart != "" {
+		backfillStart, err = parseBackfillTime("backfill_start", p.BackfillStart)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := p.initTenants(); err != nil {
+		return err
+	}
+
+	if err := p.validateTenants(); err != nil {
+		return err
+	}
+
+	if p.DumpResponsesDir != "" {
+		if err := os.MkdirAll(p.DumpResponsesDir, 0700); err != nil {
+			return fmt.Errorf("creating dump_responses_dir: %s", err)
+		}
+
+		p.Log.Warnf("Dumping raw API responses to %s", p.DumpResponsesDir)
+	}
+
+	p.gathersSkipped = selfstat.Register("pulumi_api", "gathers_skipped", map[string]string{})
+
+	if p.MaxConcurrentRequests < 1 {
+		p.MaxConcurrentRequests = 1
+	}
+
+	if p.Realtime {
+		if p.RealtimeInterval <= 0 {
+			return fmt.Errorf("realtime_interval must be positive")
+		}
+
+		if p.AdaptivePolling {
+			if p.RealtimeMinInterval <= 0 {
+				return fmt.Errorf("realtime_min_interval must be positive")
+			}
+			if p.RealtimeMaxInterval < p.RealtimeMinInterval {
+				return fmt.Errorf("realtime_max_interval must be at least realtime_min_interval")
+			}
+			if p.RealtimeInterval < p.RealtimeMinInterval || p.RealtimeInterval > p.RealtimeMaxInterval {
+				return fmt.Errorf("realtime_interval must be between realtime_min_interval and realtime_max_interval")
+			}
+			if p.AdaptiveTargetEvents < 1 {
+				return fmt.Errorf("adaptive_target_events must be positive")
+			}
+		}
+
+		p.realtimeOnce = sync.Once{}
+		p.realtimeDone = nil
+	}
+
+	if p.BackgroundPolling {
+		if p.BackgroundInterval <= 0 {
+			return fmt.Errorf("background_interval must be positive")
+		}
+
+		p.backgroundOnce = sync.Once{}
+		p.backgroundDone = nil
+	}
+
+	if p.Realtime || p.BackgroundPolling {
+		p.buffer = newBuffer(p.Log, p.RealtimeBufferLimit)
+	}
+
+	if p.DeliveryTracking && p.MaxUndeliveredMessages < 1 {
+		return fmt.Errorf("max_undelivered_messages must be positive")
+	}
+	p.tracking = nil
+
 	p.ctx, p.cancel = context.WithCancel(context.Background())
 
-	p.continuationToken = 0
-	p.lastFetch = time.Now().Add(time.Duration(-1) * time.Hour)
+	if p.MaxRequestsPerMinute > 0 {
+		p.limiter = rate.NewLimiter(rate.Limit(float64(p.MaxRequestsPerMinute)/60), p.MaxRequestsPerMinute)
+	}
+
+	if err := p.initTracing(); err != nil {
+		return err
+	}
+
+	if err := p.openGeoIP(); err != nil {
+		return err
+	}
+
+	if p.ReverseDNS {
+		p.reverseDNS = newReverseDNS(net.DefaultResolver, time.Duration(p.ReverseDNSTimeout), time.Duration(p.ReverseDNSCacheTTL))
+	}
 
 	client, err := p.HTTPClientConfig.CreateClient(p.ctx, p.Log)
 	if err != nil {
 		return err
 	}
 
+	if transport, ok := client.Transport.(*http.Transport); ok {
+		transport.MaxIdleConns = p.MaxIdleConns
+		transport.MaxIdleConnsPerHost = p.MaxIdleConnsPerHost
+		if transport.MaxIdleConnsPerHost == 0 {
+			transport.MaxIdleConnsPerHost = p.MaxConcurrentRequests
+		}
+
+		// A custom TLS config turns off HTTP/2 unless it's asked for
+		transport.ForceAttemptHTTP2 = p.PreferHTTP2
+
+		if dial := p.dialContext(); dial != nil {
+			transport.DialContext = dial
+		}
+	} else if p.UnixSocket != "" {
+		return fmt.Errorf("unix_socket can't be used with OAuth2")
+	} else {
+		p.Log.Warn("Connection pool and dialer settings are ignored when using OAuth2")
+	}
+
 	p.client = client
+	p.responseCache = make(map[string]*cachedResponse)
 
-	return nil
+	for _, t := range p.tenants {
+		if !t.discovers() && !p.ValidateCredentials && !p.DryRun && !p.TokenOwnerTag {
+			continue
+		}
+
+		user, err := p.fetchCurrentUser(t)
+		if err != nil {
+			return err
+		}
+
+		if t.discovers() {
+			if err := p.discoverOrganizations(t, user); err != nil {
+				return err
+			}
+		}
+
+		if p.ValidateCredentials || p.DryRun {
+			if err := p.validateCredentials(t, user); err != nil {
+				return err
+			}
+		}
+
+		if p.TokenOwnerTag {
+			t.owner = user.GitHubLogin
+		}
+	}
+
+	p.organizations = nil
+	for _, t := range p.tenants {
+		for _, name := range t.organizationNames {
+			org := newOrganization(t, name, p.Log)
+			org.owned = p.ownsKey(org.stateKey())
+			p.newCollectors(org)
+
+			// Organizations with a saved cursor drop this again in SetState
+			if !backfillStart.IsZero() {
+				org.lastFetch = backfillStart
+				org.backfillStart = backfillStart
+			}
+
+			p.organizations = append(p.organizations, org)
+		}
+	}
+
+	return p.loadStateFile()
 }
 
 func (p *PulumiApiConfig) SampleConfig() string {
@@ -86,6 +611,467 @@ func (p *PulumiApiConfig) SampleConfig() string {
 	# url = "https://api.pulumi.com"
 	organization = "${PULUMI_ORGANIZATION}"
 	token = "${PULUMI_TOKEN}"
+
+	## Read the token from this file instead. It's read again whenever the
+	## API rejects the token, so a rotated token is picked up without a
+	## restart.
+	# token_file = "/run/secrets/pulumi_token"
+
+	## Authenticate by exchanging a workload identity token, such as a
+	## Kubernetes service account token, for a short-lived Pulumi token
+	## instead of setting token. The file is read again for every exchange,
+	## which happens once 80% of the Pulumi token's lifetime has passed.
+	## The organization defaults to the first one collected from, the token
+	## type to organization (or team or personal, which need a scope such as
+	## "team:platform" or "user:jane"), and the expiration to the API's. A
+	## token the API doesn't give a lifetime for is taken to last the
+	## expiration, or an hour.
+	# oidc_token_file = "/var/run/secrets/pulumi/token"
+	# oidc_organization = ""
+	# oidc_requested_token_type = "organization"
+	# oidc_scope = ""
+	# oidc_token_expiration = "2h"
+
+	## Additional organizations to collect from with the same token. "*"
+	## stands for every organization the token's user is a member of, as
+	## listed at startup.
+	# organizations = []
+
+	## Check the token, and its access to every organization, at startup
+	# validate_credentials = true
+
+	## Try the config out, e.g. with telegraf --test or the -test flag of
+	## the execd binary: the credentials are checked whatever
+	## validate_credentials says, only the first page of every endpoint is
+	## fetched, realtime and background polling don't start and the state
+	## file is neither read nor written
+	# dry_run = false
+
+	## Tag every metric with token_owner, the user or organization the token
+	## belongs to, to tell apart the data of agents using different tokens
+	# token_owner_tag = false
+
+	## Tag every metric with organization_name and plan, the organization's
+	## display name and plan tier, fetched once from its details
+	# organization_metadata = false
+
+	## Split the work between shard_count agents with otherwise the same
+	## configuration, each with its own shard_index from 0. Every
+	## organization's audit logs and other per-organization metrics are
+	## collected by one shard, while its stacks are spread over all of them,
+	## which each list the stacks. Per-organization totals over stacks are
+	## tagged with shard, to be summed.
+	# shard_index = 0
+	# shard_count = 1
+
+	## Maximum number of organizations collected from at the same time
+	# max_concurrent_requests = 4
+
+	## Budget of requests per minute shared by every collector and
+	## organization, retries included, to leave the rest of the quota to
+	## CI and people. Up to a minute's worth can be made at once.
+	## 0 doesn't limit.
+	# max_requests_per_minute = 0
+
+	## Wait up to this long, at random, before collecting from each
+	## organization, so agents sharing an organization's rate limit don't
+	## all poll it in the same second. Keep it well below the interval.
+	# poll_jitter = "0s"
+
+	## Stop collecting from an organization for circuit_breaker_cooldown
+	## after this many gathers in a row had errors, rather than erroring
+	## every interval. Its state is emitted as pulumi_api_circuit_breaker.
+	## Set to 0 to never stop.
+	# circuit_breaker_threshold = 0
+	# circuit_breaker_cooldown = "5m"
+
+	## Timeout for each individual API request, including reading the body
+	# timeout = "5s"
+
+	## File used to persist the collection cursors across restarts. Telegraf
+	## doesn't persist plugin state, so without it every restart starts
+	## again from backfill_start or an hour ago. Cached responses and their
+	## ETags are only kept in memory, and revalidated after a restart.
+	# state_file = "/var/lib/telegraf/pulumi_api.state"
+
+	## Each query starts this far before the newest event already collected,
+	## events seen in the overlap are deduplicated
+	# overlap = "5m"
+
+	## Query the audit logs in windows with an end as well as a start, the
+	## end rounded down to a multiple of this. The cursor moves to the end
+	## of the window, so results don't depend on when the gather ran. Set
+	## to the interval, or a fraction of it. 0 queries up to the present.
+	# window_alignment = "0s"
+
+	## Maximum number of pages fetched per gather, the remaining pages are
+	## fetched on the following gathers. Set to 0 for no limit.
+	# max_pages = 100
+
+	## Number of items asked for per page, of the audit logs and stack
+	## updates. Larger pages take fewer requests, but more memory. 0 leaves
+	## it to the API.
+	# page_size = 0
+
+	## Only collect the audit log events of these stacks, as project/stack.
+	## The filtering is done by the API, so other events cost nothing.
+	# audit_log_stacks = ["website/production"]
+
+	## Only emit the fields matching field_include, and not field_exclude,
+	## both lists of globs, of every metric. Metrics left without fields
+	## are dropped. Excluding "payload" leaves out the raw audit events,
+	## keeping their count field of 1 to sum them up with.
+	# field_include = []
+	# field_exclude = ["payload"]
+
+	## Only emit the audit events with names matching event_include, and
+	## not event_exclude, both lists of globs
+	# event_include = ["stack-*", "member-*"]
+	# event_exclude = ["stack-viewed"]
+
+	## Emit the number of audit events dropped each gather, by reason, as
+	## the pulumi_api_dropped_events counter. Reasons are duplicate, for
+	## events seen in a previous overlap, event_filter, decode_error and
+	## anonymize_error.
+	# dropped_events_metric = false
+
+	## Emit how far behind the audit logs collection is as the
+	## pulumi_api_lag gauge, with lag_seconds since the newest event
+	## collected and since_success_seconds since the last successful fetch.
+	## Only a growing since_success_seconds means collection is stuck, a
+	## quiet organization's lag grows too.
+	# lag_metric = false
+
+	## Warn when the local clock is further than this from the API's, going
+	## by the Date header of its responses. The audit logs cursor mixes the
+	## two clocks, so a large skew can skip events or collect them twice.
+	## 0 never warns.
+	# max_clock_skew = "1m"
+
+	## Emit the skew as the pulumi_api_clock_skew gauge, skew_seconds
+	## positive when the local clock is ahead, to alert on drifting hosts.
+	# clock_skew_metric = false
+
+	## Emit the time of the oldest audit event the API still returns as the
+	## pulumi_audit_log_retention gauge, to check retention against policy.
+	## Finding it takes around 20 requests, so it's only looked for again
+	## after the interval, the gauge repeats the last answer until then.
+	# retention_watermark = false
+	# retention_watermark_interval = "24h"
+
+	## Import the audit logs since this date, or RFC3339 timestamp, from the
+	## CSV export once, rather than paging through months of history. The
+	## state_file remembers that it's been done.
+	# backfill_from = "2024-01-01"
+
+	## Start collecting from this date, or RFC3339 timestamp, on the first
+	## run rather than from an hour ago, paging through the audit logs and
+	## stack updates since. The catch-up is spread over gathers, max_pages
+	## at a time, and emits events with their original timestamps. Once a
+	## cursor is saved this has no effect.
+	# backfill_start = "2024-01-01T00:00:00Z"
+
+	## Only collect from the stacks with this stack tag, as name=value or
+	## just the name for any value, with the collectors working per stack.
+	## Lets teams opt their stacks in to monitoring by tagging them.
+	# stack_tag = "monitor=true"
+
+	## Reuse the stack list for this long before listing the stacks again,
+	## rather than on every gather, which saves a request per 100 stacks.
+	## Stacks created in between are picked up late, and so are updates to
+	## the stacks listed, as they're only fetched once a stack's last update
+	## changes. The teams of team_tag are cached for team_cache_ttl.
+	# stack_list_cache_ttl = "0s"
+
+	## Collect the updates of every stack, emitted as pulumi_stack_update
+	## events, and each stack's update success rate over success_rate_window
+	## as the pulumi_stack_updates gauge. Only the updates newer than the
+	## last version collected of a stack are fetched, and only once its last
+	## update changes, with the versions kept in the state across restarts.
+	# stack_updates = false
+	# success_rate_window = "24h"
+
+	## Keep emitting the gauge of stacks that were deleted, with a deleted
+	## field set, until their last updates leave success_rate_window. The
+	## gauge of live stacks has deleted set to false.
+	# include_deleted_stacks = false
+
+	## The gauge also summarises the durations of the updates that finished
+	## since the last gather, as min, max, mean and these percentiles
+	# duration_percentiles = [50.0, 95.0]
+
+	## Tag failed updates with failure_reason, one of cancelled,
+	## policy_violation, timeout, provider_error or unknown, and add the
+	## error saying so as failure_message. This takes a request per page of
+	## every failed update's events.
+	# failure_reasons = false
+
+	## With stack_updates, count the stacks whose most recent update other
+	## than a preview failed, per organization and per project, as the
+	## pulumi_failed_stacks gauge
+	# failed_stacks = false
+
+	## Sum each project's stacks up as the pulumi_project gauge, with their
+	## number and resources and, with stack_updates, their updates in
+	## success_rate_window and how many stacks' last update failed
+	# project_rollups = false
+
+	## Also emit every finished update other than previews to the
+	## pulumi_deploy_events measurement, with title and text fields to
+	## overlay as Grafana annotations
+	# deploy_events = false
+
+	## Emit the time until each stack with a TTL is destroyed, negative once
+	## it's overdue, and the number of scheduled and overdue stacks as the
+	## pulumi_stack_ttl gauge. This takes a request per stack.
+	# stack_ttl = false
+
+	## Report which stacks have Pulumi Deployments configured, and whether
+	## they get cloud credentials through OIDC or static secrets, as the
+	## pulumi_deployment_settings gauge. This takes a request per stack.
+	# deployment_settings = false
+
+	## Tag the metrics of stacks deploying from a repository with the
+	## repository and branch from their deployment settings, to join them
+	## with Git analytics. This takes a request per stack, shared with
+	## deployment_settings.
+	# source_tags = false
+
+	## Emit the number of deployments queued and running per stack, and how
+	## long the oldest of them has been pending, as the
+	## pulumi_pending_deployments gauge. This takes a request per stack.
+	# pending_deployments = false
+
+	## Scan the logs of deployments that failed since the last gather, and
+	## emit the number of error lines and the first error as the
+	## pulumi_deployment_errors metric. The first gather only scans the
+	## newest failure of each stack. This takes a request per stack, and
+	## one per page of every failed deployment's logs.
+	# deployment_logs = false
+
+	## Emit each stack's secrets provider, "service", "passphrase" or the
+	## key's scheme such as "awskms" for a cloud provider, and the number of
+	## stacks per provider as the pulumi_secrets_provider gauge, with kms
+	## true for providers backed by a key management service. This takes a
+	## request per stack, only repeated once the stack has been updated.
+	# secrets_providers = false
+
+	## Emit when each member of the organization was last seen in the audit
+	## logs, and how long ago, as the pulumi_member gauge, to find dormant
+	## accounts. Activity is only known from when collection started, or
+	## backfill_start, members not seen since have seen = false.
+	# member_activity = false
+
+	## Collect the billing period's update minutes, deployment minutes,
+	## resources under management and seats as the pulumi_usage gauge
+	# usage = false
+
+	## Break the deployment minutes down by stack, as pulumi_usage series
+	## tagged with project and stack, for charging teams back
+	# usage_per_stack = false
+
+	## Open every ESC environment, as a CI login would, and emit how long it
+	## took and whether evaluation produced errors as the
+	## pulumi_esc_evaluation gauge. Opening runs the environment's providers
+	## and takes a request per environment, which isn't retried as each one
+	## mints fresh credentials.
+	# esc_evaluation = false
+
+	## Emit each ESC environment's tags, as tags prefixed with tag_, and the
+	## number of environments it imports and dynamic providers it opens as
+	## the pulumi_esc_environment gauge. This takes two requests per
+	## environment, conditional ones.
+	# esc_inventory = false
+
+	## How often to search Insights for the resource types of insights
+	## below, each search takes a request per page of resources
+	# insights_interval = "1h"
+
+	## Also emit, per stack and resource type of insights, when its oldest
+	## resource was created as the pulumi_resource_age gauge, and with a
+	## threshold how many of its resources are older than it
+	# resource_age = false
+	# resource_age_threshold = "8760h"
+
+	## Retries for network errors and 5xx responses, the delay doubles on
+	## every attempt with up to retry_jitter added at random
+	# max_retries = 3
+	# retry_base_delay = "1s"
+	# retry_jitter = "500ms"
+
+	## Rate limited requests are retried once Retry-After has passed, a
+	## longer Retry-After than this leaves the request to the next gather
+	# max_retry_after = "1m"
+
+	## Precision of the event timestamps returned by the API, one of "s",
+	## "ms", "us" or "ns". "auto" guesses from the magnitude of each value.
+	# timestamp_precision = "auto"
+
+	## Timestamp events with when they happened, "event", or when they were
+	## collected, "collection", for outputs that reject old points. The
+	## latter keeps the event's own time, in ns, as an event_time field.
+	# timestamp_source = "event"
+
+	## Ask the API for compressed responses, "gzip" or "none"
+	# compression = "gzip"
+
+	## Fail requests whose response, once decompressed, is larger than this,
+	## rather than reading it all into memory. 0 reads any size.
+	# max_response_size = "64MiB"
+
+	## Sent with every request, so the traffic can be told apart in the
+	## logs of Pulumi support or a gateway in front of a self-hosted API.
+	## Defaults to telegraf-plugin-pulumi-api and the plugin's version.
+	# user_agent = "telegraf-plugin-pulumi-api/v1.2.3"
+
+	## Connection pool settings. Idle connections per host defaults to
+	## max_concurrent_requests, so every worker can reuse its connection,
+	## and an idle_conn_timeout of 0 keeps idle connections open forever.
+	# max_idle_conns = 100
+	# max_idle_conns_per_host = 4
+	# idle_conn_timeout = "0s"
+	# prefer_http2 = true
+
+	## Connect to the API through a Unix domain socket, e.g. of a local
+	## sidecar proxy, rather than the host of url, which is still sent as
+	## the Host header. The dial timeout and TCP keep-alive period default
+	## to no timeout and 15s, and a negative keep-alive turns it off.
+	# unix_socket = "/var/run/pulumi-proxy.sock"
+	# dial_timeout = "0s"
+	# dial_keep_alive = "15s"
+
+	## Emit a pulumi_api_request metric for every API request made, with its
+	## response time, status code and size
+	# request_metrics = false
+
+	## Report failed fetches as pulumi_api_errors metrics, tagged with the
+	## endpoint and a class such as auth, rate_limited, server or timeout,
+	## rather than as errors in the Telegraf log
+	# error_metrics = false
+
+	## Write every raw API response to a file in this directory, for
+	## troubleshooting only. The token is redacted from the files.
+	# dump_responses_dir = ""
+
+	## Shape audit events for log backends such as Loki with "log": the
+	## description as the only field, message, and everything else about
+	## the event as tags. The raw payload is left out. "metric" emits a
+	## count field of 1, the payload field and user attributes as
+	## configured.
+	# event_format = "metric"
+
+	## Add the header and extension fields of a SIEM event format to every
+	## audit event, "cef" or "leef", so SIEM parsers can ingest them as is.
+	## Severity is derived from the event name.
+	# siem_format = ""
+
+	## Severities, low, medium, high or critical, of the events with these
+	## names or globs, overriding the one derived from the name. Exact names
+	## win over globs.
+	# severity_overrides = {"stack-deleted" = "critical", "policy-*" = "high"}
+
+	## MaxMind GeoLite2 City database used to tag audit events with the
+	## country and city of their source IP
+	# geoip_database = "/usr/share/GeoIP/GeoLite2-City.mmdb"
+
+	## Replace the user names, GitHub logins, token names and source IPs of
+	## audit events, in tags and payload alike, with salted hashes. They're
+	## replaced where an event's description mentions them too. The same
+	## value always hashes the same, so events can still be grouped per
+	## user. GeoIP and reverse DNS still see the real source IP.
+	# anonymize = false
+	# anonymize_salt = "${PULUMI_ANONYMIZE_SALT}"
+
+	## Resolve the source IP of audit events to a source_hostname field.
+	## Lookups taking longer than the timeout are given up on, and answers
+	## are cached for the cache TTL.
+	# reverse_dns = false
+	# reverse_dns_timeout = "1s"
+	# reverse_dns_cache_ttl = "1h"
+
+	## Tag audit events with team, the teams of the event's user joined with
+	## commas, and the pulumi_member gauge of member_activity with the
+	## member's. The organization's teams and their members are fetched
+	## again once they're older than the cache TTL.
+	# team_tag = false
+	# team_cache_ttl = "1h"
+
+	## Wrap every API request in an OpenTelemetry span and send its W3C
+	## traceparent to Pulumi. Spans are exported over OTLP/HTTP when an
+	## endpoint is set, e.g. "http://localhost:4318".
+	# tracing = false
+	# tracing_endpoint = ""
+
+	## Poll the audit logs every realtime_interval in the background rather
+	## than once per interval, each gather emits the events buffered since
+	## the previous one. At most realtime_buffer_limit metrics are buffered,
+	## the oldest are dropped beyond that.
+	# realtime = false
+	# realtime_interval = "10s"
+	# realtime_buffer_limit = 10000
+
+	## Speed up the realtime polls of busy organizations, so they don't fall
+	## behind, and slow down those of quiet ones, to save request quota. Each
+	## organization starts at realtime_interval, and its interval moves
+	## within the bounds to collect about adaptive_target_events events per
+	## poll, at most halving or doubling each time.
+	# adaptive_polling = false
+	# realtime_min_interval = "1s"
+	# realtime_max_interval = "5m"
+	# adaptive_target_events = 100
+
+	## Poll everything every background_interval in the background, so
+	## gathers only emit what was buffered and never wait on the API. In
+	## realtime mode the audit logs keep to realtime_interval. The buffer is
+	## bounded by realtime_buffer_limit.
+	# background_polling = false
+	# background_interval = "1m"
+
+	## Only save the audit log cursor once outputs have accepted the events,
+	## and fetch them again if they were dropped, for at-least-once delivery.
+	## Each organization's events from a gather count as one message, at
+	## most max_undelivered_messages per organization are awaited at a time.
+	# delivery_tracking = false
+	# max_undelivered_messages = 1000
+
+	## The tables below have to come after every other option.
+
+	## Tokens of the organizations of organization and organizations that
+	## need one of their own, rather than token. Each gets its own rate
+	## limit and token_owner. Organizations left out use token.
+	# [inputs.pulumi_api.tokens]
+	#   acme = "${PULUMI_ACME_TOKEN}"
+	#   acme-labs = "${PULUMI_ACME_LABS_TOKEN}"
+
+	## Whether each attribute of an audit event's user is emitted as a
+	## "tag", a "field" or not at all with "drop". Attributes left out keep
+	## these defaults. Tags are named user, github_login and avatar_url.
+	# [inputs.pulumi_api.user_attributes]
+	#   name = "tag"
+	#   githubLogin = "tag"
+	#   avatarUrl = "drop"
+
+	## Count the resources of a type found by Insights, as the
+	## pulumi_resources gauge, grouped by the values of some of their
+	## properties. Each property tags the counts, nested properties are
+	## named with dots.
+	# [[inputs.pulumi_api.insights]]
+	#   type = "aws:ec2/instance:Instance"
+	#   properties = ["instanceType", "tags.team"]
+	# [[inputs.pulumi_api.insights]]
+	#   type = "aws:rds/instance:Instance"
+	#   properties = ["engine", "engineVersion"]
+
+	## More Pulumi APIs to collect from, such as a self-hosted install, each
+	## with its own token, organizations and cursors. Their metrics are
+	## tagged with endpoint_name. Every other option applies to them all.
+	# [[inputs.pulumi_api.endpoints]]
+	#   name = "self-hosted"
+	#   url = "https://pulumi-api.example.com"
+	#   token = "${PULUMI_SELF_HOSTED_TOKEN}"
+	#   # token_file = ""
+	#   # oidc_token_file = ""
+	#   organizations = ["platform"]
 `
 }
 
@@ -96,113 +1082,238 @@ func (p *PulumiApiConfig) Description() string {
 func (p *PulumiApiConfig) Gather(acc telegraf.Accumulator) error {
 	p.Log.Debug("Gathering Pulumi API metrics")
 
-	var wg sync.WaitGroup
+	// Telegraf calls Gather again on the next interval whether or not the
+	// last one finished, and the cursors aren't safe to share
+	if !atomic.CompareAndSwapInt32(&p.gathering, 0, 1) {
+		p.gathersSkipped.Incr(1)
+		p.Log.Warn("Skipping gather, the previous one is still running")
+		return nil
+	}
+	defer atomic.StoreInt32(&p.gathering, 0)
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+	p.inFlight.Lock()
+	defer p.inFlight.Unlock()
 
-		p.Log.Debug("Fetching audit logs")
+	if p.fieldFilter != nil {
+		acc = newFieldFilterAccumulator(acc, p.fieldFilter)
+	}
+
+	if p.BackgroundPolling && !p.DryRun {
+		p.startLoops()
+		p.buffer.flush(acc)
 
-		lastFetch := time.Now()
+		return nil
+	}
 
-		if err := p.fetchAuditLogs(acc); err != nil {
-			acc.AddError(fmt.Errorf("[organization=%s,fetch=audit_logs]: %s", p.Organization, err))
+	if p.Realtime && !p.DryRun {
+		p.startLoops()
+		p.buffer.flush(acc)
+
+		// Only the audit logs are worth polling faster than the interval
+		p.gatherOrganizations(acc, p.gatherCollectors)
+		p.addRateLimitMetrics(acc)
+		p.addDeprecationMetrics(acc)
+		if p.ClockSkewMetric {
+			p.addClockSkewMetrics(acc)
 		}
 
-		p.lastFetch = lastFetch
-		p.continuationToken = 0
-	}()
+		return nil
+	}
+
+	p.gatherOrganizations(acc, func(acc telegraf.Accumulator, org *organization) {
+		p.collectAuditLogs(acc, org)
+		p.gatherCollectors(acc, org)
+	})
+
+	p.addRateLimitMetrics(acc)
+	p.addDeprecationMetrics(acc)
+	if p.ClockSkewMetric {
+		p.addClockSkewMetrics(acc)
+	}
+
+	if err := p.saveStateFile(); err != nil {
+		acc.AddError(fmt.Errorf("saving state: %s", err))
+	}
 
-	wg.Wait()
 	return nil
 }
 
-func (p *PulumiApiConfig) Stop() {
-	p.cancel()
+// gatherOrganizations runs gather for every organization, at most
+// max_concurrent_requests of them at a time
+func (p *PulumiApiConfig) gatherOrganizations(acc telegraf.Accumulator, gather func(telegraf.Accumulator, *organization)) {
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, p.MaxConcurrentRequests)
+
+	for _, org := range p.organizations {
+		wg.Add(1)
+		go func(org *organization) {
+			defer wg.Done()
+
+			// Spread the organizations, and the agents polling them on the
+			// same interval, over poll_jitter
+			if p.PollJitter > 0 {
+				select {
+				case <-p.ctx.Done():
+					return
+				case <-time.After(time.Duration(rand.Int63n(int64(p.PollJitter)))):
+				}
+			}
+
+			workers <- struct{}{}
+			defer func() { <-workers }()
+
+			var orgAcc telegraf.Accumulator = acc
+			if tags := p.orgTags(acc, org); len(tags) > 0 {
+				orgAcc = newTaggingAccumulator(acc, tags)
+			}
+
+			p.guardGather(orgAcc, org, gather)
+		}(org)
+	}
+
+	wg.Wait()
 }
 
-func (p *PulumiApiConfig) auditLogUrl() string {
-	url := fmt.Sprintf("%s/api/orgs/%s/auditlogs?startTime=%d", p.Url, p.Organization, p.lastFetch.Unix())
+// collectAuditLogs backfills the audit logs if needed, then collects the
+// events since the last gather
+func (p *PulumiApiConfig) collectAuditLogs(acc telegraf.Accumulator, org *organization) {
+	if !org.owned {
+		return
+	}
 
-	if p.continuationToken != 0 {
-		url = fmt.Sprintf("%s&continuationToken=%d", url, p.continuationToken)
+	if p.tracking != nil {
+		p.collectTrackedAuditLogs(acc, org)
+	} else {
+		p.backfillAuditLogs(acc, org)
+		p.gatherAuditLogs(acc, org)
 	}
 
-	p.Log.Debugf("audit_log_url: %s", url)
+	if p.DroppedEventsMetric {
+		p.addDroppedEventsMetric(acc, org)
+	}
 
-	return url
+	if p.LagMetric {
+		p.addLagMetric(acc, org)
+	}
 }
 
-func (p *PulumiApiConfig) fetchAuditLogs(acc telegraf.Accumulator) error {
-	p.Log.Debug("Sending Audit Log Request")
+// Start implements telegraf.ServiceInput. Realtime polling begins here,
+// and a plugin that was stopped is brought back up where it left off.
+func (p *PulumiApiConfig) Start(acc telegraf.Accumulator) error {
+	if p.ctx.Err() != nil {
+		state := p.GetState()
 
-	request, err := http.NewRequest("GET", p.auditLogUrl(), nil)
+		if err := p.Init(); err != nil {
+			return err
+		}
 
-	if err != nil {
-		return err
+		if err := p.SetState(state); err != nil {
+			return err
+		}
+	}
+
+	if p.DeliveryTracking && p.tracking == nil {
+		p.startTracking(acc)
 	}
 
-	request.Header.Set("Accept", "application/vnd.pulumi+8")
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("Authorization", fmt.Sprintf("token %s", p.Token))
+	p.startLoops()
 
-	resp, err := p.client.Do(request)
-	if err != nil {
-		return err
+	return nil
+}
+
+// startLoops starts polling in the background, if enabled and not already
+func (p *PulumiApiConfig) startLoops() {
+	if p.DryRun {
+		return
 	}
 
-	defer resp.Body.Close()
+	if p.Realtime {
+		p.realtimeOnce.Do(p.startRealtime)
+	}
 
-	bytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return err
+	if p.BackgroundPolling {
+		p.backgroundOnce.Do(p.startBackground)
 	}
+}
 
-	if resp.StatusCode != http.StatusOK {
-		var apiErrorResponse ApiError
-		err = json.Unmarshal(bytes, &apiErrorResponse)
+// Stop implements telegraf.ServiceInput. Requests in flight are cancelled,
+// and the state is saved once the gathers they belong to have returned.
+func (p *PulumiApiConfig) Stop() {
+	p.cancel()
 
-		if err != nil {
-			// Ruhoh
-			return err
-		}
+	// Let the loops finish, so the state read after Stop is final
+	if p.realtimeDone != nil {
+		<-p.realtimeDone
+	}
+	if p.backgroundDone != nil {
+		<-p.backgroundDone
+	}
 
-		return fmt.Errorf("error code %d: %s", apiErrorResponse.Code, apiErrorResponse.Message)
+	p.inFlight.Lock()
+	if err := p.saveStateFile(); err != nil {
+		p.Log.Errorf("Saving state: %s", err)
 	}
+	p.inFlight.Unlock()
 
-	var auditLogsResponse AuditLogsResponse
-	err = json.Unmarshal(bytes, &auditLogsResponse)
+	p.stopTracing()
+	p.closeGeoIP()
+}
 
-	if err != nil {
-		return err
-	}
+// organizationNames merges organization and organizations, dropping repeats
+func (p *PulumiApiConfig) organizationNames() []string {
+	var names []string
+	seen := make(map[string]bool)
 
-	for _, auditLogEvent := range auditLogsResponse.AuditLogEvents {
-		tags := map[string]string{
-			"organization": p.Organization,
-			"event":        auditLogEvent.Event,
-			"user":         auditLogEvent.User.Name,
-			"github_login": auditLogEvent.User.GitHubLogin,
-			"source_ip":    auditLogEvent.SourceIP,
+	for _, name := range append([]string{p.Organization}, p.Organizations...) {
+		if name == "" || seen[name] {
+			continue
 		}
+		seen[name] = true
 
-		fields := map[string]interface{}{
-			"payload": string(bytes),
-		}
+		names = append(names, name)
+	}
 
-		p.Log.Debugf("Event with tags %v and fields %v", tags, fields)
+	return names
+}
 
-		acc.AddFields("pulumi_api", fields, tags, time.Unix(auditLogEvent.Timestamp, 0))
+// metricTime is the timestamp an event is emitted with
+func (p *PulumiApiConfig) metricTime(fields map[string]interface{}, eventTime time.Time) time.Time {
+	if p.TimestampSource != "collection" {
+		return eventTime
 	}
 
-	if auditLogsResponse.ContinuationToken != 0 {
-		p.Log.Info("Response was paginated, sending additional request with continuation token")
+	fields["event_time"] = eventTime.UnixNano()
 
-		p.continuationToken = auditLogsResponse.ContinuationToken
-		p.fetchAuditLogs(acc)
+	return time.Now()
+}
+
+// eventTime converts an API timestamp using the configured precision
+func (p *PulumiApiConfig) eventTime(timestamp int64) time.Time {
+	precision := p.TimestampPrecision
+
+	if precision == "auto" {
+		// Seconds won't reach 1e11 until the year 5138, and each finer
+		// precision is three orders of magnitude on from the last
+		switch {
+		case timestamp < 1e11:
+			precision = "s"
+		case timestamp < 1e14:
+			precision = "ms"
+		case timestamp < 1e17:
+			precision = "us"
+		default:
+			precision = "ns"
+		}
 	}
 
-	p.Log.Debug("Finished fetching audit logs")
-	return nil
+	switch precision {
+	case "ms":
+		return time.Unix(0, timestamp*int64(time.Millisecond))
+	case "us":
+		return time.Unix(0, timestamp*int64(time.Microsecond))
+	case "ns":
+		return time.Unix(0, timestamp)
+	default:
+		return time.Unix(timestamp, 0)
+	}
 }
@@ -0,0 +1,3460 @@
+package pulumi_api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/filter"
+	"github.com/influxdata/telegraf/plugins/inputs"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/rawkode/telegraf-plugin-pulumi-api/internal/fakepulumi"
+	"github.com/stretchr/testify/require"
+)
+
+// The fixtures' events all happen between 1700000100 and 1700000300
+var fixtureStart = time.Unix(1700000000, 0)
+
+func newTestPlugin(t *testing.T, server *fakepulumi.Server, options ...func(*PulumiApiConfig)) *PulumiApiConfig {
+	p := inputs.Inputs["pulumi_api"]().(*PulumiApiConfig)
+	p.Url = server.URL
+	p.Organization = "acme"
+	p.Token = fakepulumi.Token
+	p.Overlap = 0
+	p.RetryBaseDelay = config.Duration(time.Millisecond)
+	p.RetryJitter = 0
+	p.ValidateCredentials = false
+	p.Log = testutil.Logger{}
+
+	for _, option := range options {
+		option(p)
+	}
+
+	require.NoError(t, p.Init())
+	require.NoError(t, p.SetState(PulumiApiState{
+		Organizations: map[string]OrganizationState{
+			"acme": {LastFetch: fixtureStart},
+		},
+	}))
+
+	return p
+}
+
+func auditLogMetric(event string, category string, user string, githubLogin string, sourceIP string, payload string, timestamp int64) telegraf.Metric {
+	return testutil.MustMetric(
+		"pulumi_api",
+		map[string]string{
+			"organization": "acme",
+			"event":        event,
+			"category":     category,
+			"user":         user,
+			"github_login": githubLogin,
+			"source_ip":    sourceIP,
+		},
+		map[string]interface{}{
+			"count":   1,
+			"payload": payload,
+		},
+		time.Unix(timestamp, 0),
+	)
+}
+
+var expectedAuditLogs = []telegraf.Metric{
+	auditLogMetric("stack-updated", "stack", "Jane Doe", "jane", "203.0.113.10",
+		`{"timestamp":1700000300,"sourceIP":"203.0.113.10","event":"stack-updated","description":"Updated stack \"acme/website/production\"","user":{"name":"Jane Doe","githubLogin":"jane","avatarUrl":"https://example.com/jane.png"}}`,
+		1700000300),
+	auditLogMetric("member-added", "member", "Admin", "admin", "198.51.100.7",
+		`{"timestamp":1700000200,"sourceIP":"198.51.100.7","event":"member-added","description":"Added member \"john\" to the organization","user":{"name":"Admin","githubLogin":"admin","avatarUrl":"https://example.com/admin.png"}}`,
+		1700000200),
+	auditLogMetric("stack-created", "stack", "Jane Doe", "jane", "203.0.113.10",
+		`{"timestamp":1700000100,"sourceIP":"203.0.113.10","event":"stack-created","description":"Created stack \"acme/website/production\"","user":{"name":"Jane Doe","githubLogin":"jane","avatarUrl":"https://example.com/jane.png"}}`,
+		1700000100),
+}
+
+func TestGatherAuditLogs(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server)
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	testutil.RequireMetricsEqual(t, expectedAuditLogs, acc.GetTelegrafMetrics(), testutil.SortMetrics())
+
+	require.Equal(t, []string{
+		"/api/orgs/acme/auditlogs?startTime=1700000000",
+		"/api/orgs/acme/auditlogs?startTime=1700000000&continuationToken=page-2",
+	}, server.Requests())
+
+	// The cursor moves up to the newest event
+	require.Equal(t, time.Unix(1700000300, 0), p.organizations[0].lastFetch)
+}
+
+func TestGatherAuditLogsLogFormat(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.EventFormat = "log"
+		p.UserAttributes = map[string]string{"githubLogin": "field"}
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	metrics := acc.GetTelegrafMetrics()
+	require.Len(t, metrics, 3)
+
+	m := metrics[0]
+	require.Equal(t, map[string]interface{}{"message": `Updated stack "acme/website/production"`}, m.Fields())
+	require.Equal(t, map[string]string{
+		"organization": "acme",
+		"event":        "stack-updated",
+		"category":     "stack",
+		"source_ip":    "203.0.113.10",
+		"user":         "Jane Doe",
+		"github_login": "jane",
+	}, m.Tags())
+	require.Equal(t, time.Unix(1700000300, 0), m.Time())
+}
+
+func TestGatherDryRun(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	dir, err := os.MkdirTemp("", "pulumi")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.DryRun = true
+		p.Realtime = true
+		p.StateFile = filepath.Join(dir, "state.json")
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	// A sample from the first page, gathered right away despite realtime
+	require.Len(t, acc.GetTelegrafMetrics(), 2)
+
+	// The credentials were checked even without validate_credentials
+	require.Equal(t, []string{
+		"/api/user",
+		"/api/orgs/acme/auditlogs?startTime=1700000000",
+	}, server.Requests())
+
+	_, err = os.Stat(p.StateFile)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestGatherUserAgent(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	var userAgents []string
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.UserAgent())
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	p := newTestPlugin(t, server)
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+
+	p = newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.UserAgent = "acme-monitoring/1.0"
+	})
+	require.NoError(t, p.Gather(&acc))
+
+	require.Equal(t, []string{"telegraf-plugin-pulumi-api/dev", "acme-monitoring/1.0"}, userAgents)
+}
+
+func TestGatherPerOrganizationTokens(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.Token = "invalid"
+		p.Organizations = []string{"labs"}
+		p.Tokens = map[string]string{"acme": fakepulumi.Token}
+	})
+	require.Len(t, p.tenants, 2)
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+
+	// Only labs is left with the shared token, which the API rejects
+	require.Len(t, acc.Errors, 1)
+	require.Contains(t, acc.Errors[0].Error(), "labs")
+	require.Len(t, acc.GetTelegrafMetrics(), 3)
+}
+
+func TestGatherAuditLogsDeduplicatesOverlap(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server)
+	p.Overlap = config.Duration(time.Hour)
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Len(t, acc.GetTelegrafMetrics(), 3)
+
+	// The fake API returns the same events again, none of which are new
+	acc.ClearMetrics()
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Empty(t, acc.GetTelegrafMetrics())
+}
+
+func TestGatherAuditLogsMaxPagesResumes(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server)
+	p.MaxPages = 1
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Len(t, acc.GetTelegrafMetrics(), 2)
+	require.Equal(t, fixtureStart, p.organizations[0].lastFetch)
+
+	require.NoError(t, p.Gather(&acc))
+	testutil.RequireMetricsEqual(t, expectedAuditLogs, acc.GetTelegrafMetrics(), testutil.SortMetrics())
+	require.Equal(t, time.Unix(1700000300, 0), p.organizations[0].lastFetch)
+}
+
+func TestGatherAuditLogsErrorKeepsCursor(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		fakepulumi.Error(w, http.StatusInternalServerError, "Internal Server Error")
+	})
+
+	p := newTestPlugin(t, server)
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Len(t, acc.Errors, 1)
+	require.Empty(t, acc.GetTelegrafMetrics())
+
+	// The first attempt plus every retry
+	require.Len(t, server.Requests(), 1+p.MaxRetries)
+	require.Equal(t, fixtureStart, p.organizations[0].lastFetch)
+}
+
+func TestGatherAuditLogsInvalidToken(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server)
+	p.Token = "invalid"
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Len(t, acc.Errors, 1)
+	require.Contains(t, acc.Errors[0].Error(), "error code 401")
+
+	// Client errors aren't retried
+	require.Len(t, server.Requests(), 1)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		delay time.Duration
+	}{
+		{"none", "", 0},
+		{"seconds", "120", 2 * time.Minute},
+		{"HTTP date", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), time.Hour},
+		{"HTTP date passed", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+		{"invalid", "soon", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.InDelta(t, tt.delay.Seconds(), parseRetryAfter(tt.value).Seconds(), 1)
+		})
+	}
+}
+
+func TestGatherRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter func() string
+		requests   int
+		wait       time.Duration
+	}{
+		{"seconds honoured", func() string { return "1" }, 3, time.Second},
+		{"seconds capped", func() string { return "120" }, 1, 0},
+		// The date only has whole seconds, so it's two to wait at least one
+		{"HTTP date honoured", func() string { return time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat) }, 3, time.Second},
+		{"HTTP date capped", func() string { return time.Now().Add(time.Hour).UTC().Format(http.TimeFormat) }, 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakepulumi.NewServer()
+			defer server.Close()
+
+			limited := true
+			var times []time.Time
+			server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+				times = append(times, time.Now())
+				if limited {
+					limited = false
+					w.Header().Set("Retry-After", tt.retryAfter())
+					fakepulumi.Error(w, http.StatusTooManyRequests, "Too many requests")
+					return
+				}
+
+				if r.URL.Query().Get("continuationToken") == "page-2" {
+					fakepulumi.Fixture(w, "auditlogs_page2.json")
+				} else {
+					fakepulumi.Fixture(w, "auditlogs_page1.json")
+				}
+			})
+
+			p := newTestPlugin(t, server)
+
+			var acc testutil.Accumulator
+			require.NoError(t, p.Gather(&acc))
+			require.Len(t, server.Requests(), tt.requests)
+
+			// Beyond max_retry_after the next gather tries again instead
+			if tt.requests == 1 {
+				require.Len(t, acc.Errors, 1)
+				require.Contains(t, acc.Errors[0].Error(), "rate limited")
+				return
+			}
+
+			require.Empty(t, acc.Errors)
+			require.GreaterOrEqual(t, int64(times[1].Sub(times[0])), int64(tt.wait))
+		})
+	}
+}
+
+func TestGatherGzip(t *testing.T) {
+	fixture := func(name string) []byte {
+		recorder := httptest.NewRecorder()
+		fakepulumi.Fixture(recorder, name)
+
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		writer.Write(recorder.Body.Bytes())
+		writer.Close()
+		return compressed.Bytes()
+	}
+
+	tests := []struct {
+		name  string
+		body  func(page string) []byte
+		valid bool
+	}{
+		{"compressed", func(page string) []byte { return fixture(page) }, true},
+		{"corrupt", func(string) []byte { return []byte("not gzip at all") }, false},
+		{"truncated", func(page string) []byte { body := fixture(page); return body[:len(body)/2] }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakepulumi.NewServer()
+			defer server.Close()
+
+			server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Accept-Encoding") != "gzip" {
+					fakepulumi.Error(w, http.StatusBadRequest, "Expected gzip")
+					return
+				}
+
+				page := "auditlogs_page1.json"
+				if r.URL.Query().Get("continuationToken") == "page-2" {
+					page = "auditlogs_page2.json"
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Write(tt.body(page))
+			})
+
+			p := newTestPlugin(t, server)
+
+			var acc testutil.Accumulator
+			require.NoError(t, p.Gather(&acc))
+
+			if tt.valid {
+				require.Empty(t, acc.Errors)
+				testutil.RequireMetricsEqual(t, expectedAuditLogs, acc.GetTelegrafMetrics(), testutil.SortMetrics())
+				return
+			}
+
+			require.Len(t, acc.Errors, 1)
+			require.Empty(t, acc.GetTelegrafMetrics())
+			require.Equal(t, fixtureStart, p.organizations[0].lastFetch)
+		})
+	}
+}
+
+func TestGatherRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		failures int
+		requests int
+		err      string
+	}{
+		{"server error then success", http.StatusServiceUnavailable, 2, 4, ""},
+		{"retries running out", http.StatusInternalServerError, 100, 4, "giving up after 3 retries"},
+		{"client error", http.StatusNotFound, 100, 1, "error code 404"},
+		{"bad request", http.StatusBadRequest, 100, 1, "error code 400"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakepulumi.NewServer()
+			defer server.Close()
+
+			failures := tt.failures
+			var times []time.Time
+			server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+				times = append(times, time.Now())
+				if failures > 0 {
+					failures--
+					fakepulumi.Error(w, tt.status, http.StatusText(tt.status))
+					return
+				}
+
+				if r.URL.Query().Get("continuationToken") == "page-2" {
+					fakepulumi.Fixture(w, "auditlogs_page2.json")
+				} else {
+					fakepulumi.Fixture(w, "auditlogs_page1.json")
+				}
+			})
+
+			p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+				p.RetryBaseDelay = config.Duration(20 * time.Millisecond)
+			})
+
+			var acc testutil.Accumulator
+			require.NoError(t, p.Gather(&acc))
+			require.Len(t, server.Requests(), tt.requests)
+
+			// The delay doubles with every retry
+			for i := 1; i < len(times) && i <= tt.failures; i++ {
+				require.GreaterOrEqual(t, int64(times[i].Sub(times[i-1])), int64(20*time.Millisecond)<<(i-1))
+			}
+
+			if tt.err == "" {
+				require.Empty(t, acc.Errors)
+				testutil.RequireMetricsEqual(t, expectedAuditLogs, acc.GetTelegrafMetrics(), testutil.SortMetrics())
+				return
+			}
+
+			require.Len(t, acc.Errors, 1)
+			require.Contains(t, acc.Errors[0].Error(), tt.err)
+			require.Empty(t, acc.GetTelegrafMetrics())
+		})
+	}
+}
+
+func TestGatherAuditLogsRealtime(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.Realtime = true
+		p.RealtimeInterval = config.Duration(time.Hour)
+	})
+
+	// The first gather starts the loop, the events show up on a later one
+	var acc testutil.Accumulator
+	require.Eventually(t, func() bool {
+		if err := p.Gather(&acc); err != nil {
+			return false
+		}
+		return len(acc.GetTelegrafMetrics()) == len(expectedAuditLogs)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	p.Stop()
+
+	require.Empty(t, acc.Errors)
+	testutil.RequireMetricsEqual(t, expectedAuditLogs, acc.GetTelegrafMetrics(), testutil.SortMetrics())
+	require.Len(t, server.Requests(), 2)
+}
+
+func TestAdaptivePollInterval(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.Realtime = true
+		p.AdaptivePolling = true
+		p.RealtimeMinInterval = config.Duration(2 * time.Second)
+		p.RealtimeMaxInterval = config.Duration(time.Minute)
+	})
+	org := p.organizations[0]
+
+	start := time.Now()
+	poll := func(elapsed time.Duration, events int64) time.Duration {
+		org.auditEvents += events
+		p.adaptPollInterval(org, start.Add(elapsed))
+		require.Equal(t, start.Add(elapsed).Add(org.poll.interval), org.poll.next)
+		return org.poll.interval
+	}
+
+	// The catch up of the first poll doesn't count
+	require.Equal(t, 10*time.Second, poll(0, 5000))
+
+	// A quiet organization slows down to the maximum
+	require.Equal(t, 20*time.Second, poll(10*time.Second, 0))
+	require.Equal(t, 40*time.Second, poll(30*time.Second, 0))
+	require.Equal(t, time.Minute, poll(70*time.Second, 0))
+
+	// A busy one speeds up, halving at most, down to the minimum
+	require.Equal(t, 30*time.Second, poll(130*time.Second, 6000))
+	require.Equal(t, 15*time.Second, poll(160*time.Second, 6000))
+	require.Equal(t, 7500*time.Millisecond, poll(175*time.Second, 6000))
+	require.Equal(t, 3750*time.Millisecond, poll(182500*time.Millisecond, 6000))
+	require.Equal(t, 2*time.Second, poll(186250*time.Millisecond, 6000))
+}
+
+func TestAdaptivePollIntervalIgnoresStackUpdates(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.Realtime = true
+		p.AdaptivePolling = true
+		p.StackUpdates = true
+		p.SuccessRateWindow = config.Duration(100000 * time.Hour)
+	})
+	org := p.organizations[0]
+
+	start := time.Now()
+	p.adaptPollInterval(org, start)
+	require.Equal(t, 10*time.Second, org.poll.interval)
+
+	// The stacks collector emits updates, but no audit events came in
+	var acc testutil.Accumulator
+	p.gatherCollectors(&acc, org)
+	require.Empty(t, acc.Errors)
+	require.True(t, acc.HasMeasurement("pulumi_stack_update"))
+
+	p.adaptPollInterval(org, start.Add(10*time.Second))
+	require.Equal(t, 20*time.Second, org.poll.interval)
+	require.Zero(t, org.poll.rate)
+}
+
+func TestGatherBackgroundPolling(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	release := make(chan struct{})
+	server.Handle("billing/usage", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fakepulumi.Fixture(w, "usage.json")
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.BackgroundPolling = true
+		p.BackgroundInterval = config.Duration(time.Hour)
+		p.Usage = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Start(&acc))
+
+	// Gathers don't wait for the slow response
+	start := time.Now()
+	require.NoError(t, p.Gather(&acc))
+	require.Less(t, time.Since(start), time.Second)
+	require.False(t, acc.HasMeasurement("pulumi_usage"))
+
+	close(release)
+	require.Eventually(t, func() bool {
+		require.NoError(t, p.Gather(&acc))
+		return acc.HasMeasurement("pulumi_usage")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	p.Stop()
+
+	require.Empty(t, acc.Errors)
+	require.True(t, acc.HasMeasurement("pulumi_api"))
+}
+
+// fakeTrackingAccumulator reports deliveries only when told to
+type fakeTrackingAccumulator struct {
+	*testutil.Accumulator
+
+	mu        sync.Mutex
+	groups    int
+	delivered chan telegraf.DeliveryInfo
+}
+
+type fakeDeliveryInfo struct {
+	id        telegraf.TrackingID
+	delivered bool
+}
+
+func (i fakeDeliveryInfo) ID() telegraf.TrackingID { return i.id }
+func (i fakeDeliveryInfo) Delivered() bool         { return i.delivered }
+
+func (a *fakeTrackingAccumulator) WithTracking(int) telegraf.TrackingAccumulator { return a }
+
+func (a *fakeTrackingAccumulator) AddTrackingMetric(m telegraf.Metric) telegraf.TrackingID {
+	return a.AddTrackingMetricGroup([]telegraf.Metric{m})
+}
+
+func (a *fakeTrackingAccumulator) AddTrackingMetricGroup(group []telegraf.Metric) telegraf.TrackingID {
+	for _, m := range group {
+		a.AddMetric(m)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.groups++
+
+	return telegraf.TrackingID(a.groups)
+}
+
+func (a *fakeTrackingAccumulator) Delivered() <-chan telegraf.DeliveryInfo { return a.delivered }
+
+func TestGatherAuditLogsDeliveryTracking(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.DeliveryTracking = true
+	})
+	defer p.Stop()
+
+	acc := &fakeTrackingAccumulator{Accumulator: &testutil.Accumulator{}, delivered: make(chan telegraf.DeliveryInfo)}
+	require.NoError(t, p.Start(acc))
+
+	deliver := func(id telegraf.TrackingID, delivered bool) {
+		acc.delivered <- fakeDeliveryInfo{id: id, delivered: delivered}
+		require.Eventually(t, func() bool {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			_, ok := p.deliveries[id]
+			return ok
+		}, time.Second, time.Millisecond)
+	}
+	lastFetch := func() int64 {
+		return p.GetState().(PulumiApiState).Organizations["acme"].LastFetch.Unix()
+	}
+
+	require.NoError(t, p.Gather(acc))
+	require.Len(t, acc.GetTelegrafMetrics(), len(expectedAuditLogs))
+	require.Equal(t, fixtureStart.Unix(), lastFetch())
+
+	// Dropped by the outputs, so fetched again from the same cursor
+	deliver(1, false)
+	acc.ClearMetrics()
+	require.NoError(t, p.Gather(acc))
+	testutil.RequireMetricsEqual(t, expectedAuditLogs, acc.GetTelegrafMetrics(), testutil.SortMetrics())
+	require.Equal(t, fixtureStart.Unix(), lastFetch())
+
+	deliver(2, true)
+	require.NoError(t, p.Gather(acc))
+	require.Empty(t, acc.Errors)
+	require.Equal(t, int64(1700000300), lastFetch())
+}
+
+func TestGatherAuditLogsDeliveryTrackingBacklog(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.DeliveryTracking = true
+		p.MaxUndeliveredMessages = 2
+	})
+	defer p.Stop()
+
+	acc := &fakeTrackingAccumulator{Accumulator: &testutil.Accumulator{}, delivered: make(chan telegraf.DeliveryInfo)}
+	require.NoError(t, p.Start(acc))
+
+	lastFetch := func() int64 {
+		return p.GetState().(PulumiApiState).Organizations["acme"].LastFetch.Unix()
+	}
+	awaiting := func() int {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return len(p.organizations[0].tracked)
+	}
+
+	// Two gathers awaiting delivery fill max_undelivered_messages, so the
+	// third doesn't fetch anything
+	require.NoError(t, p.Gather(acc))
+	require.NoError(t, p.Gather(acc))
+	require.Equal(t, 2, awaiting())
+	requests := len(server.Requests())
+
+	acc.ClearMetrics()
+	require.NoError(t, p.Gather(acc))
+	require.Empty(t, acc.GetTelegrafMetrics())
+	require.Len(t, server.Requests(), requests)
+	require.Equal(t, fixtureStart.Unix(), lastFetch())
+
+	// The first is dropped by the outputs, which abandons the second, so its
+	// delivery is ignored and the events are fetched again from the start
+	acc.delivered <- fakeDeliveryInfo{id: 1, delivered: false}
+	acc.delivered <- fakeDeliveryInfo{id: 2, delivered: true}
+	require.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		_, first := p.deliveries[1]
+		_, second := p.deliveries[2]
+		return first && second
+	}, time.Second, time.Millisecond)
+
+	acc.ClearMetrics()
+	require.NoError(t, p.Gather(acc))
+	testutil.RequireMetricsEqual(t, expectedAuditLogs, acc.GetTelegrafMetrics(), testutil.SortMetrics())
+	require.Equal(t, "/api/orgs/acme/auditlogs?startTime=1700000000", server.Requests()[requests])
+	require.Equal(t, 1, awaiting())
+	require.Equal(t, fixtureStart.Unix(), lastFetch())
+	require.Empty(t, acc.Errors)
+}
+
+func TestGatherAuditLogsCEF(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.SIEMFormat = "cef"
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	fields, ok := acc.Get("pulumi_api")
+	require.True(t, ok)
+	require.Equal(t, 0, fields.Fields["cef_version"])
+	require.Equal(t, "Pulumi", fields.Fields["device_vendor"])
+	require.Equal(t, "stack-updated", fields.Fields["signature_id"])
+	require.Equal(t, 5, fields.Fields["severity"])
+	require.Equal(t, int64(1700000300000), fields.Fields["rt"])
+}
+
+func TestGatherAuditLogsBackfill(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.BackfillFrom = "2023-11-14"
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	expected := append([]telegraf.Metric{
+		auditLogMetric("stack-deleted", "stack", "Jane Doe", "jane", "203.0.113.10",
+			`{"timestamp":1699999200,"sourceIP":"203.0.113.10","event":"stack-deleted","description":"Deleted stack \"acme/website/dev\"","user":{"name":"Jane Doe","githubLogin":"jane","avatarUrl":""}}`,
+			1699999200),
+		auditLogMetric("member-removed", "member", "Admin", "admin", "198.51.100.7",
+			`{"timestamp":1699999000,"sourceIP":"198.51.100.7","event":"member-removed","description":"Removed member \"bob\" from the organization","user":{"name":"Admin","githubLogin":"admin","avatarUrl":""}}`,
+			1699999000),
+	}, expectedAuditLogs...)
+	testutil.RequireMetricsEqual(t, expected, acc.GetTelegrafMetrics(), testutil.SortMetrics())
+
+	require.Equal(t, "/api/orgs/acme/auditlogs/export?format=csv&startTime=1699920000&endTime=1700000000", server.Requests()[0])
+
+	// The backfill only happens once
+	require.NoError(t, p.Gather(&acc))
+	for _, request := range server.Requests()[1:] {
+		require.NotContains(t, request, "export")
+	}
+}
+
+func TestGatherTimestampPrecision(t *testing.T) {
+	instant := time.Unix(1700000300, 123456789)
+
+	tests := []struct {
+		precision string
+		timestamp int64
+		expected  time.Time
+	}{
+		{"s", 1700000300, time.Unix(1700000300, 0)},
+		{"ms", 1700000300123, instant.Truncate(time.Millisecond)},
+		{"us", 1700000300123456, instant.Truncate(time.Microsecond)},
+		{"ns", 1700000300123456789, instant},
+		{"auto", 1700000300, time.Unix(1700000300, 0)},
+		{"auto", 1700000300123, instant.Truncate(time.Millisecond)},
+		{"auto", 1700000300123456, instant.Truncate(time.Microsecond)},
+		{"auto", 1700000300123456789, instant},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %d", tt.precision, tt.timestamp), func(t *testing.T) {
+			server := fakepulumi.NewServer()
+			defer server.Close()
+
+			server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"auditLogEvents":[{"timestamp":%d,"event":"stack-updated","user":{"githubLogin":"jane"}}]}`, tt.timestamp)
+			})
+
+			p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+				p.TimestampPrecision = tt.precision
+			})
+
+			var acc testutil.Accumulator
+			require.NoError(t, p.Gather(&acc))
+			require.Empty(t, acc.Errors)
+
+			metrics := acc.GetTelegrafMetrics()
+			require.Len(t, metrics, 1)
+			require.Equal(t, tt.expected.UnixNano(), metrics[0].Time().UnixNano())
+		})
+	}
+}
+
+func TestExportTimestamp(t *testing.T) {
+	tests := []struct {
+		precision string
+		value     string
+		timestamp int64
+	}{
+		{"s", "1700000300", 1700000300},
+		{"s", "2023-11-14T22:18:20.123456789Z", 1700000300},
+		{"ms", "2023-11-14T22:18:20.123456789Z", 1700000300123},
+		{"us", "2023-11-14T22:18:20.123456789Z", 1700000300123456},
+		{"ns", "2023-11-14T22:18:20.123456789Z", 1700000300123456789},
+		{"auto", "2023-11-14T22:18:20.123456789Z", 1700000300},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.precision+" "+tt.value, func(t *testing.T) {
+			p := &PulumiApiConfig{TimestampPrecision: tt.precision}
+
+			timestamp, err := p.exportTimestamp(tt.value)
+			require.NoError(t, err)
+			require.Equal(t, tt.timestamp, timestamp)
+		})
+	}
+
+	_, err := (&PulumiApiConfig{}).exportTimestamp("yesterday")
+	require.Error(t, err)
+}
+
+func TestGatherAuditLogsTraceparent(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	var traceparents []string
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		traceparents = append(traceparents, r.Header.Get("traceparent"))
+		fakepulumi.Fixture(w, "auditlogs_page2.json")
+	})
+
+	p := newTestPlugin(t, server)
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Equal(t, []string{""}, traceparents)
+
+	p = newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.Tracing = true
+	})
+	defer p.Stop()
+
+	require.NoError(t, p.Gather(&acc))
+	require.Len(t, traceparents, 2)
+	require.Regexp(t, `^00-[0-9a-f]{32}-[0-9a-f]{16}-01$`, traceparents[1])
+}
+
+func TestInitValidatesCredentials(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.ValidateCredentials = true
+	})
+	require.Equal(t, []string{"/api/user"}, server.Requests())
+
+	p.Token = "invalid"
+	err := p.Init()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "error code 401")
+
+	p.Token = fakepulumi.Token
+	p.Organizations = []string{"globex"}
+	err = p.Init()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no access to organization globex")
+}
+
+func TestGatherThroughUnixSocket(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	dir, err := os.MkdirTemp("", "pulumi")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "api.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	go http.Serve(listener, server.Config.Handler)
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		// Only resolvable through the socket
+		p.Url = "http://pulumi-api.invalid"
+		p.UnixSocket = socket
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Len(t, acc.GetTelegrafMetrics(), 3)
+}
+
+func TestGatherMaxResponseSize(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.MaxResponseSize = 64
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Len(t, acc.Errors, 1)
+	require.Contains(t, acc.Errors[0].Error(), "response larger than max_response_size")
+	require.Empty(t, acc.GetTelegrafMetrics())
+
+	// Oversized responses aren't retried
+	require.Len(t, server.Requests(), 1)
+}
+
+func TestGatherOIDCTokenExchange(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte(fakepulumi.IDToken+"\n"), 0600))
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.Token = ""
+		p.OIDCTokenFile = tokenFile
+	})
+
+	exchanges := func() int {
+		count := 0
+		for _, request := range server.Requests() {
+			if request == "/api/oauth/token" {
+				count++
+			}
+		}
+		return count
+	}
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Len(t, acc.GetTelegrafMetrics(), 3)
+	require.Equal(t, 1, exchanges())
+
+	// Still valid
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Equal(t, 1, exchanges())
+
+	// Due for a refresh
+	p.tenants[0].expireToken()
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Equal(t, 2, exchanges())
+
+	// An identity token the API doesn't trust fails the requests
+	require.NoError(t, os.WriteFile(tokenFile, []byte("forged"), 0600))
+	p.tenants[0].expireToken()
+	acc.ClearMetrics()
+	require.NoError(t, p.Gather(&acc))
+	require.Len(t, acc.Errors, 1)
+	require.Contains(t, acc.Errors[0].Error(), "exchanging OIDC token")
+}
+
+func TestGatherOIDCTokenLifetime(t *testing.T) {
+	tests := []struct {
+		name       string
+		expiresIn  string
+		expiration time.Duration
+		lifetime   time.Duration
+	}{
+		{"expires_in", `,"expires_in":600`, 0, 10 * time.Minute},
+		{"zero", `,"expires_in":0`, 0, oidcDefaultLifetime},
+		{"missing", ``, 0, oidcDefaultLifetime},
+		{"missing with oidc_token_expiration", ``, 30 * time.Minute, 30 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakepulumi.NewServer()
+			defer server.Close()
+
+			server.Handle("oauth/token", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"access_token":%q,"token_type":"token"%s}`, fakepulumi.Token, tt.expiresIn)
+			})
+
+			tokenFile := filepath.Join(t.TempDir(), "token")
+			require.NoError(t, os.WriteFile(tokenFile, []byte(fakepulumi.IDToken), 0600))
+
+			p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+				p.Token = ""
+				p.OIDCTokenFile = tokenFile
+				p.OIDCTokenExpiration = config.Duration(tt.expiration)
+			})
+
+			var acc testutil.Accumulator
+			require.NoError(t, p.Gather(&acc))
+			require.NoError(t, p.Gather(&acc))
+			require.Empty(t, acc.Errors)
+
+			exchanges := 0
+			for _, request := range server.Requests() {
+				if request == "/api/oauth/token" {
+					exchanges++
+				}
+			}
+			require.Equal(t, 1, exchanges)
+
+			refreshIn := time.Until(p.tenants[0].exchange.refreshAt)
+			require.InDelta(t, time.Duration(float64(tt.lifetime)*oidcRefreshAfter).Seconds(), refreshIn.Seconds(), 5)
+		})
+	}
+}
+
+func TestGatherOIDCTokenRejected(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte(fakepulumi.IDToken+"\n"), 0600))
+
+	status := http.StatusForbidden
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		fakepulumi.Error(w, status, http.StatusText(status))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.Token = ""
+		p.OIDCTokenFile = tokenFile
+	})
+
+	count := func(path string) int {
+		count := 0
+		for _, request := range server.Requests() {
+			if strings.HasPrefix(request, path) {
+				count++
+			}
+		}
+		return count
+	}
+
+	// Lacking a permission isn't a reason to exchange the token again
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Len(t, acc.Errors, 1)
+	require.Equal(t, 1, count("/api/oauth/token"))
+	require.Equal(t, 1, count("/api/orgs/acme/auditlogs"))
+
+	require.NoError(t, p.Gather(&acc))
+	require.Equal(t, 1, count("/api/oauth/token"))
+
+	// A rejected token is, and the request made once more with the new one
+	status = http.StatusUnauthorized
+	acc.ClearMetrics()
+	require.NoError(t, p.Gather(&acc))
+	require.Equal(t, 2, count("/api/oauth/token"))
+	require.Equal(t, 4, count("/api/orgs/acme/auditlogs"))
+}
+
+func TestInitDiscoversOrganizations(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.Organization = ""
+		p.Organizations = []string{"*", "globex"}
+	})
+	require.Equal(t, []string{"/api/user"}, server.Requests())
+
+	var names []string
+	for _, org := range p.organizations {
+		names = append(names, org.name)
+	}
+	require.Equal(t, []string{"acme", "globex"}, names)
+}
+
+func TestGatherStackUpdates(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.StackUpdates = true
+		// Long enough to reach back to the fixtures
+		p.SuccessRateWindow = config.Duration(100000 * time.Hour)
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	stackUpdate := func(kind string, result string, initiator string, version int64, start int64, end int64, changes map[string]int) telegraf.Metric {
+		fields := map[string]interface{}{
+			"count":    1,
+			"version":  version,
+			"duration": float64(end - start),
+		}
+		for operation, count := range changes {
+			fields["resource_changes_"+operation] = count
+		}
+
+		return testutil.MustMetric(
+			"pulumi_stack_update",
+			map[string]string{
+				"organization": "acme",
+				"project":      "website",
+				"stack":        "production",
+				"kind":         kind,
+				"result":       result,
+				"initiator":    initiator,
+			},
+			fields,
+			time.Unix(end, 0),
+		)
+	}
+
+	expected := []telegraf.Metric{
+		stackUpdate("preview", "succeeded", "cli", 40, 1699980000, 1699980010, map[string]int{"same": 12}),
+		stackUpdate("update", "failed", "ci", 41, 1699990000, 1699990030, map[string]int{"update": 1}),
+		stackUpdate("update", "succeeded", "deployments", 42, 1700000000, 1700000090, map[string]int{"create": 2, "update": 1, "same": 10}),
+		testutil.MustMetric(
+			"pulumi_stack_updates",
+			map[string]string{"organization": "acme", "project": "website", "stack": "production"},
+			map[string]interface{}{
+				"updates":            2,
+				"successful_updates": 1,
+				"success_rate":       0.5,
+				"duration_min":       float64(30),
+				"duration_max":       float64(90),
+				"duration_mean":      float64(60),
+				"duration_p50":       float64(30),
+				"duration_p95":       float64(90),
+			},
+			time.Unix(0, 0),
+			telegraf.Gauge,
+		),
+		testutil.MustMetric(
+			"pulumi_stack_updates",
+			map[string]string{"organization": "acme", "project": "website", "stack": "staging"},
+			map[string]interface{}{"updates": 0, "successful_updates": 0},
+			time.Unix(0, 0),
+			telegraf.Gauge,
+		),
+	}
+
+	testutil.RequireMetricsEqual(t, expected, acc.GetTelegrafMetrics(), testutil.IgnoreTime())
+
+	// Unchanged stacks aren't fetched again, their rate still is emitted
+	acc.ClearMetrics()
+	requests := len(server.Requests())
+	require.NoError(t, p.Gather(&acc))
+	require.Len(t, server.Requests(), requests+2)
+	require.Len(t, acc.GetTelegrafMetrics(), 2)
+}
+
+func TestGatherFailedStacks(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	// A preview after the failed update doesn't count as the last update
+	server.Handle("updates", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"updates":[
+			{"kind": "preview", "startTime": 1700000100, "endTime": 1700000110, "result": "succeeded", "version": 43},
+			{"kind": "update", "startTime": 1700000000, "endTime": 1700000090, "result": "failed", "version": 42},
+			{"kind": "update", "startTime": 1699990000, "endTime": 1699990030, "result": "succeeded", "version": 41}
+		]}`))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.StackUpdates = true
+		p.SuccessRateWindow = config.Duration(100000 * time.Hour)
+		p.FailedStacks = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	var failed []telegraf.Metric
+	for _, m := range acc.GetTelegrafMetrics() {
+		if m.Name() == "pulumi_failed_stacks" {
+			failed = append(failed, m)
+		}
+	}
+
+	expected := []telegraf.Metric{
+		testutil.MustMetric(
+			"pulumi_failed_stacks",
+			map[string]string{"organization": "acme", "project": "website"},
+			map[string]interface{}{"stacks": 2, "failed_stacks": 1},
+			time.Unix(0, 0),
+			telegraf.Gauge,
+		),
+		testutil.MustMetric(
+			"pulumi_failed_stacks",
+			map[string]string{"organization": "acme"},
+			map[string]interface{}{"stacks": 2, "failed_stacks": 1},
+			time.Unix(0, 0),
+			telegraf.Gauge,
+		),
+	}
+
+	testutil.RequireMetricsEqual(t, expected, failed, testutil.IgnoreTime())
+}
+
+func TestGatherProjectRollups(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.ProjectRollups = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	m, ok := acc.Get("pulumi_project")
+	require.True(t, ok)
+	require.Equal(t, map[string]string{"organization": "acme", "project": "website"}, m.Tags)
+	require.Equal(t, map[string]interface{}{"stacks": 2, "resources": 12}, m.Fields)
+
+	// With the updates of the window
+	p = newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.ProjectRollups = true
+		p.StackUpdates = true
+		p.SuccessRateWindow = config.Duration(100000 * time.Hour)
+	})
+
+	acc.ClearMetrics()
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	m, ok = acc.Get("pulumi_project")
+	require.True(t, ok)
+	require.Equal(t, map[string]interface{}{
+		"stacks":             2,
+		"resources":          12,
+		"updates":            2,
+		"successful_updates": 1,
+		"failed_updates":     1,
+		"failed_stacks":      0,
+	}, m.Fields)
+}
+
+func TestGatherStackUpdatesAfterRestart(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	options := func(p *PulumiApiConfig) {
+		p.StackUpdates = true
+		p.SuccessRateWindow = config.Duration(100000 * time.Hour)
+	}
+
+	p := newTestPlugin(t, server, options)
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	rollup, ok := acc.Get("pulumi_stack_updates")
+	require.True(t, ok)
+	updates := rollup.Fields["updates"]
+	require.NotZero(t, updates)
+
+	state := p.GetState()
+	p = newTestPlugin(t, server, options)
+	require.NoError(t, p.SetState(state))
+
+	requests := len(server.Requests())
+	acc.ClearMetrics()
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	// Nothing changed, so no update is fetched or emitted again, and the
+	// rate carries on
+	for _, request := range server.Requests()[requests:] {
+		require.NotContains(t, request, "/updates")
+	}
+	require.False(t, acc.HasMeasurement("pulumi_stack_update"))
+
+	rollup, ok = acc.Get("pulumi_stack_updates")
+	require.True(t, ok)
+	require.Equal(t, updates, rollup.Fields["updates"])
+}
+
+func TestGatherSharded(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	options := func(p *PulumiApiConfig) {
+		p.StackUpdates = true
+		p.SuccessRateWindow = config.Duration(100000 * time.Hour)
+		p.Usage = true
+	}
+
+	var unsharded testutil.Accumulator
+	require.NoError(t, newTestPlugin(t, server, options).Gather(&unsharded))
+	require.Empty(t, unsharded.Errors)
+
+	count := func(metrics []telegraf.Metric, name string) int {
+		n := 0
+		for _, m := range metrics {
+			if m.Name() == name {
+				n++
+			}
+		}
+		return n
+	}
+
+	var metrics []telegraf.Metric
+	owners := 0
+	for shard := 0; shard < 2; shard++ {
+		p := newTestPlugin(t, server, options, func(p *PulumiApiConfig) {
+			p.ShardIndex = shard
+			p.ShardCount = 2
+		})
+
+		var acc testutil.Accumulator
+		require.NoError(t, p.Gather(&acc))
+		require.Empty(t, acc.Errors)
+
+		if acc.HasMeasurement("pulumi_api") {
+			owners++
+			require.True(t, acc.HasMeasurement("pulumi_usage"))
+		} else {
+			require.False(t, acc.HasMeasurement("pulumi_usage"))
+		}
+
+		metrics = append(metrics, acc.GetTelegrafMetrics()...)
+	}
+
+	// Every organization and stack is collected by exactly one shard
+	require.Equal(t, 1, owners)
+	for _, name := range []string{"pulumi_api", "pulumi_usage", "pulumi_stack_update", "pulumi_stack_updates"} {
+		require.Equal(t, count(unsharded.GetTelegrafMetrics(), name), count(metrics, name), name)
+	}
+}
+
+func TestGatherFailureReasons(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.StackUpdates = true
+		p.SuccessRateWindow = config.Duration(100000 * time.Hour)
+		p.FailureReasons = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	failed := 0
+	for _, m := range acc.GetTelegrafMetrics() {
+		if m.Name() != "pulumi_stack_update" {
+			continue
+		}
+
+		if m.Tags()["result"] != "failed" {
+			require.NotContains(t, m.Tags(), "failure_reason")
+			continue
+		}
+
+		failed++
+		require.Equal(t, "provider_error", m.Tags()["failure_reason"])
+		require.Equal(t, "creating S3 Bucket (site): BucketAlreadyExists", m.Fields()["failure_message"])
+	}
+	require.NotZero(t, failed)
+}
+
+func TestClassifyFailure(t *testing.T) {
+	diagnostic := func(urn string, message string) EngineEvent {
+		return EngineEvent{DiagnosticEvent: &DiagnosticEvent{URN: urn, Message: message, Severity: "error"}}
+	}
+
+	tests := []struct {
+		name    string
+		events  []EngineEvent
+		reason  string
+		message string
+	}{
+		{"no events", nil, "unknown", ""},
+		{"general error", []EngineEvent{diagnostic("", "update failed")}, "unknown", "update failed"},
+		{"provider error", []EngineEvent{diagnostic("urn:pulumi:dev::app::aws:s3/bucket:Bucket::logs", "access denied"), diagnostic("", "update failed")}, "provider_error", "access denied"},
+		{"timeout", []EngineEvent{diagnostic("urn:pulumi:dev::app::aws:rds/instance:Instance::db", "waiting for RDS Instance: timeout while waiting for state")}, "timeout", "waiting for RDS Instance: timeout while waiting for state"},
+		{"policy violation", []EngineEvent{
+			{PolicyEvent: &PolicyEvent{PolicyPackName: "security", PolicyName: "s3-no-public-read", Message: "public buckets aren't allowed", EnforcementLevel: "advisory"}},
+			{PolicyEvent: &PolicyEvent{PolicyPackName: "security", PolicyName: "s3-encryption", Message: "buckets must be encrypted", EnforcementLevel: "mandatory"}},
+			diagnostic("", "preview failed"),
+		}, "policy_violation", "security/s3-encryption: buckets must be encrypted"},
+		{"cancelled", []EngineEvent{diagnostic("", "update canceled"), {CancelEvent: &struct{}{}}}, "cancelled", "update canceled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, message := classifyFailure(tt.events)
+			require.Equal(t, tt.reason, reason)
+			require.Equal(t, tt.message, message)
+		})
+	}
+}
+
+func TestGatherStackListCacheTTL(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.StackTTL = true
+		p.StackListCacheTTL = config.Duration(time.Hour)
+	})
+
+	listings := func() int {
+		count := 0
+		for _, request := range server.Requests() {
+			if strings.HasPrefix(request, "/api/user/stacks") {
+				count++
+			}
+		}
+		return count
+	}
+
+	for i := 0; i < 3; i++ {
+		var acc testutil.Accumulator
+		require.NoError(t, p.Gather(&acc))
+		require.Empty(t, acc.Errors)
+
+		_, ok := acc.Get("pulumi_stack_ttl")
+		require.True(t, ok)
+	}
+	require.Equal(t, 1, listings())
+
+	// Stale
+	p.organizations[0].stacksListedAt = time.Now().Add(-2 * time.Hour)
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Equal(t, 2, listings())
+}
+
+func TestGatherDeployEvents(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.StackUpdates = true
+		p.SuccessRateWindow = config.Duration(100000 * time.Hour)
+		p.DeployEvents = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	var updates, events []telegraf.Metric
+	for _, m := range acc.GetTelegrafMetrics() {
+		switch m.Name() {
+		case "pulumi_stack_update":
+			if m.Tags()["kind"] != "preview" {
+				updates = append(updates, m)
+			}
+		case "pulumi_deploy_events":
+			events = append(events, m)
+		}
+	}
+
+	require.NotEmpty(t, events)
+	require.Len(t, events, len(updates))
+	for i, event := range events {
+		require.Equal(t, updates[i].Tags(), event.Tags())
+		require.Equal(t, updates[i].Time(), event.Time())
+		require.Contains(t, event.Fields()["text"], "of acme/website/")
+	}
+}
+
+func TestGatherSourceTags(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.StackUpdates = true
+		p.SuccessRateWindow = config.Duration(100000 * time.Hour)
+		p.SourceTags = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	require.NotEmpty(t, acc.GetTelegrafMetrics())
+	for _, m := range acc.GetTelegrafMetrics() {
+		switch m.Tags()["stack"] {
+		case "production":
+			require.Equal(t, "github.com/acme/website", m.Tags()["repository"], m.Name())
+			require.Equal(t, "main", m.Tags()["branch"], m.Name())
+		default:
+			require.NotContains(t, m.Tags(), "repository", m.Name())
+			require.NotContains(t, m.Tags(), "branch", m.Name())
+		}
+	}
+}
+
+func TestGatherUsage(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.Usage = true
+		p.UsagePerStack = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	expected := []telegraf.Metric{
+		testutil.MustMetric(
+			"pulumi_usage",
+			map[string]string{"organization": "acme"},
+			map[string]interface{}{
+				"update_minutes":             1234.5,
+				"deployment_minutes":         321.25,
+				"resources_under_management": int64(4200),
+				"seats_used":                 int64(18),
+				"seats_total":                int64(25),
+				"period_start":               int64(1698796800),
+				"period_end":                 int64(1701388800),
+			},
+			time.Unix(0, 0),
+			telegraf.Gauge,
+		),
+		testutil.MustMetric(
+			"pulumi_usage",
+			map[string]string{"organization": "acme", "project": "website", "stack": "production"},
+			map[string]interface{}{"deployment_minutes": 300.0},
+			time.Unix(0, 0),
+			telegraf.Gauge,
+		),
+		testutil.MustMetric(
+			"pulumi_usage",
+			map[string]string{"organization": "acme", "project": "website", "stack": "staging"},
+			map[string]interface{}{"deployment_minutes": 21.25},
+			time.Unix(0, 0),
+			telegraf.Gauge,
+		),
+	}
+
+	testutil.RequireMetricsEqual(t, expected, acc.GetTelegrafMetrics(), testutil.IgnoreTime())
+}
+
+func TestGatherStackTTLs(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.StackTTL = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	metrics := acc.GetTelegrafMetrics()
+	require.Len(t, metrics, 2)
+
+	// The fixture's TTL has long passed
+	require.Equal(t, map[string]string{"organization": "acme", "project": "website", "stack": "staging"}, metrics[0].Tags())
+	require.Equal(t, int64(1700002800), metrics[0].Fields()["destroy_at"])
+	require.Less(t, metrics[0].Fields()["seconds_until_destroy"], 0.0)
+
+	require.Equal(t, map[string]string{"organization": "acme"}, metrics[1].Tags())
+	require.Equal(t, map[string]interface{}{"scheduled_stacks": int64(1), "overdue_stacks": int64(1)}, metrics[1].Fields())
+}
+
+func TestGatherDeploymentSettings(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.DeploymentSettings = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	expected := []telegraf.Metric{
+		testutil.MustMetric(
+			"pulumi_deployment_settings",
+			map[string]string{"organization": "acme", "project": "website", "stack": "production"},
+			map[string]interface{}{"oidc": true, "static_credentials": true},
+			time.Unix(0, 0),
+			telegraf.Gauge,
+		),
+		testutil.MustMetric(
+			"pulumi_deployment_settings",
+			map[string]string{"organization": "acme"},
+			map[string]interface{}{"stacks": 2, "configured_stacks": 1, "oidc_stacks": 1, "static_credential_stacks": 1},
+			time.Unix(0, 0),
+			telegraf.Gauge,
+		),
+	}
+
+	testutil.RequireMetricsEqual(t, expected, acc.GetTelegrafMetrics(), testutil.IgnoreTime())
+}
+
+func TestGatherNotModified(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	var conditions []string
+	var mu sync.Mutex
+	server.Handle("deployments/settings", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/production/deployments/settings") {
+			fakepulumi.Error(w, http.StatusNotFound, "Not found")
+			return
+		}
+
+		mu.Lock()
+		conditions = append(conditions, r.Header.Get("If-None-Match"))
+		mu.Unlock()
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		fakepulumi.Fixture(w, "deployment_settings.json")
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.DeploymentSettings = true
+	})
+
+	var first testutil.Accumulator
+	require.NoError(t, p.Gather(&first))
+	require.Empty(t, first.Errors)
+
+	// The second gather revalidates, and decodes the cached body again
+	var second testutil.Accumulator
+	require.NoError(t, p.Gather(&second))
+	require.Empty(t, second.Errors)
+
+	require.Equal(t, []string{"", `"v1"`}, conditions)
+	require.NotEmpty(t, second.GetTelegrafMetrics())
+	testutil.RequireMetricsEqual(t, first.GetTelegrafMetrics(), second.GetTelegrafMetrics(), testutil.IgnoreTime())
+}
+
+func TestGatherSecretsProviders(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.SecretsProviders = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	expected := []telegraf.Metric{
+		testutil.MustMetric(
+			"pulumi_secrets_provider",
+			map[string]string{"organization": "acme", "project": "website", "stack": "production", "provider": "awskms"},
+			map[string]interface{}{"kms": true},
+			time.Unix(0, 0),
+			telegraf.Gauge,
+		),
+		testutil.MustMetric(
+			"pulumi_secrets_provider",
+			map[string]string{"organization": "acme", "project": "website", "stack": "staging", "provider": "passphrase"},
+			map[string]interface{}{"kms": false},
+			time.Unix(0, 0),
+			telegraf.Gauge,
+		),
+		testutil.MustMetric(
+			"pulumi_secrets_provider",
+			map[string]string{"organization": "acme", "provider": "awskms"},
+			map[string]interface{}{"stacks": 1, "kms": true},
+			time.Unix(0, 0),
+			telegraf.Gauge,
+		),
+		testutil.MustMetric(
+			"pulumi_secrets_provider",
+			map[string]string{"organization": "acme", "provider": "passphrase"},
+			map[string]interface{}{"stacks": 1, "kms": false},
+			time.Unix(0, 0),
+			telegraf.Gauge,
+		),
+	}
+
+	testutil.RequireMetricsEqual(t, expected, acc.GetTelegrafMetrics(), testutil.IgnoreTime())
+
+	// Until a stack is updated its export isn't fetched again
+	acc.ClearMetrics()
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	testutil.RequireMetricsEqual(t, expected, acc.GetTelegrafMetrics(), testutil.IgnoreTime())
+
+	exports := 0
+	for _, request := range server.Requests() {
+		if strings.HasSuffix(request, "/export") {
+			exports++
+		}
+	}
+	require.Equal(t, 2, exports)
+}
+
+func TestExportSecretsProvider(t *testing.T) {
+	tests := []struct {
+		name   string
+		export string
+		kind   string
+	}{
+		{"service", `{"version":3,"deployment":{"secrets_providers":{"type":"service","state":{"owner":"acme"}}}}`, "service"},
+		{"after the resources", `{"version":3,"deployment":{"resources":[{"urn":"a"},{"urn":"b"}],"secrets_providers":{"type":"cloud","state":{"url":"gcpkms://projects/p/locations/global/keyRings/r/cryptoKeys/k"}}}}`, "gcpkms"},
+		{"never deployed", `{"version":3,"deployment":null}`, "unknown"},
+		{"no provider", `{"version":3,"deployment":{"manifest":{}}}`, "unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := exportSecretsProvider(strings.NewReader(tt.export))
+			require.NoError(t, err)
+
+			var provider SecretsProvider
+			if raw != nil {
+				require.NoError(t, json.Unmarshal(raw, &provider))
+			}
+			require.Equal(t, tt.kind, provider.kind())
+		})
+	}
+}
+
+func TestGatherPendingDeployments(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.PendingDeployments = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	metrics := acc.GetTelegrafMetrics()
+	require.Len(t, metrics, 2)
+
+	// The running deployment was created before the queued one
+	require.Equal(t, map[string]string{"organization": "acme", "project": "website", "stack": "production"}, metrics[0].Tags())
+	require.Equal(t, int64(1), metrics[0].Fields()["queued"])
+	require.Equal(t, int64(1), metrics[0].Fields()["running"])
+	require.InDelta(t, time.Since(time.Unix(1700000400, 0)).Seconds(), metrics[0].Fields()["oldest_pending_seconds"], 60)
+
+	require.Equal(t, map[string]string{"organization": "acme", "project": "website", "stack": "staging"}, metrics[1].Tags())
+	require.Equal(t, map[string]interface{}{"queued": int64(0), "running": int64(0)}, metrics[1].Fields())
+}
+
+func TestGatherDeploymentLogs(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.DeploymentLogs = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	// Inline step errors are repeated under the diagnostics, only those count
+	expected := []telegraf.Metric{
+		testutil.MustMetric(
+			"pulumi_deployment_errors",
+			map[string]string{"organization": "acme", "project": "website", "stack": "production"},
+			map[string]interface{}{
+				"deployment_id": "d-1235",
+				"version":       int64(2),
+				"error_lines":   2,
+				"first_error":   "creating S3 Bucket (site): BucketAlreadyExists",
+			},
+			time.Unix(1699999380, 0),
+		),
+	}
+
+	testutil.RequireMetricsEqual(t, expected, acc.GetTelegrafMetrics())
+
+	// The failure has been scanned already
+	acc.ClearMetrics()
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Empty(t, acc.GetTelegrafMetrics())
+}
+
+func TestGatherESCEvaluation(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	var methods []string
+	server.Handle("esc/environments/open", func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+
+		if strings.HasSuffix(r.URL.Path, "/broken/open") {
+			fakepulumi.Fixture(w, "esc_open_diagnostics.json")
+		} else {
+			fakepulumi.Fixture(w, "esc_open.json")
+		}
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.ESCEvaluation = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Equal(t, []string{http.MethodPost, http.MethodPost}, methods)
+
+	metrics := acc.GetTelegrafMetrics()
+	require.Len(t, metrics, 2)
+
+	require.Equal(t, map[string]string{"organization": "acme", "project": "website", "environment": "production"}, metrics[0].Tags())
+	require.Equal(t, true, metrics[0].Fields()["success"])
+	require.Equal(t, int64(0), metrics[0].Fields()["diagnostics"])
+	require.Contains(t, metrics[0].Fields(), "duration")
+
+	require.Equal(t, map[string]string{"organization": "acme", "project": "website", "environment": "broken"}, metrics[1].Tags())
+	require.Equal(t, false, metrics[1].Fields()["success"])
+	require.Equal(t, int64(2), metrics[1].Fields()["diagnostics"])
+	require.Equal(t, `unknown property "aws.login.foo"`, metrics[1].Fields()["error"])
+}
+
+func TestGatherESCEvaluationNotRetried(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	opens := 0
+	server.Handle("esc/environments/open", func(w http.ResponseWriter, r *http.Request) {
+		opens++
+		fakepulumi.Error(w, http.StatusInternalServerError, "Internal error")
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.ESCEvaluation = true
+	})
+
+	// Every open mints credentials, so a failed one isn't sent again
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Len(t, acc.Errors, 2)
+	require.Equal(t, 2, opens)
+	require.False(t, acc.HasMeasurement("pulumi_esc_evaluation"))
+}
+
+func TestGatherInsights(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.Insights = []InsightsConfig{
+			{Type: "aws:ec2/instance:Instance", Properties: []string{"instanceType", "tags.team"}},
+			{Type: "aws:rds/instance:Instance", Properties: []string{"engine", "engineVersion"}},
+		}
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	expected := []telegraf.Metric{
+		testutil.MustMetric(
+			"pulumi_resources",
+			map[string]string{"organization": "acme", "type": "aws:ec2/instance:Instance", "instanceType": "m5.large"},
+			map[string]interface{}{"count": 1},
+			time.Unix(0, 0),
+			telegraf.Gauge,
+		),
+		testutil.MustMetric(
+			"pulumi_resources",
+			map[string]string{"organization": "acme", "type": "aws:ec2/instance:Instance", "instanceType": "t3.micro", "tags.team": "platform"},
+			map[string]interface{}{"count": 2},
+			time.Unix(0, 0),
+			telegraf.Gauge,
+		),
+		testutil.MustMetric(
+			"pulumi_resources",
+			map[string]string{"organization": "acme", "type": "aws:rds/instance:Instance", "engine": "postgres", "engineVersion": "15.4"},
+			map[string]interface{}{"count": 1},
+			time.Unix(0, 0),
+			telegraf.Gauge,
+		),
+	}
+
+	testutil.RequireMetricsEqual(t, expected, acc.GetTelegrafMetrics(), testutil.IgnoreTime())
+
+	// Not searched again until insights_interval has passed
+	requests := len(server.Requests())
+	acc.ClearMetrics()
+	require.NoError(t, p.Gather(&acc))
+	require.False(t, acc.HasMeasurement("pulumi_resources"))
+	require.Len(t, server.Requests(), requests+1)
+}
+
+func TestGatherResourceAge(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.Insights = []InsightsConfig{{Type: "aws:ec2/instance:Instance"}}
+		p.ResourceAge = true
+		// Only web-1, created in 2021, is older
+		p.ResourceAgeThreshold = config.Duration(time.Since(time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)))
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	var ages []telegraf.Metric
+	for _, m := range acc.GetTelegrafMetrics() {
+		if m.Name() == "pulumi_resource_age" {
+			ages = append(ages, m)
+		}
+	}
+	require.Len(t, ages, 2)
+
+	production := ages[0]
+	require.Equal(t, "production", production.Tags()["stack"])
+	require.Equal(t, int64(2), production.Fields()["resources"])
+	require.Equal(t, time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC).Unix(), production.Fields()["oldest_created"])
+	require.Equal(t, int64(1), production.Fields()["older_than_threshold"])
+
+	staging := ages[1]
+	require.Equal(t, "staging", staging.Tags()["stack"])
+	require.Equal(t, int64(1), staging.Fields()["resources"])
+	require.Equal(t, int64(0), staging.Fields()["older_than_threshold"])
+}
+
+func TestGatherESCInventory(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.ESCInventory = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	metrics := acc.GetTelegrafMetrics()
+	require.Len(t, metrics, 2)
+
+	expected := map[string]string{
+		"organization": "acme",
+		"project":      "website",
+		"environment":  "production",
+		"tag_team":     "platform",
+		"tag_tier":     "critical",
+	}
+	require.Equal(t, expected, metrics[0].Tags())
+
+	// aws-login, aws-secrets and vault-secrets
+	require.Equal(t, map[string]interface{}{"imports": int64(2), "providers": int64(3), "tags": int64(2)}, metrics[0].Fields())
+}
+
+func TestGatherStopsOnRepeatedContinuationToken(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	server.Handle("user/stacks", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"stacks":[],"continuationToken":"again"}`))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.StackUpdates = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	stackRequests := 0
+	for _, request := range server.Requests() {
+		if strings.HasPrefix(request, "/api/user/stacks") {
+			stackRequests++
+		}
+	}
+	require.Equal(t, 2, stackRequests)
+}
+
+func TestContinuationToken(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		token ContinuationToken
+		err   bool
+	}{
+		{"string", `"page-2"`, "page-2", false},
+		{"empty string", `""`, "", false},
+		{"number", `2`, "2", false},
+		{"large number", `17000003001234567890`, "17000003001234567890", false},
+		{"zero", `0`, "", false},
+		{"null", `null`, "", false},
+		{"bool", `true`, "", true},
+		{"object", `{"page":2}`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var response AuditLogsResponse
+			err := json.Unmarshal([]byte(`{"continuationToken":`+tt.data+`,"auditLogEvents":[]}`), &response)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.token, response.ContinuationToken)
+		})
+	}
+}
+
+func TestGatherNumericContinuationToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string
+		requests []string
+	}{
+		{"string", `"2"`, []string{
+			"/api/orgs/acme/auditlogs?startTime=1700000000",
+			"/api/orgs/acme/auditlogs?startTime=1700000000&continuationToken=2",
+		}},
+		{"number", `2`, []string{
+			"/api/orgs/acme/auditlogs?startTime=1700000000",
+			"/api/orgs/acme/auditlogs?startTime=1700000000&continuationToken=2",
+		}},
+		{"zero", `0`, []string{
+			"/api/orgs/acme/auditlogs?startTime=1700000000",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakepulumi.NewServer()
+			defer server.Close()
+
+			server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("continuationToken") == "2" {
+					w.Write([]byte(`{"auditLogEvents":[{"timestamp":1700000100,"event":"stack-created","user":{"githubLogin":"jane"}}]}`))
+					return
+				}
+				fmt.Fprintf(w, `{"continuationToken":%s,"auditLogEvents":[{"timestamp":1700000200,"event":"stack-updated","user":{"githubLogin":"jane"}}]}`, tt.token)
+			})
+
+			p := newTestPlugin(t, server)
+
+			var acc testutil.Accumulator
+			require.NoError(t, p.Gather(&acc))
+			require.Empty(t, acc.Errors)
+
+			require.Equal(t, tt.requests, server.Requests())
+			require.Len(t, acc.GetTelegrafMetrics(), len(tt.requests))
+		})
+	}
+}
+
+func TestGatherAuditLogsAnonymized(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.Anonymize = true
+		p.AnonymizeSalt = "pepper"
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Len(t, acc.GetTelegrafMetrics(), 3)
+
+	login := p.pseudonym("jane")
+	require.Len(t, login, 16)
+
+	for _, m := range acc.GetTelegrafMetrics() {
+		payload := m.Fields()["payload"].(string)
+		require.NotContains(t, payload, `"jane"`)
+		require.NotContains(t, payload, "203.0.113.10")
+		require.NotContains(t, payload, "example.com")
+		require.NotContains(t, m.Tags()["source_ip"], ".")
+	}
+
+	// The same user keeps the same pseudonym
+	require.Equal(t, login, acc.GetTelegrafMetrics()[0].Tags()["github_login"])
+	require.Equal(t, login, acc.GetTelegrafMetrics()[2].Tags()["github_login"])
+}
+
+func TestGatherAuditLogsAnonymizedDescription(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[{"timestamp":1700000300,"sourceIP":"203.0.113.10","event":"token-created","description":"Jane created access token \"jane-laptop\" for JANE from 203.0.113.10, not janet","tokenName":"jane-laptop","user":{"name":"Jane Doe","githubLogin":"jane"}}]}`))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.Anonymize = true
+		p.AnonymizeSalt = "pepper"
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Len(t, acc.GetTelegrafMetrics(), 1)
+
+	m := acc.GetTelegrafMetrics()[0]
+	require.Equal(t, p.pseudonym("jane-laptop"), m.Tags()["token_name"])
+
+	var payload AuditLogEvent
+	require.NoError(t, json.Unmarshal([]byte(m.Fields()["payload"].(string)), &payload))
+	require.Equal(t, p.pseudonym("jane-laptop"), payload.TokenName)
+
+	// Only whole words are replaced, so janet is someone else
+	login, token, ip := p.pseudonym("jane"), p.pseudonym("jane-laptop"), p.pseudonym("203.0.113.10")
+	require.Equal(t, fmt.Sprintf("%s created access token %q for %s from %s, not janet", login, token, login, ip), payload.Description)
+}
+
+func TestGatherAuditLogsStackFilter(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.AuditLogStacks = []string{"website/production", "api/prod"}
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	require.Equal(t, "/api/orgs/acme/auditlogs?startTime=1700000000&stackFilter=website%2Fproduction&stackFilter=api%2Fprod", server.Requests()[0])
+}
+
+func TestGatherAuditLogsAlignedWindows(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.WindowAlignment = config.Duration(time.Hour)
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	testutil.RequireMetricsEqual(t, expectedAuditLogs, acc.GetTelegrafMetrics(), testutil.SortMetrics())
+
+	windowEnd := time.Now().Truncate(time.Hour)
+	require.Equal(t, []string{
+		fmt.Sprintf("/api/orgs/acme/auditlogs?startTime=1700000000&endTime=%d", windowEnd.Unix()),
+		fmt.Sprintf("/api/orgs/acme/auditlogs?startTime=1700000000&endTime=%d&continuationToken=page-2", windowEnd.Unix()),
+	}, server.Requests())
+
+	// The cursor moves to the end of the window, not the newest event
+	require.Equal(t, windowEnd, p.organizations[0].lastFetch)
+
+	// The next window isn't complete yet
+	require.NoError(t, p.Gather(&acc))
+	require.Len(t, server.Requests(), 2)
+}
+
+func TestGatherDeprecationHeaders(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	sunset := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "@1700000000")
+		w.Header().Set("Sunset", sunset.Format(http.TimeFormat))
+		w.Header().Set("Warning", `299 - "Use the v2 audit log export"`)
+
+		if r.URL.Query().Get("continuationToken") == "page-2" {
+			fakepulumi.Fixture(w, "auditlogs_page2.json")
+		} else {
+			fakepulumi.Fixture(w, "auditlogs_page1.json")
+		}
+	})
+
+	p := newTestPlugin(t, server)
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	metric, ok := acc.Get("pulumi_api_deprecation")
+	require.True(t, ok)
+	require.Equal(t, map[string]string{"endpoint": "auditlogs"}, metric.Tags)
+	require.Equal(t, true, metric.Fields["deprecated"])
+	require.Equal(t, int64(1700000000), metric.Fields["deprecated_at"])
+	require.Equal(t, sunset.Unix(), metric.Fields["sunset"])
+	require.Equal(t, "Use the v2 audit log export", metric.Fields["message"])
+
+	// Gone again once the endpoint stops saying so
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		fakepulumi.Fixture(w, "auditlogs_page2.json")
+	})
+
+	acc.ClearMetrics()
+	require.NoError(t, p.Gather(&acc))
+	require.False(t, acc.HasMeasurement("pulumi_api_deprecation"))
+}
+
+func TestGatherClockSkew(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	// An API clock five minutes behind the local one
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(-5*time.Minute).UTC().Format(http.TimeFormat))
+
+		if r.URL.Query().Get("continuationToken") == "page-2" {
+			fakepulumi.Fixture(w, "auditlogs_page2.json")
+		} else {
+			fakepulumi.Fixture(w, "auditlogs_page1.json")
+		}
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.ClockSkewMetric = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	metric, ok := acc.Get("pulumi_api_clock_skew")
+	require.True(t, ok)
+	require.InDelta(t, 300, metric.Fields["skew_seconds"], 2)
+	require.Equal(t, true, metric.Fields["exceeded"])
+
+	// Back within max_clock_skew once the API's clock is
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		fakepulumi.Fixture(w, "auditlogs_page2.json")
+	})
+
+	acc.ClearMetrics()
+	require.NoError(t, p.Gather(&acc))
+
+	metric, ok = acc.Get("pulumi_api_clock_skew")
+	require.True(t, ok)
+	require.InDelta(t, 0, metric.Fields["skew_seconds"], 2)
+	require.Equal(t, false, metric.Fields["exceeded"])
+}
+
+func TestGatherLagMetric(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.LagMetric = true
+	})
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		fakepulumi.Error(w, http.StatusInternalServerError, "Internal error")
+	})
+	p.MaxRetries = 0
+
+	// Not before the first successful fetch
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.False(t, acc.HasMeasurement("pulumi_api_lag"))
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("continuationToken") == "page-2" {
+			fakepulumi.Fixture(w, "auditlogs_page2.json")
+		} else {
+			fakepulumi.Fixture(w, "auditlogs_page1.json")
+		}
+	})
+
+	acc.ClearMetrics()
+	require.NoError(t, p.Gather(&acc))
+
+	m, ok := acc.Get("pulumi_api_lag")
+	require.True(t, ok)
+	require.Equal(t, int64(1700000300), m.Fields["newest_event"])
+	require.InDelta(t, time.Since(time.Unix(1700000300, 0)).Seconds(), m.Fields["lag_seconds"], 60)
+	require.Less(t, m.Fields["since_success_seconds"], 60.0)
+}
+
+func TestGatherTokenOwnerTag(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.TokenOwnerTag = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	require.Len(t, acc.GetTelegrafMetrics(), 3)
+	for _, m := range acc.GetTelegrafMetrics() {
+		require.Equal(t, "jane", m.Tags()["token_owner"])
+	}
+}
+
+func TestGatherOrganizationMetadata(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.OrganizationMetadata = true
+	})
+
+	for i := 0; i < 2; i++ {
+		var acc testutil.Accumulator
+		require.NoError(t, p.Gather(&acc))
+		require.Empty(t, acc.Errors)
+
+		require.NotEmpty(t, acc.GetTelegrafMetrics())
+		for _, m := range acc.GetTelegrafMetrics() {
+			require.Equal(t, "Acme Corp", m.Tags()["organization_name"])
+			require.Equal(t, "enterprise", m.Tags()["plan"])
+		}
+	}
+
+	fetched := 0
+	for _, request := range server.Requests() {
+		if request == "/api/orgs/acme" {
+			fetched++
+		}
+	}
+	require.Equal(t, 1, fetched)
+}
+
+func TestGatherAuditLogsTeamTag(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.TeamTag = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	require.Len(t, acc.GetTelegrafMetrics(), 3)
+	for _, m := range acc.GetTelegrafMetrics() {
+		switch m.Tags()["github_login"] {
+		case "jane":
+			require.Equal(t, "platform", m.Tags()["team"])
+		case "admin":
+			require.Equal(t, "platform,security", m.Tags()["team"])
+		}
+	}
+
+	// The teams are cached for the events of the next gather
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	fetched := 0
+	for _, request := range server.Requests() {
+		if request == "/api/orgs/acme/teams" {
+			fetched++
+		}
+	}
+	require.Equal(t, 1, fetched)
+}
+
+// fakeResolver knows the names of a few addresses, and hangs on slowIP
+// until the lookup is cancelled
+type fakeResolver struct {
+	names map[string][]string
+
+	mu      sync.Mutex
+	lookups map[string]int
+}
+
+const slowIP = "192.0.2.1"
+
+func newFakeResolver() *fakeResolver {
+	return &fakeResolver{
+		names:   map[string][]string{"203.0.113.10": {"runner-1.ci.example.com."}},
+		lookups: make(map[string]int),
+	}
+}
+
+func (r *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	r.mu.Lock()
+	r.lookups[addr]++
+	r.mu.Unlock()
+
+	if addr == slowIP {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	names, ok := r.names[addr]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+
+	return names, nil
+}
+
+func (r *fakeResolver) lookupCount(addr string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.lookups[addr]
+}
+
+func TestReverseDNSLookup(t *testing.T) {
+	tests := []struct {
+		name     string
+		ip       string
+		hostname string
+	}{
+		{"hit", "203.0.113.10", "runner-1.ci.example.com"},
+		{"miss", "198.51.100.7", ""},
+		{"timeout", slowIP, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := newFakeResolver()
+			r := newReverseDNS(resolver, 10*time.Millisecond, time.Hour)
+
+			require.Equal(t, tt.hostname, r.lookup(context.Background(), tt.ip))
+
+			// Answers, failures included, are cached
+			require.Equal(t, tt.hostname, r.lookup(context.Background(), tt.ip))
+			require.Equal(t, 1, resolver.lookupCount(tt.ip))
+		})
+	}
+}
+
+func TestReverseDNSCacheExpires(t *testing.T) {
+	resolver := newFakeResolver()
+	r := newReverseDNS(resolver, 10*time.Millisecond, time.Millisecond)
+
+	require.Equal(t, "runner-1.ci.example.com", r.lookup(context.Background(), "203.0.113.10"))
+	time.Sleep(2 * time.Millisecond)
+	require.Equal(t, "runner-1.ci.example.com", r.lookup(context.Background(), "203.0.113.10"))
+	require.Equal(t, 2, resolver.lookupCount("203.0.113.10"))
+}
+
+func TestGatherAuditLogsReverseDNS(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	resolver := newFakeResolver()
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.ReverseDNS = true
+	})
+	p.reverseDNS.resolver = resolver
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	require.Len(t, acc.GetTelegrafMetrics(), 3)
+	for _, m := range acc.GetTelegrafMetrics() {
+		hostname, ok := m.GetField("source_hostname")
+		switch m.Tags()["source_ip"] {
+		case "203.0.113.10":
+			require.Equal(t, "runner-1.ci.example.com", hostname)
+		default:
+			require.False(t, ok)
+		}
+	}
+
+	// Two of the events share a source IP, which is looked up once
+	require.Equal(t, 1, resolver.lookupCount("203.0.113.10"))
+	require.Equal(t, 1, resolver.lookupCount("198.51.100.7"))
+}
+
+func TestGatherAuditLogsGeoIP(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	// The fixture only knows 203.0.113.0/24, as Wellington, NZ
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.GeoIPDatabase = filepath.Join("testdata", "geoip.mmdb")
+	})
+	defer p.Stop()
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	require.Len(t, acc.GetTelegrafMetrics(), 3)
+	for _, m := range acc.GetTelegrafMetrics() {
+		switch m.Tags()["source_ip"] {
+		case "203.0.113.10":
+			require.Equal(t, "NZ", m.Tags()["country"])
+			require.Equal(t, "Wellington", m.Tags()["city"])
+		default:
+			require.NotContains(t, m.Tags(), "country")
+			require.NotContains(t, m.Tags(), "city")
+		}
+	}
+}
+
+func TestInitMissingGeoIPDatabase(t *testing.T) {
+	p := inputs.Inputs["pulumi_api"]().(*PulumiApiConfig)
+	p.Organization = "acme"
+	p.Token = fakepulumi.Token
+	p.ValidateCredentials = false
+	p.Log = testutil.Logger{}
+	p.GeoIPDatabase = filepath.Join(t.TempDir(), "GeoLite2-City.mmdb")
+
+	err := p.Init()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "geoip_database")
+}
+
+func TestGatherMemberActivity(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.MemberActivity = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	lastSeen := make(map[string]interface{})
+	for _, m := range acc.GetTelegrafMetrics() {
+		if m.Name() != "pulumi_member" {
+			continue
+		}
+
+		require.Equal(t, m.Tags()["github_login"] != "john", m.Fields()["seen"])
+		lastSeen[m.Tags()["github_login"]] = m.Fields()["last_seen"]
+	}
+	require.Equal(t, map[string]interface{}{
+		"jane":  int64(1700000300),
+		"admin": int64(1700000200),
+		"john":  nil,
+	}, lastSeen)
+
+	// What's been seen survives a restart
+	state := p.GetState()
+	p = newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.MemberActivity = true
+	})
+	p.SetState(state)
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	acc.ClearMetrics()
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	m, ok := acc.Get("pulumi_member")
+	require.True(t, ok)
+	require.Equal(t, "jane", m.Tags["github_login"])
+	require.Equal(t, int64(1700000300), m.Fields["last_seen"])
+}
+
+func TestGatherMemberActivityTeamTag(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.MemberActivity = true
+		p.TeamTag = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	teams := make(map[string]string)
+	for _, m := range acc.GetTelegrafMetrics() {
+		if m.Name() == "pulumi_member" {
+			teams[m.Tags()["github_login"]] = m.Tags()["team"]
+		}
+	}
+	require.Equal(t, map[string]string{
+		"jane":  "platform",
+		"admin": "platform,security",
+		"john":  "",
+	}, teams)
+
+	// The members share the teams fetched for the audit events
+	fetched := 0
+	for _, request := range server.Requests() {
+		if request == "/api/orgs/acme/teams" {
+			fetched++
+		}
+	}
+	require.Equal(t, 1, fetched)
+}
+
+func TestGatherAuditLogsUserAttributes(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.UserAttributes = map[string]string{
+			"name":      "field",
+			"avatarUrl": "field",
+		}
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Len(t, acc.GetTelegrafMetrics(), 3)
+
+	m := acc.GetTelegrafMetrics()[0]
+	require.NotContains(t, m.Tags(), "user")
+	require.Equal(t, "jane", m.Tags()["github_login"])
+	require.Equal(t, "Jane Doe", m.Fields()["user"])
+	require.Equal(t, "https://example.com/jane.png", m.Fields()["avatar_url"])
+}
+
+func TestInitInvalidUserAttributes(t *testing.T) {
+	p := inputs.Inputs["pulumi_api"]().(*PulumiApiConfig)
+	p.Organization = "acme"
+	p.Log = testutil.Logger{}
+	p.UserAttributes = map[string]string{"avatarUrl": "label"}
+
+	require.Error(t, p.Init())
+}
+
+func TestInitValidatesConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(p *PulumiApiConfig)
+		err    string
+	}{
+		{"no organization", func(p *PulumiApiConfig) { p.Organization = "" }, "organization is required"},
+		{"no token", func(p *PulumiApiConfig) { p.Token = "" }, "token is required"},
+		{"shard index", func(p *PulumiApiConfig) {
+			p.ShardIndex = 2
+			p.ShardCount = 2
+		}, "invalid shard_index 2"},
+		{"token and OIDC", func(p *PulumiApiConfig) { p.OIDCTokenFile = "/var/run/secrets/token" }, "token and oidc_token_file can't both be set"},
+		{"OIDC token type", func(p *PulumiApiConfig) {
+			p.Token = ""
+			p.OIDCTokenFile = "/var/run/secrets/token"
+			p.OIDCRequestedTokenType = "admin"
+		}, "invalid oidc_requested_token_type"},
+		{"url without scheme", func(p *PulumiApiConfig) { p.Url = "api.pulumi.com" }, `invalid url "api.pulumi.com"`},
+		{"negative overlap", func(p *PulumiApiConfig) { p.Overlap = config.Duration(-time.Minute) }, "invalid overlap -1m0s"},
+		{"negative max_pages", func(p *PulumiApiConfig) { p.MaxPages = -1 }, "invalid max_pages -1"},
+		{"insights without a type", func(p *PulumiApiConfig) {
+			p.Insights = []InsightsConfig{{Properties: []string{"instanceType"}}}
+		}, "insights needs a type"},
+		{"insights property replacing a tag", func(p *PulumiApiConfig) {
+			p.Insights = []InsightsConfig{{Type: "aws:ec2/instance:Instance", Properties: []string{"type"}}}
+		}, `invalid insights property "type"`},
+		{"adaptive polling bounds", func(p *PulumiApiConfig) {
+			p.Realtime = true
+			p.AdaptivePolling = true
+			p.RealtimeMaxInterval = config.Duration(5 * time.Second)
+		}, "realtime_interval must be between realtime_min_interval and realtime_max_interval"},
+		{"invalid event_format", func(p *PulumiApiConfig) { p.EventFormat = "json" }, `invalid event_format "json"`},
+		{"log event_format with siem_format", func(p *PulumiApiConfig) {
+			p.EventFormat = "log"
+			p.SIEMFormat = "cef"
+		}, "siem_format can't be used"},
+		{"token for an organization not collected", func(p *PulumiApiConfig) {
+			p.Tokens = map[string]string{"labs": "pul-labs"}
+		}, "tokens has a token for labs"},
+		{"empty organization token", func(p *PulumiApiConfig) {
+			p.Tokens = map[string]string{"acme": ""}
+		}, "the tokens entry of acme is empty"},
+		{"negative max_response_size", func(p *PulumiApiConfig) { p.MaxResponseSize = -1 }, "invalid max_response_size -1"},
+		{"zero success_rate_window", func(p *PulumiApiConfig) {
+			p.StackUpdates = true
+			p.SuccessRateWindow = 0
+		}, "invalid success_rate_window 0s, must be positive"},
+		{"endpoint without token", func(p *PulumiApiConfig) {
+			p.Endpoints = []EndpointConfig{{Name: "eu", Organizations: []string{"acme-eu"}}}
+		}, "endpoint eu token is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := inputs.Inputs["pulumi_api"]().(*PulumiApiConfig)
+			p.Organization = "acme"
+			p.Token = fakepulumi.Token
+			p.Log = testutil.Logger{}
+			tt.modify(p)
+
+			err := p.Init()
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
+
+func TestGatherPageSize(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.PageSize = 50
+		p.StackUpdates = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	require.Contains(t, server.Requests(), "/api/orgs/acme/auditlogs?startTime=1700000000&pageSize=50")
+	require.Contains(t, server.Requests(), "/api/stacks/acme/website/production/updates?pageSize=50&page=1")
+}
+
+func TestGatherBackfillStart(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	// No saved state, so this is the first run
+	p := inputs.Inputs["pulumi_api"]().(*PulumiApiConfig)
+	p.Url = server.URL
+	p.Organization = "acme"
+	p.Token = fakepulumi.Token
+	p.Overlap = 0
+	p.ValidateCredentials = false
+	p.Log = testutil.Logger{}
+	p.BackfillStart = "2023-11-14"
+	p.StackUpdates = true
+	require.NoError(t, p.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	require.Equal(t, "/api/orgs/acme/auditlogs?startTime=1699920000", server.Requests()[0])
+
+	// The updates are emitted, as old as they are, without counting
+	// towards the success rate
+	var updates int
+	for _, m := range acc.GetTelegrafMetrics() {
+		switch m.Name() {
+		case "pulumi_stack_update":
+			updates++
+		case "pulumi_stack_updates":
+			require.Equal(t, int64(0), m.Fields()["updates"])
+		}
+	}
+	require.Equal(t, 3, updates)
+	require.True(t, p.organizations[0].backfillStart.IsZero())
+}
+
+func TestInitInvalidBackfillStart(t *testing.T) {
+	p := inputs.Inputs["pulumi_api"]().(*PulumiApiConfig)
+	p.Organization = "acme"
+	p.Log = testutil.Logger{}
+	p.BackfillStart = "last tuesday"
+
+	require.EqualError(t, p.Init(), `invalid backfill_start "last tuesday", must be a date or RFC3339 timestamp`)
+}
+
+func TestGatherAuditLogsCollectionTime(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.TimestampSource = "collection"
+	})
+
+	start := time.Now()
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Len(t, acc.GetTelegrafMetrics(), 3)
+
+	m := acc.GetTelegrafMetrics()[0]
+	require.False(t, m.Time().Before(start))
+	require.Equal(t, time.Unix(1700000300, 0).UnixNano(), m.Fields()["event_time"])
+
+	// The cursor still follows the events
+	require.Equal(t, time.Unix(1700000300, 0), p.organizations[0].lastFetch)
+}
+
+func TestStartAfterStop(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server)
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Start(&acc))
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	state := p.GetState()
+	p.Stop()
+
+	// Restarting keeps the cursors
+	require.NoError(t, p.Start(&acc))
+	require.Equal(t, state, p.GetState())
+	p.Stop()
+}
+
+func TestStopCancelsGather(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	started := make(chan struct{})
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	})
+
+	p := newTestPlugin(t, server)
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Start(&acc))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Gather(&acc)
+	}()
+
+	<-started
+	p.Stop()
+
+	// Stop only returns once the gather has
+	select {
+	case <-done:
+	default:
+		t.Fatal("Stop returned before the gather")
+	}
+}
+
+func TestGatherPollJitter(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.PollJitter = config.Duration(20 * time.Millisecond)
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	testutil.RequireMetricsEqual(t, expectedAuditLogs, acc.GetTelegrafMetrics(), testutil.SortMetrics())
+
+	// Stopping doesn't wait out the jitter
+	p.Stop()
+	acc.ClearMetrics()
+	start := time.Now()
+	p.PollJitter = config.Duration(time.Hour)
+	require.NoError(t, p.Gather(&acc))
+	require.Less(t, time.Since(start), time.Second)
+	require.Empty(t, acc.GetTelegrafMetrics())
+}
+
+func TestGatherCircuitBreaker(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.CircuitBreakerThreshold = 2
+		p.CircuitBreakerCooldown = config.Duration(time.Hour)
+	})
+	p.Token = "invalid"
+
+	breaker := func(acc *testutil.Accumulator) map[string]interface{} {
+		m, ok := acc.Get("pulumi_api_circuit_breaker")
+		require.True(t, ok)
+		return m.Fields
+	}
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Equal(t, false, breaker(&acc)["open"])
+	require.Equal(t, 1, breaker(&acc)["consecutive_failures"])
+
+	acc.ClearMetrics()
+	require.NoError(t, p.Gather(&acc))
+	require.Equal(t, true, breaker(&acc)["open"])
+
+	// While open, nothing is requested
+	acc.ClearMetrics()
+	acc.Errors = nil
+	requests := len(server.Requests())
+	require.NoError(t, p.Gather(&acc))
+	require.Len(t, server.Requests(), requests)
+	require.Empty(t, acc.Errors)
+	require.Equal(t, true, breaker(&acc)["open"])
+	require.Greater(t, breaker(&acc)["seconds_until_retry"], float64(3500))
+}
+
+func TestGatherErrorMetrics(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		fakepulumi.Error(w, http.StatusInternalServerError, "Internal Server Error")
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.ErrorMetrics = true
+		p.MaxRetries = 0
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	expected := []telegraf.Metric{
+		testutil.MustMetric(
+			"pulumi_api_errors",
+			map[string]string{
+				"organization": "acme",
+				"endpoint":     "audit_logs",
+				"class":        "server",
+			},
+			map[string]interface{}{
+				"count":   1,
+				"message": "page 1: giving up after 0 retries: error code 500: Internal Server Error",
+			},
+			time.Unix(0, 0),
+		),
+	}
+
+	testutil.RequireMetricsEqual(t, expected, acc.GetTelegrafMetrics(), testutil.IgnoreTime())
+
+	acc.ClearMetrics()
+	p.Token = "invalid"
+	require.NoError(t, p.Gather(&acc))
+	require.Equal(t, "auth", acc.GetTelegrafMetrics()[0].Tags()["class"])
+}
+
+func TestGatherReloadsRotatedToken(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("revoked\n"), 0600))
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.TokenFile = tokenFile
+	})
+	require.Equal(t, "revoked", p.Token)
+
+	// Unchanged, the token isn't retried
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Len(t, acc.Errors, 1)
+	require.Len(t, server.Requests(), 1)
+
+	require.NoError(t, os.WriteFile(tokenFile, []byte(fakepulumi.Token), 0600))
+
+	acc.Errors = nil
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	testutil.RequireMetricsEqual(t, expectedAuditLogs, acc.GetTelegrafMetrics(), testutil.SortMetrics())
+	require.Equal(t, fakepulumi.Token, p.Token)
+}
+
+func TestGatherAuditLogsTokenName(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[
+			{"timestamp":1700000100,"sourceIP":"192.0.2.1","event":"stack-updated","description":"Updated stack","user":{"name":"CI","githubLogin":"ci-bot"},"tokenID":"a1b2","tokenName":"release-pipeline"},
+			{"timestamp":1700000200,"sourceIP":"192.0.2.2","event":"stack-updated","description":"Updated stack","user":{"name":"Jane Doe","githubLogin":"jane"}}
+		]}`))
+	})
+
+	p := newTestPlugin(t, server)
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Len(t, acc.GetTelegrafMetrics(), 2)
+
+	require.Equal(t, "release-pipeline", acc.GetTelegrafMetrics()[0].Tags()["token_name"])
+	require.NotContains(t, acc.GetTelegrafMetrics()[1].Tags(), "token_name")
+}
+
+func TestGatherSkipsWhileRunning(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	p := newTestPlugin(t, server)
+
+	var acc testutil.Accumulator
+	done := make(chan error)
+	go func() {
+		done <- p.Gather(&acc)
+	}()
+
+	<-started
+	skipped := p.gathersSkipped.Get()
+	require.NoError(t, p.Gather(&acc))
+	require.Equal(t, skipped+1, p.gathersSkipped.Get())
+
+	close(release)
+	require.NoError(t, <-done)
+	require.Len(t, server.Requests(), 1)
+}
+
+func TestGatherRequestBudget(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.MaxRequestsPerMinute = 1
+	})
+
+	// The second page waits for the budget until Stop
+	time.AfterFunc(100*time.Millisecond, p.Stop)
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Len(t, acc.Errors, 1)
+	require.Len(t, server.Requests(), 1)
+}
+
+func TestGatherStackTagFilter(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.StackTTL = true
+		p.StackTag = "monitor=true"
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	require.Contains(t, server.Requests(), "/api/user/stacks?organization=acme&tagName=monitor&tagValue=true")
+}
+
+func TestGatherStackUpdatesDeletedStacks(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auditLogEvents":[]}`))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.StackUpdates = true
+		p.IncludeDeletedStacks = true
+		p.SuccessRateWindow = config.Duration(100000 * time.Hour)
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	// Production is deleted
+	server.Handle("user/stacks", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"stacks":[{"orgName":"acme","projectName":"website","stackName":"staging"}]}`))
+	})
+
+	acc.ClearMetrics()
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	deleted := map[string]interface{}{}
+	for _, m := range acc.GetTelegrafMetrics() {
+		deleted[m.Tags()["stack"]] = m.Fields()["deleted"]
+		if m.Tags()["stack"] == "production" {
+			require.Equal(t, int64(2), m.Fields()["updates"])
+		}
+	}
+	require.Equal(t, map[string]interface{}{"production": true, "staging": false}, deleted)
+}
+
+func TestGatherRetentionWatermark(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	// Only the window's events, the oldest still kept is from 1690000000
+	server.Handle("auditlogs", func(w http.ResponseWriter, r *http.Request) {
+		start, _ := strconv.ParseInt(r.URL.Query().Get("startTime"), 10, 64)
+		end, err := strconv.ParseInt(r.URL.Query().Get("endTime"), 10, 64)
+		if err != nil {
+			end = math.MaxInt64
+		}
+
+		var events []string
+		for _, timestamp := range []int64{1700000100, 1695000000, 1690000000} {
+			if timestamp >= start && timestamp <= end {
+				events = append(events, fmt.Sprintf(`{"timestamp":%d,"event":"stack-updated","user":{}}`, timestamp))
+			}
+		}
+
+		fmt.Fprintf(w, `{"auditLogEvents":[%s]}`, strings.Join(events, ","))
+	})
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.RetentionWatermark = true
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	m, ok := acc.Get("pulumi_audit_log_retention")
+	require.True(t, ok)
+	require.Equal(t, int64(1690000000), m.Fields["oldest_event"])
+
+	// The answer is reused until the interval is up
+	acc.ClearMetrics()
+	requests := len(server.Requests())
+	require.NoError(t, p.Gather(&acc))
+	require.Len(t, server.Requests(), requests+1)
+	require.True(t, acc.HasMeasurement("pulumi_audit_log_retention"))
+
+	// And across a restart, through the state
+	restarted := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.RetentionWatermark = true
+	})
+	require.NoError(t, restarted.SetState(p.GetState()))
+
+	acc.ClearMetrics()
+	requests = len(server.Requests())
+	require.NoError(t, restarted.Gather(&acc))
+	require.Len(t, server.Requests(), requests+1)
+
+	m, ok = acc.Get("pulumi_audit_log_retention")
+	require.True(t, ok)
+	require.Equal(t, int64(1690000000), m.Fields["oldest_event"])
+}
+
+// TestGatherRetentionWatermarkRealtime is for -race: the realtime loop saves
+// the watermark while Gather updates it
+func TestGatherRetentionWatermarkRealtime(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	dir, err := os.MkdirTemp("", "pulumi_api")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.Realtime = true
+		p.RealtimeInterval = config.Duration(time.Millisecond)
+		p.RetentionWatermark = true
+		p.RetentionWatermarkInterval = config.Duration(time.Nanosecond)
+		p.StateFile = filepath.Join(dir, "state.json")
+	})
+
+	var acc testutil.Accumulator
+	for i := 0; i < 20; i++ {
+		require.NoError(t, p.Gather(&acc))
+	}
+	p.Stop()
+
+	require.Empty(t, acc.Errors)
+	require.True(t, acc.HasMeasurement("pulumi_audit_log_retention"))
+}
+
+func TestGatherAuditLogsDroppedEvents(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.EventExclude = []string{"member-*"}
+		p.DroppedEventsMetric = true
+	})
+	p.Overlap = config.Duration(time.Hour)
+
+	dropped := func(acc *testutil.Accumulator) map[string]interface{} {
+		counts := make(map[string]interface{})
+		for _, m := range acc.GetTelegrafMetrics() {
+			if m.Name() == "pulumi_api_dropped_events" {
+				counts[m.Tags()["reason"]] = m.Fields()["count"]
+			}
+		}
+		return counts
+	}
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Len(t, acc.GetTelegrafMetrics(), 2+len(dropReasons))
+	require.Equal(t, map[string]interface{}{
+		"duplicate":       int64(0),
+		"event_filter":    int64(1),
+		"decode_error":    int64(0),
+		"anonymize_error": int64(0),
+	}, dropped(&acc))
+
+	// Everything again, the excluded event is a duplicate this time
+	acc.ClearMetrics()
+	require.NoError(t, p.Gather(&acc))
+	require.Equal(t, int64(3), dropped(&acc)["duplicate"])
+	require.Equal(t, int64(0), dropped(&acc)["event_filter"])
+}
+
+func TestGatherEndpoints(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	selfHosted := fakepulumi.NewServer()
+	defer selfHosted.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.Endpoints = []EndpointConfig{{
+			Name:          "self-hosted",
+			Url:           selfHosted.URL,
+			Token:         fakepulumi.Token,
+			Organizations: []string{"acme"},
+		}}
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Len(t, acc.GetTelegrafMetrics(), 6)
+
+	endpoints := make(map[string]int)
+	for _, m := range acc.GetTelegrafMetrics() {
+		endpoints[m.Tags()["endpoint_name"]]++
+	}
+	require.Equal(t, map[string]int{"": 3, "self-hosted": 3}, endpoints)
+
+	// The same organization name has a cursor per endpoint
+	state := p.GetState().(PulumiApiState)
+	require.Contains(t, state.Organizations, "acme")
+	require.Contains(t, state.Organizations, "self-hosted/acme")
+	require.Len(t, selfHosted.Requests(), 2)
+}
+
+func TestGatherAuditLogsSeverityOverrides(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.SIEMFormat = "cef"
+		p.SeverityOverrides = map[string]string{
+			"stack-*":       "low",
+			"stack-created": "critical",
+		}
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	severities := make(map[string]interface{})
+	for _, m := range acc.GetTelegrafMetrics() {
+		severities[m.Tags()["event"]] = m.Fields()["severity"]
+	}
+
+	require.Equal(t, map[string]interface{}{
+		"stack-updated": int64(3),
+		"stack-created": int64(10),
+		"member-added":  int64(5),
+	}, severities)
+}
+
+func TestGatherFieldFilter(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.FieldExclude = []string{"payload"}
+		p.SIEMFormat = "cef"
+	})
+
+	var acc testutil.Accumulator
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Len(t, acc.GetTelegrafMetrics(), 3)
+
+	for _, m := range acc.GetTelegrafMetrics() {
+		require.NotContains(t, m.Fields(), "payload")
+		require.Contains(t, m.Fields(), "severity")
+	}
+
+	// Metrics left without fields aren't emitted
+	acc.ClearMetrics()
+	p.fieldFilter, _ = filter.NewIncludeExcludeFilter([]string{"payload"}, []string{"payload"})
+	p.organizations[0].lastFetch = fixtureStart
+	p.organizations[0].seen = make(map[string]time.Time)
+	require.NoError(t, p.Gather(&acc))
+	require.Empty(t, acc.GetTelegrafMetrics())
+}
+
+func TestGatherFieldFilterRealtime(t *testing.T) {
+	server := fakepulumi.NewServer()
+	defer server.Close()
+
+	p := newTestPlugin(t, server, func(p *PulumiApiConfig) {
+		p.FieldExclude = []string{"payload"}
+		p.SIEMFormat = "cef"
+		p.Realtime = true
+		p.RealtimeInterval = config.Duration(time.Hour)
+	})
+	defer p.Stop()
+
+	// Buffered metrics are filtered as they're flushed
+	var acc testutil.Accumulator
+	require.Eventually(t, func() bool {
+		if err := p.Gather(&acc); err != nil {
+			return false
+		}
+		return len(acc.GetTelegrafMetrics()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Empty(t, acc.Errors)
+	for _, m := range acc.GetTelegrafMetrics() {
+		require.NotContains(t, m.Fields(), "payload")
+		require.Contains(t, m.Fields(), "severity")
+	}
+}
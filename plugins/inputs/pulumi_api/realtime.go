@@ -0,0 +1,164 @@
+package pulumi_api
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+)
+
+// startRealtime polls the audit logs every realtime_interval until Stop,
+// buffering what it collects for Gather to flush
+func (p *PulumiApiConfig) startRealtime() {
+	p.realtimeDone = make(chan struct{})
+
+	go func() {
+		defer close(p.realtimeDone)
+
+		// With adaptive_polling each organization has an interval of its
+		// own, the loop checks which are due as often as any can be
+		interval := time.Duration(p.RealtimeInterval)
+		if p.AdaptivePolling {
+			interval = time.Duration(p.RealtimeMinInterval)
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			polled := int32(1)
+			if p.AdaptivePolling {
+				polled = 0
+				p.gatherOrganizations(p.buffer, func(acc telegraf.Accumulator, org *organization) {
+					p.collectDueAuditLogs(acc, org, &polled)
+				})
+			} else {
+				p.gatherOrganizations(p.buffer, p.collectAuditLogs)
+			}
+
+			if polled != 0 {
+				if err := p.saveStateFile(); err != nil {
+					p.buffer.AddError(fmt.Errorf("saving state: %s", err))
+				}
+			}
+
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	if p.AdaptivePolling {
+		p.Log.Infof("Polling audit logs every %s to %s in realtime mode, adapting to each organization's events",
+			time.Duration(p.RealtimeMinInterval), time.Duration(p.RealtimeMaxInterval))
+		return
+	}
+
+	p.Log.Infof("Polling audit logs every %s in realtime mode", time.Duration(p.RealtimeInterval))
+}
+
+// buffer is an accumulator that holds on to metrics and errors until they
+// are flushed into the accumulator of the next Gather
+type buffer struct {
+	log   telegraf.Logger
+	limit int
+
+	mu      sync.Mutex
+	metrics []telegraf.Metric
+	errors  []error
+	dropped int
+}
+
+func newBuffer(log telegraf.Logger, limit int) *buffer {
+	return &buffer{
+		log:   log,
+		limit: limit,
+	}
+}
+
+func (b *buffer) AddFields(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	b.add(measurement, fields, tags, telegraf.Untyped, t)
+}
+
+func (b *buffer) AddGauge(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	b.add(measurement, fields, tags, telegraf.Gauge, t)
+}
+
+func (b *buffer) AddCounter(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	b.add(measurement, fields, tags, telegraf.Counter, t)
+}
+
+func (b *buffer) AddSummary(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	b.add(measurement, fields, tags, telegraf.Summary, t)
+}
+
+func (b *buffer) AddHistogram(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	b.add(measurement, fields, tags, telegraf.Histogram, t)
+}
+
+func (b *buffer) add(measurement string, fields map[string]interface{}, tags map[string]string, valueType telegraf.ValueType, t []time.Time) {
+	timestamp := time.Now()
+	if len(t) > 0 {
+		timestamp = t[0]
+	}
+
+	b.AddMetric(metric.New(measurement, tags, fields, timestamp, valueType))
+}
+
+func (b *buffer) AddMetric(m telegraf.Metric) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Drop the oldest metrics rather than grow without bound while Gather
+	// isn't being called, or can't keep up
+	if b.limit > 0 && len(b.metrics) >= b.limit {
+		b.metrics = b.metrics[1:]
+		b.dropped++
+	}
+
+	b.metrics = append(b.metrics, m)
+}
+
+func (b *buffer) SetPrecision(precision time.Duration) {}
+
+func (b *buffer) AddError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.errors = append(b.errors, err)
+}
+
+func (b *buffer) WithTracking(maxTracked int) telegraf.TrackingAccumulator {
+	panic("tracking is not supported by the realtime buffer")
+}
+
+// take empties the buffer, returning what it held
+func (b *buffer) take() ([]telegraf.Metric, []error) {
+	b.mu.Lock()
+	metrics, errors, dropped := b.metrics, b.errors, b.dropped
+	b.metrics, b.errors, b.dropped = nil, nil, 0
+	b.mu.Unlock()
+
+	if dropped > 0 {
+		b.log.Warnf("Realtime buffer full, dropped the %d oldest metrics", dropped)
+	}
+
+	return metrics, errors
+}
+
+// flush moves everything buffered since the last flush into acc
+func (b *buffer) flush(acc telegraf.Accumulator) {
+	metrics, errors := b.take()
+
+	for _, m := range metrics {
+		acc.AddMetric(m)
+	}
+
+	for _, err := range errors {
+		acc.AddError(err)
+	}
+}
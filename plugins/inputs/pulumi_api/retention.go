@@ -0,0 +1,191 @@
+package pulumi_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// The oldest audit event is found to within this
+const retentionPrecision = time.Hour
+
+// retentionCollector emits how far back the audit logs go. The API lists
+// events newest first, so rather than paging through all of history it
+// bisects the time before the oldest event, a request per step. That is
+// only done once per retention_watermark_interval, the watermark found is
+// emitted again in between.
+type retentionCollector struct {
+	p     *PulumiApiConfig
+	org   *organization
+	state retentionWatermark
+}
+
+// retentionWatermark is kept so a restart doesn't bisect again straight
+// away. The realtime loop may save it while Gather updates it.
+type retentionWatermark struct {
+	mu    sync.Mutex
+	state retentionState
+}
+
+type retentionState struct {
+	// OldestEvent is how far back the audit logs went as of CheckedAt
+	OldestEvent time.Time `json:"oldest_event,omitempty"`
+	CheckedAt   time.Time `json:"checked_at,omitempty"`
+}
+
+func (w *retentionWatermark) get() retentionState {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.state
+}
+
+func (w *retentionWatermark) set(state retentionState) {
+	w.mu.Lock()
+	w.state = state
+	w.mu.Unlock()
+}
+
+func (w *retentionWatermark) MarshalJSON() ([]byte, error) {
+	return json.Marshal(w.get())
+}
+
+func (w *retentionWatermark) UnmarshalJSON(data []byte) error {
+	var state retentionState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	w.set(state)
+	return nil
+}
+
+func newRetentionCollector(p *PulumiApiConfig, org *organization) Collector {
+	if !p.RetentionWatermark {
+		return nil
+	}
+
+	return &retentionCollector{p: p, org: org}
+}
+
+func (c *retentionCollector) Name() string {
+	return "retention_watermark"
+}
+
+func (c *retentionCollector) Interval() time.Duration {
+	return 0
+}
+
+func (c *retentionCollector) State() interface{} {
+	return &c.state
+}
+
+func (c *retentionCollector) Gather(acc telegraf.Accumulator) {
+	p, org := c.p, c.org
+	state := c.state.get()
+
+	if time.Since(state.CheckedAt) >= time.Duration(p.RetentionWatermarkInterval) {
+		oldest, err := p.findOldestAuditEvent(acc, org)
+		if err != nil {
+			p.addFetchError(acc, org, "audit_log_retention", "", err)
+			return
+		}
+
+		state = retentionState{OldestEvent: oldest, CheckedAt: time.Now()}
+		c.state.set(state)
+	}
+
+	if state.OldestEvent.IsZero() {
+		return
+	}
+
+	fields := map[string]interface{}{
+		"oldest_event":      state.OldestEvent.Unix(),
+		"retention_seconds": time.Since(state.OldestEvent).Seconds(),
+	}
+
+	acc.AddGauge("pulumi_audit_log_retention", fields, map[string]string{"organization": org.name})
+}
+
+// findOldestAuditEvent returns the time of the oldest event the API still
+// returns, zero if there are none
+func (p *PulumiApiConfig) findOldestAuditEvent(acc telegraf.Accumulator, org *organization) (time.Time, error) {
+	start := time.Unix(0, 0)
+	end := time.Now()
+
+	found, err := p.probeAuditLogs(acc, org, start, end)
+	if err != nil || !found {
+		return time.Time{}, err
+	}
+
+	// The oldest event stays between start and end
+	for end.Sub(start) > retentionPrecision {
+		middle := start.Add(end.Sub(start) / 2)
+
+		found, err := p.probeAuditLogs(acc, org, start, middle)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if found {
+			end = middle
+		} else {
+			start = middle
+		}
+	}
+
+	// Narrowed down enough for what's left to be looked at directly
+	var oldest time.Time
+	err = p.listAuditLogWindow(acc, org, start, end, 0, func(auditLogEvent AuditLogEvent) {
+		if timestamp := p.eventTime(auditLogEvent.Timestamp); oldest.IsZero() || timestamp.Before(oldest) {
+			oldest = timestamp
+		}
+	})
+
+	return oldest, err
+}
+
+// probeAuditLogs reports whether there are events between start and end
+func (p *PulumiApiConfig) probeAuditLogs(acc telegraf.Accumulator, org *organization, start time.Time, end time.Time) (bool, error) {
+	found := false
+	err := p.listAuditLogWindow(acc, org, start, end, 1, func(AuditLogEvent) {
+		found = true
+	})
+
+	return found, err
+}
+
+// listAuditLogWindow decodes the first page of events between start and
+// end, without emitting them
+func (p *PulumiApiConfig) listAuditLogWindow(acc telegraf.Accumulator, org *organization, start time.Time, end time.Time, pageSize int, each func(AuditLogEvent)) error {
+	url := fmt.Sprintf("%s/api/orgs/%s/auditlogs?startTime=%d&endTime=%d", org.tenant.url, org.name, start.Unix(), end.Unix())
+	if pageSize > 0 {
+		url = fmt.Sprintf("%s&pageSize=%d", url, pageSize)
+	}
+
+	req := apiRequest{
+		acc:          acc,
+		tenant:       org.tenant,
+		stats:        org.stats,
+		organization: org.name,
+		endpoint:     "auditlogs",
+		url:          url,
+	}
+
+	var auditLogsResponse AuditLogsResponse
+	return p.get(req, func(body io.Reader) error {
+		return org.drift.decodeStream("auditlogs", body, &auditLogsResponse, "auditLogEvents", func(raw json.RawMessage) error {
+			var auditLogEvent AuditLogEvent
+			if err := org.drift.decode("auditlogs.auditLogEvents[]", raw, &auditLogEvent); err != nil {
+				return nil
+			}
+
+			each(auditLogEvent)
+			return nil
+		})
+	})
+}
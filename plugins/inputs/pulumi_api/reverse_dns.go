@@ -0,0 +1,75 @@
+package pulumi_api
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reverseDNS resolves source IPs to hostnames. Events come from the same
+// few CI runners and offices over and over, so answers are cached,
+// failures included, for the cache TTL.
+type reverseDNS struct {
+	resolver addrResolver
+	timeout  time.Duration
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedHostname
+}
+
+// addrResolver finds the names of an address, as net.Resolver does
+type addrResolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+type cachedHostname struct {
+	hostname string
+	expires  time.Time
+}
+
+func newReverseDNS(resolver addrResolver, timeout time.Duration, ttl time.Duration) *reverseDNS {
+	return &reverseDNS{
+		resolver: resolver,
+		timeout:  timeout,
+		ttl:      ttl,
+		cache:    make(map[string]cachedHostname),
+	}
+}
+
+// lookup returns the hostname of ip, empty if it has none or the lookup
+// didn't finish within the timeout
+func (r *reverseDNS) lookup(ctx context.Context, ip string) string {
+	now := time.Now()
+
+	r.mu.Lock()
+	cached, ok := r.cache[ip]
+	r.mu.Unlock()
+
+	if ok && now.Before(cached.expires) {
+		return cached.hostname
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var hostname string
+	if names, err := r.resolver.LookupAddr(ctx, ip); err == nil && len(names) > 0 {
+		hostname = strings.TrimSuffix(names[0], ".")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Expired entries of IPs not seen again would pile up otherwise
+	for key, entry := range r.cache {
+		if now.After(entry.expires) {
+			delete(r.cache, key)
+		}
+	}
+
+	r.cache[ip] = cachedHostname{hostname: hostname, expires: now.Add(r.ttl)}
+
+	return hostname
+}
@@ -0,0 +1,209 @@
+package pulumi_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	neturl "net/url"
+	"sort"
+	"strings"
+
+	"github.com/influxdata/telegraf"
+)
+
+// Schemes of the cloud secrets providers that encrypt with a key management
+// service
+var kmsSecretsProviders = map[string]bool{
+	"awskms":        true,
+	"azurekeyvault": true,
+	"gcpkms":        true,
+	"hashivault":    true,
+}
+
+// SecretsProvider is the secrets provider of a stack's latest deployment.
+// Its state differs by type, cloud providers keep their key's URL in it.
+type SecretsProvider struct {
+	Type  string                 `json:"type"`
+	State map[string]interface{} `json:"state"`
+}
+
+// kind is the provider as a tag value: service, passphrase, the scheme of
+// a cloud provider's key such as awskms, or unknown for a stack that
+// hasn't been deployed
+func (s SecretsProvider) kind() string {
+	switch s.Type {
+	case "":
+		return "unknown"
+	case "cloud":
+		url, _ := s.State["url"].(string)
+		if i := strings.Index(url, "://"); i > 0 {
+			return url[:i]
+		}
+	}
+
+	return s.Type
+}
+
+// stackSecretsProvider is a stack's provider kind as of its update at
+// lastUpdate
+type stackSecretsProvider struct {
+	lastUpdate int64
+	kind       string
+}
+
+// gatherSecretsProviders emits the secrets provider of each stack, and the
+// number of stacks using each provider per organization. A stack's export
+// is only fetched again once it's been updated.
+func (p *PulumiApiConfig) gatherSecretsProviders(acc telegraf.Accumulator, org *organization, stacks []StackSummary) {
+	providers := make(map[string]stackSecretsProvider, len(stacks))
+	counts := make(map[string]int)
+
+	for _, stack := range stacks {
+		provider, ok := org.secretsProviders[stack.Key()]
+		if !ok || provider.lastUpdate != stack.LastUpdate {
+			secretsProvider, err := p.fetchSecretsProvider(acc, org, stack)
+			if err != nil {
+				p.addFetchError(acc, org, "secrets_provider", stack.Key(), err)
+				continue
+			}
+
+			provider = stackSecretsProvider{lastUpdate: stack.LastUpdate, kind: secretsProvider.kind()}
+		}
+
+		providers[stack.Key()] = provider
+		counts[provider.kind]++
+
+		tags := map[string]string{
+			"organization": org.name,
+			"project":      stack.ProjectName,
+			"stack":        stack.StackName,
+			"provider":     provider.kind,
+		}
+
+		fields := map[string]interface{}{
+			"kms": kmsSecretsProviders[provider.kind],
+		}
+
+		acc.AddGauge("pulumi_secrets_provider", fields, tags)
+	}
+
+	// Stacks gone from the listing are forgotten
+	org.secretsProviders = providers
+
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	for _, kind := range kinds {
+		tags := map[string]string{
+			"organization": org.name,
+			"provider":     kind,
+		}
+		p.addShardTag(tags)
+
+		fields := map[string]interface{}{
+			"stacks": counts[kind],
+			"kms":    kmsSecretsProviders[kind],
+		}
+
+		acc.AddGauge("pulumi_secrets_provider", fields, tags)
+	}
+}
+
+// fetchSecretsProvider returns the secrets provider from the stack's
+// export, which is read only as far as the provider
+func (p *PulumiApiConfig) fetchSecretsProvider(acc telegraf.Accumulator, org *organization, stack StackSummary) (SecretsProvider, error) {
+	req := apiRequest{
+		acc:          acc,
+		tenant:       org.tenant,
+		stats:        org.stats,
+		organization: org.name,
+		endpoint:     "export",
+		url: fmt.Sprintf("%s/api/stacks/%s/%s/%s/export", org.tenant.url,
+			neturl.PathEscape(org.name), neturl.PathEscape(stack.ProjectName), neturl.PathEscape(stack.StackName)),
+	}
+
+	var provider SecretsProvider
+	err := p.get(req, func(body io.Reader) error {
+		raw, err := exportSecretsProvider(body)
+		if err != nil || raw == nil {
+			return err
+		}
+
+		return org.drift.decode("export.deployment.secrets_providers", raw, &provider)
+	})
+	if err != nil {
+		return SecretsProvider{}, err
+	}
+
+	return provider, nil
+}
+
+// exportSecretsProvider finds deployment.secrets_providers in an export,
+// stepping over the resources an element at a time rather than buffering
+// what can be megabytes of them. It's nil if the deployment has none.
+func exportSecretsProvider(r io.Reader) (json.RawMessage, error) {
+	decoder := json.NewDecoder(r)
+	if err := expectDelim(decoder, '{'); err != nil {
+		return nil, fmt.Errorf("export: %s", err)
+	}
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("export: %s", err)
+		}
+
+		if token.(string) != "deployment" {
+			var value json.RawMessage
+			if err := decoder.Decode(&value); err != nil {
+				return nil, fmt.Errorf("export.%s: %s", token, err)
+			}
+			continue
+		}
+
+		// A stack that was never deployed has a null deployment
+		token, err = decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("export.deployment: %s", err)
+		}
+		if token == nil {
+			return nil, nil
+		}
+		if delim, ok := token.(json.Delim); !ok || delim != '{' {
+			return nil, fmt.Errorf("export.deployment: expected {, got %v", token)
+		}
+
+		for decoder.More() {
+			token, err := decoder.Token()
+			if err != nil {
+				return nil, fmt.Errorf("export.deployment: %s", err)
+			}
+			name := token.(string)
+
+			switch name {
+			case "secrets_providers":
+				var value json.RawMessage
+				if err := decoder.Decode(&value); err != nil {
+					return nil, fmt.Errorf("export.deployment.%s: %s", name, err)
+				}
+				return value, nil
+			case "resources":
+				if err := decodeArrayStream(decoder, func(json.RawMessage) error { return nil }); err != nil {
+					return nil, fmt.Errorf("export.deployment.%s: %s", name, err)
+				}
+			default:
+				var value json.RawMessage
+				if err := decoder.Decode(&value); err != nil {
+					return nil, fmt.Errorf("export.deployment.%s: %s", name, err)
+				}
+			}
+		}
+
+		return nil, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,61 @@
+package pulumi_api
+
+import (
+	"hash/fnv"
+	"strconv"
+)
+
+// shardedCollector is implemented by collectors whose work is split per
+// stack between the shards, every other collector only runs on the shard
+// owning the organization
+type shardedCollector interface {
+	Sharded() bool
+}
+
+// ownsKey reports whether this agent's shard owns key, an organization's
+// state key or a stack of it. Keys are assigned by rendezvous hashing:
+// the shard ranking highest for the key owns it, so changing shard_count
+// by one only moves the keys of one shard's share.
+func (p *PulumiApiConfig) ownsKey(key string) bool {
+	if p.ShardCount <= 1 {
+		return true
+	}
+
+	owner, highest := 0, uint64(0)
+	for shard := 0; shard < p.ShardCount; shard++ {
+		hash := fnv.New64a()
+		hash.Write([]byte(key))
+		hash.Write([]byte{0})
+		hash.Write([]byte(strconv.Itoa(shard)))
+
+		if weight := hash.Sum64(); shard == 0 || weight > highest {
+			owner, highest = shard, weight
+		}
+	}
+
+	return owner == p.ShardIndex
+}
+
+// shardStacks returns the stacks of the organization owned by this shard
+func (p *PulumiApiConfig) shardStacks(org *organization, stacks []StackSummary) []StackSummary {
+	if p.ShardCount <= 1 {
+		return stacks
+	}
+
+	var owned []StackSummary
+	for _, stack := range stacks {
+		if p.ownsKey(org.stateKey() + "/" + stack.Key()) {
+			owned = append(owned, stack)
+		}
+	}
+
+	return owned
+}
+
+// addShardTag tags the per-organization totals over stacks with the shard,
+// each shard only counting its own stacks, so they can be summed
+func (p *PulumiApiConfig) addShardTag(tags map[string]string) {
+	if p.ShardCount > 1 {
+		tags["shard"] = strconv.Itoa(p.ShardIndex)
+	}
+}
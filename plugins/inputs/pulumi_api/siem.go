@@ -0,0 +1,122 @@
+package pulumi_api
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf/filter"
+)
+
+const (
+	siemVendor  = "Pulumi"
+	siemProduct = "Pulumi Cloud"
+)
+
+// Severities on the 0-10 scale shared by CEF and LEEF
+var severityLevels = map[string]int{
+	"low":      3,
+	"medium":   5,
+	"high":     8,
+	"critical": 10,
+}
+
+// eventSeverity classifies an audit log event by what it did to the
+// resource named in it, removing access or data being the riskiest
+func eventSeverity(event string) string {
+	switch {
+	case strings.HasSuffix(event, "-deleted"),
+		strings.HasSuffix(event, "-removed"),
+		strings.HasSuffix(event, "-disabled"):
+		return "high"
+	case strings.HasSuffix(event, "-created"),
+		strings.HasSuffix(event, "-added"),
+		strings.HasSuffix(event, "-updated"),
+		strings.HasSuffix(event, "-changed"),
+		strings.HasSuffix(event, "-enabled"):
+		return "medium"
+	default:
+		return "low"
+	}
+}
+
+// severityOverride is a severity_overrides entry, matching event names by
+// glob
+type severityOverride struct {
+	filter   filter.Filter
+	severity string
+}
+
+// compileSeverityOverrides checks the overrides, exact names are tried
+// before globs and globs in order, so the outcome doesn't depend on the
+// order of the table
+func compileSeverityOverrides(overrides map[string]string) ([]severityOverride, error) {
+	patterns := make([]string, 0, len(overrides))
+	for pattern, severity := range overrides {
+		if _, ok := severityLevels[severity]; !ok {
+			return nil, fmt.Errorf("invalid severity_overrides severity %q of %s, must be low, medium, high or critical", severity, pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	sort.Slice(patterns, func(i, j int) bool {
+		iGlob, jGlob := strings.ContainsAny(patterns[i], "*?["), strings.ContainsAny(patterns[j], "*?[")
+		if iGlob != jGlob {
+			return jGlob
+		}
+		return patterns[i] < patterns[j]
+	})
+
+	compiled := make([]severityOverride, 0, len(patterns))
+	for _, pattern := range patterns {
+		f, err := filter.Compile([]string{pattern})
+		if err != nil {
+			return nil, fmt.Errorf("invalid severity_overrides pattern %q: %s", pattern, err)
+		}
+		compiled = append(compiled, severityOverride{filter: f, severity: overrides[pattern]})
+	}
+
+	return compiled, nil
+}
+
+// severity is the event's severity, from severity_overrides if it matches
+// one and the built in classification otherwise
+func (p *PulumiApiConfig) severity(event string) string {
+	for _, override := range p.severityOverrides {
+		if override.filter.Match(event) {
+			return override.severity
+		}
+	}
+
+	return eventSeverity(event)
+}
+
+// addSIEMFields adds the header and extension fields of the configured
+// siem_format, named as the format names them
+func (p *PulumiApiConfig) addSIEMFields(fields map[string]interface{}, auditLogEvent AuditLogEvent, timestamp time.Time) {
+	severity := severityLevels[p.severity(auditLogEvent.Event)]
+	millis := timestamp.UnixNano() / int64(time.Millisecond)
+
+	switch p.SIEMFormat {
+	case "cef":
+		fields["cef_version"] = 0
+		fields["device_vendor"] = siemVendor
+		fields["device_product"] = siemProduct
+		fields["signature_id"] = auditLogEvent.Event
+		fields["name"] = auditLogEvent.Description
+		fields["severity"] = severity
+		fields["src"] = auditLogEvent.SourceIP
+		fields["suser"] = auditLogEvent.User.GitHubLogin
+		fields["rt"] = millis
+	case "leef":
+		fields["leef_version"] = "2.0"
+		fields["vendor"] = siemVendor
+		fields["product"] = siemProduct
+		fields["event_id"] = auditLogEvent.Event
+		fields["sev"] = severity
+		fields["src"] = auditLogEvent.SourceIP
+		fields["usrName"] = auditLogEvent.User.GitHubLogin
+		fields["devTime"] = millis
+	}
+}
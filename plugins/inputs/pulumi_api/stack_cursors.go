@@ -0,0 +1,138 @@
+package pulumi_api
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stackCursors is the state of the stacks collector: how far each stack's
+// updates and deployments have been collected, so a restart carries on
+// from there rather than fetching every stack's history again. It's a
+// snapshot taken after every gather, as the state may be saved while the
+// next one is running.
+type stackCursors struct {
+	org *organization
+
+	mu    sync.Mutex
+	state stackCursorsState
+}
+
+type stackCursorsState struct {
+	Stacks map[string]stackCursor `json:"stacks,omitempty"`
+
+	// Deployments is the version of each stack's newest finished
+	// deployment whose logs don't need scanning
+	Deployments map[string]int64 `json:"deployments,omitempty"`
+}
+
+type stackCursor struct {
+	LastUpdate  int64 `json:"last_update"`
+	LastVersion int64 `json:"last_version"`
+	Deleted     bool  `json:"deleted,omitempty"`
+
+	LastResult string `json:"last_result,omitempty"`
+
+	// Updates are the finished updates inside the success rate window, so
+	// the rate doesn't drop back to nothing either
+	Updates []savedUpdate `json:"updates,omitempty"`
+}
+
+type savedUpdate struct {
+	EndTime   int64 `json:"end_time"`
+	Succeeded bool  `json:"succeeded"`
+}
+
+// snapshot copies the organization's cursors, only ever called by the
+// goroutine gathering the organization
+func (c *stackCursors) snapshot() {
+	org := c.org
+
+	state := stackCursorsState{
+		Stacks:      make(map[string]stackCursor, len(org.stacks)),
+		Deployments: make(map[string]int64, len(org.scannedDeployments)),
+	}
+
+	for key, history := range org.stacks {
+		cursor := stackCursor{
+			LastUpdate:  history.lastUpdate,
+			LastVersion: history.lastVersion,
+			Deleted:     history.deleted,
+			LastResult:  history.lastResult,
+		}
+
+		for _, update := range history.updates {
+			cursor.Updates = append(cursor.Updates, savedUpdate{
+				EndTime:   update.endTime.Unix(),
+				Succeeded: update.succeeded,
+			})
+		}
+
+		state.Stacks[key] = cursor
+	}
+
+	for key, version := range org.scannedDeployments {
+		state.Deployments[key] = version
+	}
+
+	c.mu.Lock()
+	c.state = state
+	c.mu.Unlock()
+}
+
+func (c *stackCursors) MarshalJSON() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return json.Marshal(c.state)
+}
+
+// UnmarshalJSON restores the cursors into the organization, which is done
+// before it's gathered from
+func (c *stackCursors) UnmarshalJSON(data []byte) error {
+	var state stackCursorsState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	org := c.org
+	org.stacks = make(map[string]*stackHistory, len(state.Stacks))
+	org.scannedDeployments = make(map[string]int64, len(state.Deployments))
+
+	for key, cursor := range state.Stacks {
+		// Stacks only come back this way when they've been deleted, the
+		// summary of those listed is replaced on the first gather
+		var stack StackSummary
+		if i := strings.Index(key, "/"); i >= 0 {
+			stack = StackSummary{OrgName: org.name, ProjectName: key[:i], StackName: key[i+1:], LastUpdate: cursor.LastUpdate}
+		}
+
+		history := &stackHistory{
+			stack:       stack,
+			deleted:     cursor.Deleted,
+			lastUpdate:  cursor.LastUpdate,
+			lastVersion: cursor.LastVersion,
+			lastResult:  cursor.LastResult,
+		}
+
+		for _, update := range cursor.Updates {
+			history.updates = append(history.updates, finishedUpdate{
+				endTime:   time.Unix(update.EndTime, 0),
+				succeeded: update.Succeeded,
+			})
+		}
+
+		org.stacks[key] = history
+	}
+
+	for key, version := range state.Deployments {
+		org.scannedDeployments[key] = version
+	}
+
+	c.mu.Lock()
+	c.state = state
+	c.mu.Unlock()
+
+	return nil
+}
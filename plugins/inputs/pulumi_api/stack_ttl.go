@@ -0,0 +1,125 @@
+package pulumi_api
+
+import (
+	"fmt"
+	"io"
+	neturl "net/url"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+type SchedulesResponse struct {
+	Schedules []Schedule `json:"schedules"`
+}
+
+// Schedule is a scheduled deployment of a stack, kind environment_ttl is
+// the destroy scheduled by a stack's TTL
+type Schedule struct {
+	ID            string `json:"id"`
+	Kind          string `json:"kind"`
+	ScheduleOnce  string `json:"scheduleOnce"`
+	ScheduleCron  string `json:"scheduleCron"`
+	NextExecution string `json:"nextExecution"`
+	Paused        bool   `json:"paused"`
+}
+
+// destroyAt is when the TTL destroy runs, zero if the schedule has none
+func (s Schedule) destroyAt() time.Time {
+	for _, value := range []string{s.NextExecution, s.ScheduleOnce} {
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// gatherStackTTLs emits the time left until each TTL stack is destroyed,
+// negative once it's overdue, plus how many there are per organization
+func (p *PulumiApiConfig) gatherStackTTLs(acc telegraf.Accumulator, org *organization, stacks []StackSummary) {
+	now := time.Now()
+	scheduled, overdue := 0, 0
+
+	for _, stack := range stacks {
+		schedule, ok, err := p.fetchStackTTL(acc, org, stack)
+		if err != nil {
+			p.addFetchError(acc, org, "schedules", stack.Key(), err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		destroyAt := schedule.destroyAt()
+		if destroyAt.IsZero() {
+			continue
+		}
+
+		scheduled++
+		if destroyAt.Before(now) {
+			overdue++
+		}
+
+		tags := map[string]string{
+			"organization": org.name,
+			"project":      stack.ProjectName,
+			"stack":        stack.StackName,
+		}
+
+		fields := map[string]interface{}{
+			"destroy_at":            destroyAt.Unix(),
+			"seconds_until_destroy": destroyAt.Sub(now).Seconds(),
+			"paused":                schedule.Paused,
+		}
+
+		acc.AddGauge("pulumi_stack_ttl", fields, tags)
+	}
+
+	tags := map[string]string{
+		"organization": org.name,
+	}
+	p.addShardTag(tags)
+
+	fields := map[string]interface{}{
+		"scheduled_stacks": scheduled,
+		"overdue_stacks":   overdue,
+	}
+
+	acc.AddGauge("pulumi_stack_ttl", fields, tags)
+}
+
+// fetchStackTTL returns the stack's TTL schedule, if it has one. Schedules
+// rarely change, so the request is conditional.
+func (p *PulumiApiConfig) fetchStackTTL(acc telegraf.Accumulator, org *organization, stack StackSummary) (Schedule, bool, error) {
+	req := apiRequest{
+		acc:          acc,
+		tenant:       org.tenant,
+		stats:        org.stats,
+		organization: org.name,
+		endpoint:     "deployments/schedules",
+		url: fmt.Sprintf("%s/api/stacks/%s/%s/%s/deployments/schedules", org.tenant.url,
+			neturl.PathEscape(org.name), neturl.PathEscape(stack.ProjectName), neturl.PathEscape(stack.StackName)),
+	}
+
+	var schedules SchedulesResponse
+	err := p.getConditional(req, func(body io.Reader) error {
+		bytes, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+
+		return org.drift.decode("deployments/schedules", bytes, &schedules)
+	})
+	if err != nil {
+		return Schedule{}, false, err
+	}
+
+	for _, schedule := range schedules.Schedules {
+		if schedule.Kind == "environment_ttl" {
+			return schedule, true, nil
+		}
+	}
+
+	return Schedule{}, false, nil
+}
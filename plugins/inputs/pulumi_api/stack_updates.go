@@ -0,0 +1,435 @@
+package pulumi_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	neturl "net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/rawkode/telegraf-plugin-pulumi-api/plugins/common/pulumi"
+)
+
+// Updates are listed newest first, a page at a time, of this size unless
+// page_size is set
+const defaultUpdatesPageSize = 20
+
+func (p *PulumiApiConfig) updatesPageSize() int {
+	if p.PageSize > 0 {
+		return p.PageSize
+	}
+
+	return defaultUpdatesPageSize
+}
+
+type UpdatesResponse struct {
+	Updates []UpdateInfo `json:"updates"`
+}
+
+type UpdateInfo struct {
+	UpdateID        string            `json:"updateID"`
+	Kind            string            `json:"kind"`
+	StartTime       int64             `json:"startTime"`
+	EndTime         int64             `json:"endTime"`
+	Message         string            `json:"message"`
+	Environment     map[string]string `json:"environment"`
+	Result          string            `json:"result"`
+	Version         int64             `json:"version"`
+	ResourceChanges map[string]int    `json:"resourceChanges"`
+}
+
+func (u UpdateInfo) finished() bool {
+	return u.Result != "in-progress" && u.Result != "not-started"
+}
+
+// stackHistory is what has been collected of a stack's updates so far
+type stackHistory struct {
+	stack StackSummary
+
+	// deleted is set once the stack is no longer listed, deleted stacks
+	// are only kept with include_deleted_stacks
+	deleted bool
+
+	// lastUpdate is the stack's lastUpdate when everything up to it had
+	// been collected, the updates aren't fetched again until it changes
+	lastUpdate  int64
+	lastVersion int64
+
+	// lastResult is the result of the newest finished update other than
+	// a preview, however old
+	lastResult string
+
+	// Finished updates inside the success rate window, oldest first
+	updates []finishedUpdate
+
+	// Durations of the updates that finished since the last gather
+	durations []float64
+}
+
+type finishedUpdate struct {
+	endTime   time.Time
+	succeeded bool
+}
+
+func (h *stackHistory) prune(windowStart time.Time) {
+	for len(h.updates) > 0 && h.updates[0].endTime.Before(windowStart) {
+		h.updates = h.updates[1:]
+	}
+}
+
+func (p *PulumiApiConfig) gatherStackUpdates(acc telegraf.Accumulator, org *organization, stacks []StackSummary) {
+	p.Log.Debugf("Fetching stack updates for %s", org.name)
+
+	windowStart := time.Now().Add(-time.Duration(p.SuccessRateWindow))
+	current := make(map[string]bool, len(stacks))
+
+	// Updates go back to backfill_start the first time, but only count
+	// towards the rate once inside the window
+	since := windowStart
+	if !org.backfillStart.IsZero() && org.backfillStart.Before(windowStart) {
+		since = org.backfillStart
+	}
+	failed := false
+
+	for _, stack := range stacks {
+		current[stack.Key()] = true
+
+		history, ok := org.stacks[stack.Key()]
+		if !ok {
+			history = &stackHistory{}
+			org.stacks[stack.Key()] = history
+		}
+		history.stack = stack
+		history.deleted = false
+
+		// Stacks that haven't changed cost no requests
+		if stack.LastUpdate > history.lastUpdate {
+			complete, err := p.fetchStackUpdates(acc, org, stack, history, since, windowStart)
+			if err != nil {
+				failed = true
+				p.addFetchError(acc, org, "updates", stack.Key(), err)
+			} else if complete {
+				history.lastUpdate = stack.LastUpdate
+			}
+		}
+
+		history.prune(windowStart)
+		p.addStackUpdatesRollup(acc, org, stack, history)
+	}
+
+	for key, history := range org.stacks {
+		if current[key] {
+			continue
+		}
+
+		// A deleted stack's rate is kept until its last updates leave the
+		// window, showing what was destroyed rather than just going away
+		history.prune(windowStart)
+		if !p.IncludeDeletedStacks || len(history.updates) == 0 {
+			delete(org.stacks, key)
+			continue
+		}
+
+		history.deleted = true
+		p.addStackUpdatesRollup(acc, org, history.stack, history)
+	}
+
+	// Stacks that failed are backfilled on the retry, stacks created from
+	// now on have no history to backfill
+	if !failed {
+		org.backfillStart = time.Time{}
+	}
+
+	if p.FailedStacks {
+		p.addFailedStacks(acc, org, stacks)
+	}
+}
+
+// addFailedStacks emits how many of the stacks listed had their most recent
+// update fail, for the organization and each of its projects
+func (p *PulumiApiConfig) addFailedStacks(acc telegraf.Accumulator, org *organization, stacks []StackSummary) {
+	type counts struct {
+		stacks, failed int
+	}
+	total := counts{}
+	projects := make(map[string]*counts)
+
+	for _, stack := range stacks {
+		project, ok := projects[stack.ProjectName]
+		if !ok {
+			project = &counts{}
+			projects[stack.ProjectName] = project
+		}
+
+		total.stacks++
+		project.stacks++
+
+		if history, ok := org.stacks[stack.Key()]; ok && history.lastResult == "failed" {
+			total.failed++
+			project.failed++
+		}
+	}
+
+	names := make([]string, 0, len(projects))
+	for name := range projects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		tags := map[string]string{
+			"organization": org.name,
+			"project":      name,
+		}
+
+		fields := map[string]interface{}{
+			"stacks":        projects[name].stacks,
+			"failed_stacks": projects[name].failed,
+		}
+
+		acc.AddGauge("pulumi_failed_stacks", fields, tags)
+	}
+
+	tags := map[string]string{
+		"organization": org.name,
+	}
+	p.addShardTag(tags)
+
+	fields := map[string]interface{}{
+		"stacks":        total.stacks,
+		"failed_stacks": total.failed,
+	}
+
+	acc.AddGauge("pulumi_failed_stacks", fields, tags)
+}
+
+// fetchStackUpdates emits the stack's finished updates newer than the last
+// version collected, and ending after since. It reports true when no
+// update was left running. A running update holds the version cursor
+// back, so the update is picked up once it finishes.
+func (p *PulumiApiConfig) fetchStackUpdates(acc telegraf.Accumulator, org *organization, stack StackSummary, history *stackHistory, since time.Time, windowStart time.Time) (bool, error) {
+	updates, err := p.listStackUpdates(acc, org, stack, history, since)
+	if err != nil {
+		return false, err
+	}
+
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].Version < updates[j].Version
+	})
+
+	for _, update := range updates {
+		if update.Version <= history.lastVersion {
+			continue
+		}
+
+		if !update.finished() {
+			return false, nil
+		}
+		history.lastVersion = update.Version
+		if update.Kind != "preview" {
+			history.lastResult = update.Result
+		}
+
+		endTime := time.Unix(update.EndTime, 0)
+		if endTime.Before(since) {
+			continue
+		}
+
+		p.addStackUpdate(acc, org, stack, update)
+
+		// Previews don't change anything, so don't count towards the rate
+		if update.Kind != "preview" && !endTime.Before(windowStart) {
+			history.updates = append(history.updates, finishedUpdate{
+				endTime:   endTime,
+				succeeded: update.Result == "succeeded",
+			})
+
+			if update.StartTime > 0 {
+				history.durations = append(history.durations, endTime.Sub(time.Unix(update.StartTime, 0)).Seconds())
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// listStackUpdates returns the stack's updates, newest first, back to the
+// last version collected or, on the first collection, to since. The pages
+// are numbered rather than chained by a token.
+func (p *PulumiApiConfig) listStackUpdates(acc telegraf.Accumulator, org *organization, stack StackSummary, history *stackHistory, since time.Time) ([]UpdateInfo, error) {
+	var updates []UpdateInfo
+	page := 1
+
+	err := p.getPages(acc, org, pager{
+		endpoint: "updates",
+		url: func(token string) string {
+			return fmt.Sprintf("%s/api/stacks/%s/%s/%s/updates?pageSize=%d&page=%d", org.tenant.url,
+				neturl.PathEscape(org.name), neturl.PathEscape(stack.ProjectName), neturl.PathEscape(stack.StackName),
+				p.updatesPageSize(), page)
+		},
+		decode: func(body io.Reader) (string, error) {
+			var updatesResponse UpdatesResponse
+			var pageUpdates []UpdateInfo
+
+			err := org.drift.decodeStream("updates", body, &updatesResponse, "updates", func(raw json.RawMessage) error {
+				var update UpdateInfo
+				if err := org.drift.decode("updates.updates[]", raw, &update); err != nil {
+					org.drift.report("updates.updates[]", "dropping element: %s", err)
+					return nil
+				}
+
+				pageUpdates = append(pageUpdates, update)
+				return nil
+			})
+			if err != nil {
+				return "", err
+			}
+
+			updates = append(updates, pageUpdates...)
+
+			if len(pageUpdates) < p.updatesPageSize() {
+				return "", nil
+			}
+
+			// Stop once the page reaches what's been collected already, or
+			// goes back further than since on the first collection
+			oldest := pageUpdates[len(pageUpdates)-1]
+			if oldest.Version <= history.lastVersion || time.Unix(oldest.StartTime, 0).Before(since) {
+				return "", nil
+			}
+
+			page++
+			return strconv.Itoa(page), nil
+		},
+	})
+
+	return updates, err
+}
+
+// updateInitiator tells automation from people from the environment the
+// CLI records with every update. Deployments are checked first, as they run
+// the CLI too.
+func updateInitiator(environment map[string]string) string {
+	if _, ok := environment["pulumi.deployment.id"]; ok {
+		switch environment["pulumi.deployment.reason"] {
+		case "drift", "drift-remediation":
+			return "drift_remediation"
+		}
+		return "deployments"
+	}
+
+	if _, ok := environment["ci.system"]; ok {
+		return "ci"
+	}
+
+	switch kind := environment["exec.kind"]; {
+	case strings.HasPrefix(kind, "auto."):
+		return "automation_api"
+	case kind == "cli":
+		return "cli"
+	}
+
+	return "unknown"
+}
+
+// Polled updates share their schema with the pulumi_webhooks input
+func (p *PulumiApiConfig) addStackUpdate(acc telegraf.Accumulator, org *organization, stack StackSummary, update UpdateInfo) {
+	stackUpdate := pulumi.StackUpdate{
+		Organization:    org.name,
+		Project:         stack.ProjectName,
+		Stack:           stack.StackName,
+		Kind:            update.Kind,
+		Result:          update.Result,
+		Initiator:       updateInitiator(update.Environment),
+		Version:         update.Version,
+		ResourceChanges: update.ResourceChanges,
+	}
+
+	if update.StartTime > 0 {
+		stackUpdate.StartTime = time.Unix(update.StartTime, 0)
+	}
+	if update.EndTime > 0 {
+		stackUpdate.EndTime = time.Unix(update.EndTime, 0)
+	}
+
+	if p.FailureReasons && update.Result == "failed" {
+		stackUpdate.FailureReason, stackUpdate.FailureMessage = p.updateFailure(acc, org, stack, update)
+	}
+
+	fields := stackUpdate.Fields()
+	acc.AddFields(pulumi.StackUpdateMeasurement, fields, stackUpdate.Tags(), p.metricTime(fields, stackUpdate.Time()))
+	org.stats.eventsEmitted.Incr(1)
+
+	if p.DeployEvents && stackUpdate.DeployEvent() {
+		acc.AddFields(pulumi.DeployEventMeasurement, stackUpdate.DeployEventFields(), stackUpdate.Tags(), stackUpdate.Time())
+	}
+}
+
+// addStackUpdatesRollup emits the stack's success rate over the window, a
+// stack without updates in it has no rate rather than a rate of zero
+func (p *PulumiApiConfig) addStackUpdatesRollup(acc telegraf.Accumulator, org *organization, stack StackSummary, history *stackHistory) {
+	tags := map[string]string{
+		"organization": org.name,
+		"project":      stack.ProjectName,
+		"stack":        stack.StackName,
+	}
+
+	succeeded := 0
+	for _, update := range history.updates {
+		if update.succeeded {
+			succeeded++
+		}
+	}
+
+	fields := map[string]interface{}{
+		"updates":            len(history.updates),
+		"successful_updates": succeeded,
+	}
+
+	if len(history.updates) > 0 {
+		fields["success_rate"] = float64(succeeded) / float64(len(history.updates))
+	}
+
+	p.addDurationSummary(fields, history.durations)
+	history.durations = nil
+
+	if p.IncludeDeletedStacks {
+		fields["deleted"] = history.deleted
+	}
+
+	acc.AddGauge("pulumi_stack_updates", fields, tags)
+}
+
+// addDurationSummary summarises the durations of the updates finished since
+// the last gather, percentiles use the nearest rank
+func (p *PulumiApiConfig) addDurationSummary(fields map[string]interface{}, durations []float64) {
+	if len(durations) == 0 {
+		return
+	}
+
+	sorted := append([]float64(nil), durations...)
+	sort.Float64s(sorted)
+
+	sum := 0.0
+	for _, duration := range sorted {
+		sum += duration
+	}
+
+	fields["duration_min"] = sorted[0]
+	fields["duration_max"] = sorted[len(sorted)-1]
+	fields["duration_mean"] = sum / float64(len(sorted))
+
+	for _, percentile := range p.DurationPercentiles {
+		rank := int(math.Ceil(percentile / 100 * float64(len(sorted))))
+		if rank < 1 {
+			rank = 1
+		}
+
+		fields[fmt.Sprintf("duration_p%s", strconv.FormatFloat(percentile, 'f', -1, 64))] = sorted[rank-1]
+	}
+}
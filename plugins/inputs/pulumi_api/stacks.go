@@ -0,0 +1,180 @@
+package pulumi_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	neturl "net/url"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+type StacksResponse struct {
+	ContinuationToken ContinuationToken `json:"continuationToken"`
+	Stacks            []StackSummary    `json:"stacks"`
+}
+
+type StackSummary struct {
+	OrgName       string `json:"orgName"`
+	ProjectName   string `json:"projectName"`
+	StackName     string `json:"stackName"`
+	LastUpdate    int64  `json:"lastUpdate"`
+	ResourceCount int    `json:"resourceCount"`
+}
+
+// Key identifies a stack within its organization
+func (s StackSummary) Key() string {
+	return s.ProjectName + "/" + s.StackName
+}
+
+func newStacksCollector(p *PulumiApiConfig, org *organization) Collector {
+	if !p.StackUpdates && !p.StackTTL && !p.DeploymentSettings && !p.SourceTags && !p.PendingDeployments && !p.DeploymentLogs && !p.ProjectRollups && !p.SecretsProviders {
+		return nil
+	}
+
+	return &stacksCollector{
+		p:       p,
+		org:     org,
+		cursors: &stackCursors{org: org},
+	}
+}
+
+// stacksCollector runs everything working per stack, keeping their
+// cursors across restarts
+type stacksCollector struct {
+	p       *PulumiApiConfig
+	org     *organization
+	cursors *stackCursors
+}
+
+func (c *stacksCollector) Name() string {
+	return "stacks"
+}
+
+func (c *stacksCollector) Interval() time.Duration {
+	return 0
+}
+
+func (c *stacksCollector) State() interface{} {
+	return c.cursors
+}
+
+// Sharded splits the stacks between the shards
+func (c *stacksCollector) Sharded() bool {
+	return true
+}
+
+func (c *stacksCollector) Gather(acc telegraf.Accumulator) {
+	c.p.gatherStacks(acc, c.org)
+	c.cursors.snapshot()
+}
+
+// gatherStacks lists the stacks once for everything working per stack
+func (p *PulumiApiConfig) gatherStacks(acc telegraf.Accumulator, org *organization) {
+	stacks, err := p.cachedStacks(acc, org)
+	if err != nil {
+		p.addFetchError(acc, org, "stacks", "", err)
+		return
+	}
+	stacks = p.shardStacks(org, stacks)
+
+	// Deployment settings are fetched first so the source tags are there
+	// for the metrics of stacks deploying for the first time
+	var settings map[string]DeploymentSettings
+	if p.DeploymentSettings || p.SourceTags {
+		settings = p.listDeploymentSettings(acc, org, stacks)
+	}
+
+	if p.SourceTags {
+		org.updateStackSources(settings)
+	}
+
+	if p.StackUpdates {
+		p.gatherStackUpdates(acc, org, stacks)
+	}
+
+	if p.ProjectRollups {
+		p.addProjectRollups(acc, org, stacks)
+	}
+
+	if p.StackTTL {
+		p.gatherStackTTLs(acc, org, stacks)
+	}
+
+	if p.DeploymentSettings {
+		p.gatherDeploymentSettings(acc, org, stacks, settings)
+	}
+
+	if p.PendingDeployments || p.DeploymentLogs {
+		p.gatherDeployments(acc, org, stacks)
+	}
+
+	if p.SecretsProviders {
+		p.gatherSecretsProviders(acc, org, stacks)
+	}
+}
+
+// cachedStacks returns the stack list of the last listing until it's older
+// than stack_list_cache_ttl, a failed listing is tried again next time
+func (p *PulumiApiConfig) cachedStacks(acc telegraf.Accumulator, org *organization) ([]StackSummary, error) {
+	ttl := time.Duration(p.StackListCacheTTL)
+	if ttl > 0 && !org.stacksListedAt.IsZero() && time.Since(org.stacksListedAt) < ttl {
+		p.Log.Debugf("Reusing the stack list of %s from %s", org.name, org.stacksListedAt.Format(time.RFC3339))
+		return org.stackList, nil
+	}
+
+	stacks, err := p.listStacks(acc, org)
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl > 0 {
+		org.stackList, org.stacksListedAt = stacks, time.Now()
+	}
+
+	return stacks, nil
+}
+
+// listStacks returns every stack of the organization, following
+// continuation tokens to the last page
+func (p *PulumiApiConfig) listStacks(acc telegraf.Accumulator, org *organization) ([]StackSummary, error) {
+	var stacks []StackSummary
+
+	err := p.getPages(acc, org, pager{
+		endpoint: "stacks",
+		url: func(token string) string {
+			url := fmt.Sprintf("%s/api/user/stacks?organization=%s", org.tenant.url, neturl.QueryEscape(org.name))
+			if p.stackTagName != "" {
+				url = fmt.Sprintf("%s&tagName=%s", url, neturl.QueryEscape(p.stackTagName))
+			}
+			if p.stackTagValue != "" {
+				url = fmt.Sprintf("%s&tagValue=%s", url, neturl.QueryEscape(p.stackTagValue))
+			}
+			if token != "" {
+				url = fmt.Sprintf("%s&continuationToken=%s", url, neturl.QueryEscape(token))
+			}
+			return url
+		},
+		decode: func(body io.Reader) (string, error) {
+			var stacksResponse StacksResponse
+			err := org.drift.decodeStream("stacks", body, &stacksResponse, "stacks", func(raw json.RawMessage) error {
+				var stack StackSummary
+				if err := org.drift.decode("stacks.stacks[]", raw, &stack); err != nil {
+					org.drift.report("stacks.stacks[]", "dropping element: %s", err)
+					return nil
+				}
+
+				stacks = append(stacks, stack)
+				return nil
+			})
+
+			return string(stacksResponse.ContinuationToken), err
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stacks, nil
+}
@@ -0,0 +1,193 @@
+package pulumi_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PulumiApiState is the collection cursors that need to survive a restart
+type PulumiApiState struct {
+	Organizations map[string]OrganizationState `json:"organizations"`
+}
+
+// OrganizationState is the audit log cursor of a single organization
+type OrganizationState struct {
+	LastFetch         time.Time         `json:"last_fetch"`
+	ContinuationToken ContinuationToken `json:"continuation_token"`
+
+	// NewestEvent and WindowEnd are only meaningful while a capped fetch is
+	// being resumed
+	NewestEvent time.Time `json:"newest_event,omitempty"`
+	WindowEnd   time.Time `json:"window_end,omitempty"`
+
+	// Seen holds the keys of events inside the overlap window, so a restart
+	// doesn't emit them a second time
+	Seen map[string]time.Time `json:"seen,omitempty"`
+
+	BackfilledFrom time.Time `json:"backfilled_from,omitempty"`
+
+	// Collectors holds the state of each collector that has any, by name
+	Collectors map[string]json.RawMessage `json:"collectors,omitempty"`
+}
+
+// GetState snapshots the cursors of every organization, for state_file to
+// save. Telegraf doesn't persist plugin state itself, so nothing else does.
+func (p *PulumiApiConfig) GetState() interface{} {
+	state := PulumiApiState{
+		Organizations: make(map[string]OrganizationState, len(p.organizations)),
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, org := range p.organizations {
+		// With delivery_tracking only what outputs accepted is saved
+		orgState := org.cursor()
+		if org.delivered != nil {
+			orgState = *org.delivered
+		}
+		orgState.Collectors = org.collectorState()
+
+		state.Organizations[org.stateKey()] = orgState
+	}
+
+	return state
+}
+
+// cursor is a copy of the organization's audit log cursor
+func (o *organization) cursor() OrganizationState {
+	seen := make(map[string]time.Time, len(o.seen))
+	for key, timestamp := range o.seen {
+		seen[key] = timestamp
+	}
+
+	return OrganizationState{
+		LastFetch:         o.lastFetch,
+		ContinuationToken: o.continuationToken,
+		NewestEvent:       o.newestEvent,
+		WindowEnd:         o.windowEnd,
+		Seen:              seen,
+		BackfilledFrom:    o.backfilledFrom,
+	}
+}
+
+// setCursor moves the organization's audit log cursor to s
+func (o *organization) setCursor(s OrganizationState) {
+	o.lastFetch = s.LastFetch
+	o.continuationToken = s.ContinuationToken
+	o.newestEvent = s.NewestEvent
+	o.windowEnd = s.WindowEnd
+	o.backfilledFrom = s.BackfilledFrom
+
+	o.seen = make(map[string]time.Time, len(s.Seen))
+	for key, timestamp := range s.Seen {
+		o.seen[key] = timestamp
+	}
+}
+
+// SetState restores the cursors of a GetState snapshot, from state_file or
+// across a Stop and Start
+func (p *PulumiApiConfig) SetState(state interface{}) error {
+	var s PulumiApiState
+
+	switch v := state.(type) {
+	case PulumiApiState:
+		s = v
+	case *PulumiApiState:
+		s = *v
+	default:
+		// A state decoded without knowing its type, like a map, is
+		// round-tripped through JSON to get our own type back
+		bytes, err := json.Marshal(state)
+		if err != nil {
+			return fmt.Errorf("invalid state: %s", err)
+		}
+
+		if err := json.Unmarshal(bytes, &s); err != nil {
+			return fmt.Errorf("invalid state: %s", err)
+		}
+	}
+
+	// Organizations no longer configured are dropped, new ones keep the
+	// defaults from Init
+	for _, org := range p.organizations {
+		orgState, ok := s.Organizations[org.stateKey()]
+		if !ok {
+			continue
+		}
+
+		if err := org.setCollectorState(orgState.Collectors); err != nil {
+			return err
+		}
+
+		if orgState.LastFetch.IsZero() {
+			continue
+		}
+
+		org.setCursor(orgState)
+		org.backfillStart = time.Time{}
+
+		p.mu.Lock()
+		org.delivered = nil
+		org.tracked = nil
+		p.mu.Unlock()
+	}
+
+	return nil
+}
+
+// Neither Telegraf nor the execd shim persist plugin state, so state_file
+// is the only way the cursors survive a restart
+func (p *PulumiApiConfig) loadStateFile() error {
+	if p.StateFile == "" || p.DryRun {
+		return nil
+	}
+
+	bytes, err := os.ReadFile(p.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state PulumiApiState
+	if err := json.Unmarshal(bytes, &state); err != nil {
+		return fmt.Errorf("invalid state file %s: %s", p.StateFile, err)
+	}
+
+	return p.SetState(state)
+}
+
+func (p *PulumiApiConfig) saveStateFile() error {
+	if p.StateFile == "" || p.DryRun {
+		return nil
+	}
+
+	bytes, err := json.Marshal(p.GetState())
+	if err != nil {
+		return err
+	}
+
+	// Write then rename, so a crash mid-write never leaves a corrupt cursor
+	tmp, err := os.CreateTemp(filepath.Dir(p.StateFile), filepath.Base(p.StateFile)+".*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(bytes); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), p.StateFile)
+}
@@ -0,0 +1,44 @@
+package pulumi_api
+
+import (
+	"io"
+
+	"github.com/influxdata/telegraf/selfstat"
+)
+
+// stats are the plugin's own health counters, which inputs.internal reports
+// as the internal_pulumi_api measurement
+type stats struct {
+	requests        selfstat.Stat
+	bytesReceived   selfstat.Stat
+	pages           selfstat.Stat
+	eventsEmitted   selfstat.Stat
+	errors          selfstat.Stat
+	decodeAnomalies selfstat.Stat
+}
+
+func newStats(tags map[string]string) *stats {
+	return &stats{
+		requests:        selfstat.Register("pulumi_api", "requests", tags),
+		bytesReceived:   selfstat.Register("pulumi_api", "bytes_received", tags),
+		pages:           selfstat.Register("pulumi_api", "pages_fetched", tags),
+		eventsEmitted:   selfstat.Register("pulumi_api", "events_emitted", tags),
+		errors:          selfstat.Register("pulumi_api", "errors", tags),
+		decodeAnomalies: selfstat.Register("pulumi_api", "decode_anomalies", tags),
+	}
+}
+
+// countingReader counts the bytes read through it, adding them to stat
+type countingReader struct {
+	reader io.Reader
+	stat   selfstat.Stat
+	n      int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.n += int64(n)
+	r.stat.Incr(int64(n))
+
+	return n, err
+}
@@ -0,0 +1,113 @@
+package pulumi_api
+
+import (
+	"fmt"
+	"io"
+	neturl "net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+type TeamsResponse struct {
+	Teams []Team `json:"teams"`
+}
+
+type Team struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// TeamResponse is a team along with its members
+type TeamResponse struct {
+	Name    string       `json:"name"`
+	Members []TeamMember `json:"members"`
+}
+
+type TeamMember struct {
+	GitHubLogin string `json:"githubLogin"`
+}
+
+// userTeams returns the teams of the user with the login, sorted and
+// joined with commas, refreshing the organization's teams once they're
+// older than team_cache_ttl. A failed refresh is reported and keeps the
+// teams fetched last, if any.
+func (p *PulumiApiConfig) userTeams(acc telegraf.Accumulator, org *organization, login string) string {
+	org.teamsMu.Lock()
+	defer org.teamsMu.Unlock()
+
+	now := time.Now()
+	if org.teams == nil || now.Sub(org.teamsFetchedAt) >= time.Duration(p.TeamCacheTTL) {
+		teams, err := p.fetchTeams(acc, org)
+		if err != nil {
+			p.addFetchError(acc, org, "teams", "", err)
+		} else {
+			org.teams = teams
+		}
+
+		// Failures wait for the next refresh too, rather than costing two
+		// requests per event
+		org.teamsFetchedAt = now
+	}
+
+	return org.teams[login]
+}
+
+// fetchTeams maps the login of every member of the organization's teams
+// to the teams they're in
+func (p *PulumiApiConfig) fetchTeams(acc telegraf.Accumulator, org *organization) (map[string]string, error) {
+	req := apiRequest{
+		acc:          acc,
+		tenant:       org.tenant,
+		stats:        org.stats,
+		organization: org.name,
+		endpoint:     "teams",
+		url:          fmt.Sprintf("%s/api/orgs/%s/teams", org.tenant.url, neturl.PathEscape(org.name)),
+	}
+
+	var teams TeamsResponse
+	err := p.getConditional(req, func(body io.Reader) error {
+		bytes, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+
+		return org.drift.decode("teams", bytes, &teams)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	members := make(map[string][]string)
+	for _, team := range teams.Teams {
+		req.endpoint = "teams/team"
+		req.url = fmt.Sprintf("%s/api/orgs/%s/teams/%s", org.tenant.url, neturl.PathEscape(org.name), neturl.PathEscape(team.Name))
+
+		var details TeamResponse
+		err := p.getConditional(req, func(body io.Reader) error {
+			bytes, err := io.ReadAll(body)
+			if err != nil {
+				return err
+			}
+
+			return org.drift.decode("teams/team", bytes, &details)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("team %s: %w", team.Name, err)
+		}
+
+		for _, member := range details.Members {
+			members[member.GitHubLogin] = append(members[member.GitHubLogin], team.Name)
+		}
+	}
+
+	userTeams := make(map[string]string, len(members))
+	for login, names := range members {
+		sort.Strings(names)
+		userTeams[login] = strings.Join(names, ",")
+	}
+
+	return userTeams, nil
+}
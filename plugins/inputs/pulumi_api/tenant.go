@@ -0,0 +1,182 @@
+package pulumi_api
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EndpointConfig is another Pulumi API to collect from, such as a
+// self-hosted install, with a token and organizations of its own
+type EndpointConfig struct {
+	Name          string   `toml:"name"`
+	Url           string   `toml:"url"`
+	Token         string   `toml:"token"`
+	TokenFile     string   `toml:"token_file"`
+	Organizations []string `toml:"organizations"`
+
+	OIDCConfig
+}
+
+// tenant is a Pulumi API being collected from, either the one configured at
+// the top level or one of the endpoints
+type tenant struct {
+	// name tags the metrics of an endpoint, it's empty at the top level
+	name string
+	url  string
+
+	// token points at the configured token, for its token file to replace,
+	// and is guarded by the plugin's mutex like rateLimit
+	token     *string
+	tokenFile string
+	rateLimit rateLimit
+
+	// deprecations are the endpoints the API said are going away, also
+	// guarded by the plugin's mutex
+	deprecations map[string]deprecation
+
+	// clockSkew is from the Date header of the latest response, also
+	// guarded by the plugin's mutex
+	clockSkew clockSkew
+
+	// exchange replaces the token with one exchanged for an OIDC token
+	// before it expires, with oidc_token_file
+	exchange *tokenExchange
+
+	// owner is who the token belongs to, with token_owner_tag
+	owner string
+
+	organizationNames []string
+}
+
+// tags are added to every metric of the tenant
+func (t *tenant) tags() map[string]string {
+	tags := make(map[string]string)
+
+	if t.name != "" {
+		tags["endpoint_name"] = t.name
+	}
+	if t.owner != "" {
+		tags["token_owner"] = t.owner
+	}
+
+	return tags
+}
+
+// discovers is whether the tenant's organizations are listed with "*"
+func (t *tenant) discovers() bool {
+	for _, name := range t.organizationNames {
+		if name == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// initTenants sets up the top-level tenant, left out if only endpoints
+// have organizations, and one per endpoint
+func (p *PulumiApiConfig) initTenants() error {
+	p.tenants = nil
+
+	names := p.organizationNames()
+
+	// Organizations with a token of their own in tokens get a tenant each,
+	// which keeps their rate limits apart too
+	var shared []string
+	var own []*tenant
+	collected := make(map[string]bool, len(names))
+	for _, name := range names {
+		collected[name] = true
+
+		token, ok := p.Tokens[name]
+		if !ok {
+			shared = append(shared, name)
+			continue
+		}
+		if token == "" {
+			return fmt.Errorf("the tokens entry of %s is empty", name)
+		}
+
+		own = append(own, &tenant{
+			url:               p.Url,
+			token:             &token,
+			organizationNames: []string{name},
+		})
+	}
+
+	for name := range p.Tokens {
+		if !collected[name] {
+			return fmt.Errorf("tokens has a token for %s, which isn't in organization or organizations", name)
+		}
+	}
+
+	if len(shared) > 0 || (len(own) == 0 && len(p.Endpoints) == 0) {
+		if p.TokenFile != "" {
+			token, err := readTokenFile(p.TokenFile)
+			if err != nil {
+				return err
+			}
+			p.Token = token
+		}
+
+		exchange, err := newTokenExchange(p.OIDCConfig, shared)
+		if err != nil {
+			return err
+		}
+
+		p.tenants = append(p.tenants, &tenant{
+			url:               p.Url,
+			token:             &p.Token,
+			tokenFile:         p.TokenFile,
+			exchange:          exchange,
+			organizationNames: shared,
+		})
+	}
+
+	p.tenants = append(p.tenants, own...)
+
+	seen := make(map[string]bool)
+	for i := range p.Endpoints {
+		endpoint := &p.Endpoints[i]
+
+		if endpoint.Name == "" || strings.Contains(endpoint.Name, "/") {
+			return fmt.Errorf("invalid endpoints name %q, must be set and not contain /", endpoint.Name)
+		}
+		if seen[endpoint.Name] {
+			return fmt.Errorf("endpoints name %q is used more than once", endpoint.Name)
+		}
+		seen[endpoint.Name] = true
+
+		if len(endpoint.Organizations) == 0 {
+			return fmt.Errorf("endpoint %s has no organizations", endpoint.Name)
+		}
+
+		if endpoint.Url == "" {
+			endpoint.Url = "https://api.pulumi.com"
+		}
+
+		if endpoint.TokenFile != "" {
+			token, err := readTokenFile(endpoint.TokenFile)
+			if err != nil {
+				return fmt.Errorf("endpoint %s: %s", endpoint.Name, err)
+			}
+			endpoint.Token = token
+		}
+
+		exchange, err := newTokenExchange(endpoint.OIDCConfig, endpoint.Organizations)
+		if err != nil {
+			return fmt.Errorf("endpoint %s: %s", endpoint.Name, err)
+		}
+
+		p.tenants = append(p.tenants, &tenant{
+			name:              endpoint.Name,
+			url:               endpoint.Url,
+			token:             &endpoint.Token,
+			tokenFile:         endpoint.TokenFile,
+			exchange:          exchange,
+			organizationNames: endpoint.Organizations,
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package pulumi_api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// token is the API token the tenant's requests are made with, which its
+// token file can replace while running
+func (p *PulumiApiConfig) token(t *tenant) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return *t.token
+}
+
+func readTokenFile(path string) (string, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading token_file: %s", err)
+	}
+
+	token := strings.TrimSpace(string(bytes))
+	if token == "" {
+		return "", fmt.Errorf("token_file %s is empty", path)
+	}
+
+	return token, nil
+}
+
+// reloadToken re-reads the tenant's token file after the API rejected its
+// token, reporting whether it now holds a different one worth retrying with
+func (p *PulumiApiConfig) reloadToken(t *tenant) bool {
+	if t.tokenFile == "" {
+		return false
+	}
+
+	token, err := readTokenFile(t.tokenFile)
+	if err != nil {
+		p.Log.Errorf("Reloading token: %s", err)
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if token == *t.token {
+		return false
+	}
+
+	*t.token = token
+	p.Log.Infof("Reloaded the rotated token from %s", t.tokenFile)
+
+	return true
+}
+
+// isUnauthorized reports whether the API rejected the token itself. A 403
+// is a valid token lacking a permission, which a new one won't fix.
+func isUnauthorized(err error) bool {
+	var status *statusError
+	return errors.As(err, &status) && status.statusCode == http.StatusUnauthorized
+}
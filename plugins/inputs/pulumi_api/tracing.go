@@ -0,0 +1,104 @@
+package pulumi_api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// initTracing sets up the tracer wrapping every API request. Without
+// tracing it's a no-op tracer, whose spans never add a traceparent.
+func (p *PulumiApiConfig) initTracing() error {
+	if !p.Tracing {
+		p.tracer = trace.NewNoopTracerProvider().Tracer("pulumi_api")
+		return nil
+	}
+
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String("telegraf"),
+		)),
+	}
+
+	// Spans are still created without an endpoint, so the traceparent
+	// reaches Pulumi even when we don't export our side
+	if p.TracingEndpoint != "" {
+		endpoint, err := neturl.Parse(p.TracingEndpoint)
+		if err != nil || endpoint.Host == "" {
+			return fmt.Errorf("invalid tracing_endpoint %q", p.TracingEndpoint)
+		}
+
+		exporterOptions := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(endpoint.Host),
+		}
+		if endpoint.Scheme == "http" {
+			exporterOptions = append(exporterOptions, otlptracehttp.WithInsecure())
+		}
+		if endpoint.Path != "" && endpoint.Path != "/" {
+			exporterOptions = append(exporterOptions, otlptracehttp.WithURLPath(endpoint.Path))
+		}
+
+		exporter, err := otlptracehttp.New(p.ctx, exporterOptions...)
+		if err != nil {
+			return fmt.Errorf("creating trace exporter: %s", err)
+		}
+
+		options = append(options, sdktrace.WithBatcher(exporter))
+	}
+
+	p.tracerProvider = sdktrace.NewTracerProvider(options...)
+	p.tracer = p.tracerProvider.Tracer("github.com/rawkode/telegraf-plugin-pulumi-api/plugins/inputs/pulumi_api")
+
+	return nil
+}
+
+// startSpan starts the span of a single request attempt, the request made
+// with the returned context carries it as its traceparent
+func (p *PulumiApiConfig) startSpan(req apiRequest) (context.Context, trace.Span) {
+	return p.tracer.Start(p.ctx, req.httpMethod()+" "+req.endpoint,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(req.httpMethod()),
+			semconv.HTTPURLKey.String(req.url),
+			attribute.String("pulumi.endpoint", req.endpoint),
+			attribute.String("pulumi.organization", req.organization),
+		),
+	)
+}
+
+func injectTraceContext(ctx context.Context, request *http.Request) {
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(request.Header))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// stopTracing flushes the spans still waiting to be exported
+func (p *PulumiApiConfig) stopTracing() {
+	// Without an exporter there's nothing to flush, and the SDK fails to
+	// shut down a provider that has no span processors
+	if p.tracerProvider == nil || p.TracingEndpoint == "" {
+		return
+	}
+
+	if err := p.tracerProvider.Shutdown(context.Background()); err != nil {
+		p.Log.Errorf("Error shutting down tracing: %s", err)
+	}
+}
@@ -0,0 +1,130 @@
+package pulumi_api
+
+import (
+	"github.com/influxdata/telegraf"
+)
+
+// trackedGather is the events of one organization's gather, sent as a
+// single tracking group, and the cursor to save once it's delivered
+type trackedGather struct {
+	id telegraf.TrackingID
+
+	// Gathers without events have nothing to wait for
+	tracked bool
+
+	cursor OrganizationState
+}
+
+// startTracking sends the audit events through a tracking accumulator on
+// acc, so their cursor is only saved once outputs have accepted them
+func (p *PulumiApiConfig) startTracking(acc telegraf.Accumulator) {
+	p.tracking = acc.WithTracking(p.MaxUndeliveredMessages)
+	p.deliveries = make(map[telegraf.TrackingID]bool)
+	p.abandoned = make(map[telegraf.TrackingID]bool)
+
+	go func() {
+		for {
+			select {
+			case <-p.ctx.Done():
+				return
+			case info := <-p.tracking.Delivered():
+				p.mu.Lock()
+				if p.abandoned[info.ID()] {
+					delete(p.abandoned, info.ID())
+				} else {
+					p.deliveries[info.ID()] = info.Delivered()
+				}
+				p.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// collectTrackedAuditLogs is collectAuditLogs with the events held back
+// and sent as one tracking group once the gather is done
+func (p *PulumiApiConfig) collectTrackedAuditLogs(acc telegraf.Accumulator, org *organization) {
+	p.mu.Lock()
+	p.settleDeliveries(org)
+	if org.delivered == nil {
+		cursor := org.cursor()
+		org.delivered = &cursor
+	}
+	awaiting := len(org.tracked)
+	p.mu.Unlock()
+
+	if awaiting >= p.MaxUndeliveredMessages {
+		p.Log.Warnf("Skipping the audit logs of %s, %d gathers are awaiting delivery", org.name, awaiting)
+		return
+	}
+
+	// The group skips the accumulators wrapping acc, so gets its own
+	group := newBuffer(p.Log, 0)
+	var groupAcc telegraf.Accumulator = group
+	if p.fieldFilter != nil {
+		groupAcc = newFieldFilterAccumulator(groupAcc, p.fieldFilter)
+	}
+	if tags := p.orgTags(acc, org); len(tags) > 0 {
+		groupAcc = newTaggingAccumulator(groupAcc, tags)
+	}
+
+	p.backfillAuditLogs(groupAcc, org)
+	p.gatherAuditLogs(groupAcc, org)
+
+	metrics, errors := group.take()
+	for _, err := range errors {
+		acc.AddError(err)
+	}
+
+	gather := trackedGather{cursor: org.cursor()}
+	if len(metrics) > 0 {
+		gather.id = p.tracking.AddTrackingMetricGroup(metrics)
+		gather.tracked = true
+	}
+
+	p.mu.Lock()
+	org.tracked = append(org.tracked, gather)
+	p.settleDeliveries(org)
+	p.mu.Unlock()
+}
+
+// settleDeliveries moves the delivered cursor past every gather delivered
+// in order. An undelivered one rewinds the organization to the delivered
+// cursor so its events are fetched again, and the gathers after it no
+// longer matter. The plugin's mutex has to be held.
+func (p *PulumiApiConfig) settleDeliveries(org *organization) {
+	for len(org.tracked) > 0 {
+		gather := org.tracked[0]
+
+		if gather.tracked {
+			delivered, ok := p.deliveries[gather.id]
+			if !ok {
+				return
+			}
+			delete(p.deliveries, gather.id)
+
+			if !delivered {
+				p.Log.Warnf("Audit events of %s weren't delivered, fetching them again", org.name)
+
+				for _, later := range org.tracked[1:] {
+					if !later.tracked {
+						continue
+					}
+
+					if _, ok := p.deliveries[later.id]; ok {
+						delete(p.deliveries, later.id)
+					} else {
+						p.abandoned[later.id] = true
+					}
+				}
+
+				org.setCursor(*org.delivered)
+				org.tracked = nil
+				return
+			}
+		}
+
+		cursor := gather.cursor
+		org.delivered = &cursor
+		org.tracked = org.tracked[1:]
+	}
+}
@@ -0,0 +1,156 @@
+package pulumi_api
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/influxdata/telegraf"
+)
+
+// UsageResponse is the organization's consumption in the current billing
+// period
+type UsageResponse struct {
+	PeriodStart int64 `json:"periodStart"`
+	PeriodEnd   int64 `json:"periodEnd"`
+
+	UpdateMinutes            float64 `json:"updateMinutes"`
+	DeploymentMinutes        float64 `json:"deploymentMinutes"`
+	ResourcesUnderManagement int64   `json:"resourcesUnderManagement"`
+
+	Seats Seats `json:"seats"`
+}
+
+// StackUsageResponse breaks the period's deployment minutes down by stack
+type StackUsageResponse struct {
+	Stacks []StackUsage `json:"stacks"`
+}
+
+type StackUsage struct {
+	ProjectName       string  `json:"projectName"`
+	StackName         string  `json:"stackName"`
+	DeploymentMinutes float64 `json:"deploymentMinutes"`
+}
+
+type Seats struct {
+	Used  int64 `json:"used"`
+	Total int64 `json:"total"`
+}
+
+func newUsageCollector(p *PulumiApiConfig, org *organization) Collector {
+	if !p.Usage {
+		return nil
+	}
+
+	return &funcCollector{
+		name: "usage",
+		gather: func(acc telegraf.Accumulator) {
+			p.gatherUsage(acc, org)
+		},
+	}
+}
+
+func newStackUsageCollector(p *PulumiApiConfig, org *organization) Collector {
+	if !p.UsagePerStack {
+		return nil
+	}
+
+	return &funcCollector{
+		name: "usage_per_stack",
+		gather: func(acc telegraf.Accumulator) {
+			p.gatherStackUsage(acc, org)
+		},
+	}
+}
+
+// gatherUsage emits the billing period's consumption so far. It changes
+// slowly, so the request is conditional and a 304 costs no quota.
+func (p *PulumiApiConfig) gatherUsage(acc telegraf.Accumulator, org *organization) {
+	p.Log.Debugf("Fetching usage for %s", org.name)
+
+	req := apiRequest{
+		acc:          acc,
+		tenant:       org.tenant,
+		stats:        org.stats,
+		organization: org.name,
+		endpoint:     "billing/usage",
+		url:          fmt.Sprintf("%s/api/orgs/%s/billing/usage", org.tenant.url, org.name),
+	}
+
+	var usage UsageResponse
+	err := p.getConditional(req, func(body io.Reader) error {
+		bytes, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+
+		return org.drift.decode("billing/usage", bytes, &usage)
+	})
+
+	if err != nil {
+		p.addFetchError(acc, org, "usage", "", err)
+		return
+	}
+
+	tags := map[string]string{
+		"organization": org.name,
+	}
+
+	fields := map[string]interface{}{
+		"update_minutes":             usage.UpdateMinutes,
+		"deployment_minutes":         usage.DeploymentMinutes,
+		"resources_under_management": usage.ResourcesUnderManagement,
+		"seats_used":                 usage.Seats.Used,
+		"seats_total":                usage.Seats.Total,
+	}
+
+	if usage.PeriodStart > 0 {
+		fields["period_start"] = usage.PeriodStart
+	}
+	if usage.PeriodEnd > 0 {
+		fields["period_end"] = usage.PeriodEnd
+	}
+
+	acc.AddGauge("pulumi_usage", fields, tags)
+}
+
+// gatherStackUsage emits each stack's share of the deployment minutes, as
+// pulumi_usage series of their own so they sum to the organization's total
+func (p *PulumiApiConfig) gatherStackUsage(acc telegraf.Accumulator, org *organization) {
+	req := apiRequest{
+		acc:          acc,
+		tenant:       org.tenant,
+		stats:        org.stats,
+		organization: org.name,
+		endpoint:     "billing/usage/deployments",
+		url:          fmt.Sprintf("%s/api/orgs/%s/billing/usage/deployments", org.tenant.url, org.name),
+	}
+
+	var usage StackUsageResponse
+	err := p.getConditional(req, func(body io.Reader) error {
+		bytes, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+
+		return org.drift.decode("billing/usage/deployments", bytes, &usage)
+	})
+
+	if err != nil {
+		p.addFetchError(acc, org, "stack_usage", "", err)
+		return
+	}
+
+	for _, stack := range usage.Stacks {
+		tags := map[string]string{
+			"organization": org.name,
+			"project":      stack.ProjectName,
+			"stack":        stack.StackName,
+		}
+
+		fields := map[string]interface{}{
+			"deployment_minutes": stack.DeploymentMinutes,
+		}
+
+		acc.AddGauge("pulumi_usage", fields, tags)
+	}
+}
@@ -0,0 +1,95 @@
+package pulumi_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// CurrentUser is who the token belongs to, from /api/user
+type CurrentUser struct {
+	Name          string             `json:"name"`
+	GitHubLogin   string             `json:"githubLogin"`
+	Organizations []UserOrganization `json:"organizations"`
+}
+
+type UserOrganization struct {
+	Name        string `json:"name"`
+	GitHubLogin string `json:"githubLogin"`
+}
+
+// fetchCurrentUser asks who the tenant's token belongs to, which also
+// proves the token works
+func (p *PulumiApiConfig) fetchCurrentUser(t *tenant) (CurrentUser, error) {
+	req := apiRequest{
+		tenant:   t,
+		stats:    newStats(map[string]string{}),
+		endpoint: "user",
+		url:      fmt.Sprintf("%s/api/user", t.url),
+	}
+
+	var user CurrentUser
+	err := p.get(req, func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&user)
+	})
+	if err != nil {
+		return CurrentUser{}, fmt.Errorf("validating token against %s: %s", t.url, err)
+	}
+
+	p.Log.Debugf("Authenticated as %s", user.GitHubLogin)
+
+	return user, nil
+}
+
+// discoverOrganizations replaces the "*" in the tenant's organizations
+// with every organization its token's user is a member of
+func (p *PulumiApiConfig) discoverOrganizations(t *tenant, user CurrentUser) error {
+	var names []string
+	seen := make(map[string]bool)
+
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range t.organizationNames {
+		if name != "*" {
+			add(name)
+			continue
+		}
+
+		for _, org := range user.Organizations {
+			add(org.GitHubLogin)
+		}
+	}
+
+	if len(names) == 0 {
+		return fmt.Errorf("discovering organizations: %s isn't a member of any", user.GitHubLogin)
+	}
+
+	p.Log.Infof("Collecting from organizations %s", strings.Join(names, ", "))
+	t.organizationNames = names
+
+	return nil
+}
+
+// validateCredentials checks the tenant's token can see every organization
+// configured for it, so a bad token fails Init rather than every gather
+func (p *PulumiApiConfig) validateCredentials(t *tenant, user CurrentUser) error {
+	// Organization tokens authenticate as the organization itself
+	member := map[string]bool{user.GitHubLogin: true}
+	for _, org := range user.Organizations {
+		member[org.GitHubLogin] = true
+	}
+
+	for _, name := range t.organizationNames {
+		if !member[name] {
+			return fmt.Errorf("token of %s has no access to organization %s", user.GitHubLogin, name)
+		}
+	}
+
+	return nil
+}
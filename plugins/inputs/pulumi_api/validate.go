@@ -0,0 +1,131 @@
+package pulumi_api
+
+import (
+	"fmt"
+	neturl "net/url"
+	"time"
+)
+
+// validateSettings checks the numeric and duration options, so a typo fails
+// at startup rather than behaving oddly on every gather
+func (p *PulumiApiConfig) validateSettings() error {
+	nonNegative := []struct {
+		option string
+		value  time.Duration
+	}{
+		{"overlap", time.Duration(p.Overlap)},
+		{"poll_jitter", time.Duration(p.PollJitter)},
+		{"window_alignment", time.Duration(p.WindowAlignment)},
+		{"retry_base_delay", time.Duration(p.RetryBaseDelay)},
+		{"retry_jitter", time.Duration(p.RetryJitter)},
+		{"max_retry_after", time.Duration(p.MaxRetryAfter)},
+		{"dial_timeout", time.Duration(p.DialTimeout)},
+		{"stack_list_cache_ttl", time.Duration(p.StackListCacheTTL)},
+		{"resource_age_threshold", time.Duration(p.ResourceAgeThreshold)},
+		{"max_clock_skew", time.Duration(p.MaxClockSkew)},
+	}
+
+	for _, setting := range nonNegative {
+		if setting.value < 0 {
+			return fmt.Errorf("invalid %s %s, must not be negative", setting.option, setting.value)
+		}
+	}
+
+	// Only checked when what they belong to is enabled
+	positive := []struct {
+		option  string
+		value   time.Duration
+		enabled bool
+	}{
+		{"success_rate_window", time.Duration(p.SuccessRateWindow), p.StackUpdates},
+		{"circuit_breaker_cooldown", time.Duration(p.CircuitBreakerCooldown), p.CircuitBreakerThreshold > 0},
+		{"retention_watermark_interval", time.Duration(p.RetentionWatermarkInterval), p.RetentionWatermark},
+		{"reverse_dns_timeout", time.Duration(p.ReverseDNSTimeout), p.ReverseDNS},
+		{"team_cache_ttl", time.Duration(p.TeamCacheTTL), p.TeamTag},
+		{"insights_interval", time.Duration(p.InsightsInterval), len(p.Insights) > 0},
+	}
+
+	for _, setting := range positive {
+		if setting.enabled && setting.value <= 0 {
+			return fmt.Errorf("invalid %s %s, must be positive", setting.option, setting.value)
+		}
+	}
+
+	counts := []struct {
+		option string
+		value  int
+	}{
+		{"max_pages", p.MaxPages},
+		{"max_retries", p.MaxRetries},
+		{"max_requests_per_minute", p.MaxRequestsPerMinute},
+		{"circuit_breaker_threshold", p.CircuitBreakerThreshold},
+		{"shard_count", p.ShardCount},
+	}
+
+	for _, setting := range counts {
+		if setting.value < 0 {
+			return fmt.Errorf("invalid %s %d, must not be negative", setting.option, setting.value)
+		}
+	}
+
+	for _, insights := range p.Insights {
+		if insights.Type == "" {
+			return fmt.Errorf("insights needs a type")
+		}
+
+		for _, property := range insights.Properties {
+			if property == "organization" || property == "type" {
+				return fmt.Errorf("invalid insights property %q of %s, it would replace the %s tag", property, insights.Type, property)
+			}
+		}
+	}
+
+	if p.MaxResponseSize < 0 {
+		return fmt.Errorf("invalid max_response_size %d, must not be negative", p.MaxResponseSize)
+	}
+
+	if p.ShardCount > 1 && (p.ShardIndex < 0 || p.ShardIndex >= p.ShardCount) {
+		return fmt.Errorf("invalid shard_index %d, must be from 0 to shard_count - 1", p.ShardIndex)
+	}
+	if p.ShardCount <= 1 && p.ShardIndex != 0 {
+		return fmt.Errorf("invalid shard_index %d without a shard_count", p.ShardIndex)
+	}
+
+	return nil
+}
+
+// validateTenants checks every tenant has an API it can reach, credentials
+// and something to collect, once tokens have been read from their files
+func (p *PulumiApiConfig) validateTenants() error {
+	for _, t := range p.tenants {
+		option := func(name string) string {
+			if t.name == "" {
+				return name
+			}
+			return fmt.Sprintf("endpoint %s %s", t.name, name)
+		}
+
+		if len(t.organizationNames) == 0 {
+			return fmt.Errorf("%s is required, set organization or organizations", option("organization"))
+		}
+
+		url, err := neturl.Parse(t.url)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %s", option("url"), t.url, err)
+		}
+		if (url.Scheme != "http" && url.Scheme != "https") || url.Host == "" {
+			return fmt.Errorf("invalid %s %q, must be an http or https URL such as https://api.pulumi.com", option("url"), t.url)
+		}
+
+		// OAuth2 credentials and OIDC token exchange stand in for the
+		// access token
+		if *t.token == "" && p.ClientID == "" && t.exchange == nil {
+			return fmt.Errorf("%s is required, set token or token_file to a Pulumi access token", option("token"))
+		}
+		if *t.token != "" && t.exchange != nil {
+			return fmt.Errorf("%s and %s can't both be set", option("token"), option("oidc_token_file"))
+		}
+	}
+
+	return nil
+}
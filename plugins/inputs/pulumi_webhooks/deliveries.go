@@ -0,0 +1,78 @@
+package pulumi_webhooks
+
+import (
+	"sync"
+	"time"
+)
+
+// At most this many delivery IDs are remembered, the oldest are forgotten
+// first, so a flood of deliveries can't grow the set without bound
+const maxDeliveries = 100000
+
+// deliveries remembers the IDs of the deliveries handled within the window,
+// so a delivery Pulumi retries, or someone replays, is only counted once
+type deliveries struct {
+	window time.Duration
+
+	mu sync.Mutex
+	// seen is when each ID was handled, order the IDs oldest first
+	seen  map[string]time.Time
+	order []string
+}
+
+func newDeliveries(window time.Duration) *deliveries {
+	return &deliveries{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// seenOrRecord reports whether the delivery was already handled within the
+// window, remembering it if not. Checking and remembering under one lock
+// means of two concurrent retries only one gets through.
+func (d *deliveries) seenOrRecord(id string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expire(now)
+
+	if _, ok := d.seen[id]; ok {
+		return true
+	}
+
+	if len(d.order) >= maxDeliveries {
+		delete(d.seen, d.order[0])
+		d.order = d.order[1:]
+	}
+
+	d.seen[id] = now
+	d.order = append(d.order, id)
+
+	return false
+}
+
+// forget drops a delivery that couldn't be handled after all, so a retry of
+// it isn't taken for a duplicate
+func (d *deliveries) forget(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.seen[id]; !ok {
+		return
+	}
+	delete(d.seen, id)
+
+	for i, seen := range d.order {
+		if seen == id {
+			d.order = append(d.order[:i], d.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (d *deliveries) expire(now time.Time) {
+	for len(d.order) > 0 && now.Sub(d.seen[d.order[0]]) >= d.window {
+		delete(d.seen, d.order[0])
+		d.order = d.order[1:]
+	}
+}
@@ -0,0 +1,464 @@
+package pulumi_webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	tlsint "github.com/influxdata/telegraf/plugins/common/tls"
+	"github.com/influxdata/telegraf/plugins/inputs"
+	"github.com/rawkode/telegraf-plugin-pulumi-api/plugins/common/pulumi"
+)
+
+type PulumiWebhooksConfig struct {
+	ServiceAddress string          `toml:"service_address"`
+	Path           string          `toml:"path"`
+	ReadTimeout    config.Duration `toml:"read_timeout"`
+	WriteTimeout   config.Duration `toml:"write_timeout"`
+
+	// Bodies are buffered whole, so don't let a sender make us buffer
+	// gigabytes
+	MaxBodySize config.Size `toml:"max_body_size"`
+
+	tlsint.ServerConfig
+
+	BearerToken   string `toml:"bearer_token"`
+	BasicUsername string `toml:"basic_username"`
+	BasicPassword string `toml:"basic_password"`
+
+	// Secrets are tried in turn, so a new secret can be added before the
+	// webhook is switched over to it during rotation
+	Secrets []string `toml:"secrets"`
+
+	DeployEvents bool `toml:"deploy_events"`
+
+	DedupWindow config.Duration `toml:"dedup_window"`
+	MaxEventAge config.Duration `toml:"max_event_age"`
+
+	Routes []RouteConfig `toml:"routes"`
+
+	acc        telegraf.Accumulator
+	server     *http.Server
+	tlsConfig  *tls.Config
+	deliveries *deliveries
+	routes     map[string]*RouteConfig
+
+	Log telegraf.Logger `toml:"-"`
+}
+
+// WebhookPayload covers the fields of every webhook kind Pulumi sends, each
+// kind only fills in the ones relevant to it
+type WebhookPayload struct {
+	User         User         `json:"user"`
+	Organization Organization `json:"organization"`
+
+	ProjectName string `json:"projectName"`
+	StackName   string `json:"stackName"`
+
+	// stack_update and deployment
+	UpdateKind      string         `json:"updateKind"`
+	Result          string         `json:"result"`
+	ResourceChanges map[string]int `json:"resourceChanges"`
+	DeploymentID    string         `json:"deploymentID"`
+	Status          string         `json:"status"`
+	StartTime       int64          `json:"startTime"`
+	EndTime         int64          `json:"endTime"`
+	Version         int64          `json:"version"`
+
+	// stack and team lifecycle
+	Action string `json:"action"`
+
+	// ping
+	Message string `json:"message"`
+}
+
+// eventTime is when the event happened, zero for kinds that don't say
+func (w WebhookPayload) eventTime() time.Time {
+	switch {
+	case w.EndTime > 0:
+		return time.Unix(w.EndTime, 0)
+	case w.StartTime > 0:
+		return time.Unix(w.StartTime, 0)
+	}
+
+	return time.Time{}
+}
+
+type User struct {
+	Name        string `json:"name"`
+	GitHubLogin string `json:"githubLogin"`
+	AvatarUrl   string `json:"avatarUrl"`
+}
+
+type Organization struct {
+	Name        string `json:"name"`
+	GitHubLogin string `json:"githubLogin"`
+	AvatarUrl   string `json:"avatarUrl"`
+}
+
+func init() {
+	inputs.Add("pulumi_webhooks", func() telegraf.Input {
+		return &PulumiWebhooksConfig{
+			ServiceAddress: ":8742",
+			Path:           "/pulumi",
+			ReadTimeout:    config.Duration(10 * time.Second),
+			WriteTimeout:   config.Duration(10 * time.Second),
+			MaxBodySize:    config.Size(1024 * 1024),
+			DedupWindow:    config.Duration(time.Hour),
+		}
+	})
+}
+
+func (p *PulumiWebhooksConfig) SampleConfig() string {
+	return `
+  ## Pulumi Webhook Listener
+	[inputs.pulumi_webhooks]
+	## Address and path to receive Pulumi organization and stack webhooks on
+	# service_address = ":8742"
+	# path = "/pulumi"
+
+	# read_timeout = "10s"
+	# write_timeout = "10s"
+
+	## Largest delivery accepted, larger ones get a 413
+	# max_body_size = "1MiB"
+
+	## Serve HTTPS, and with tls_allowed_cacerts require client certificates
+	## signed by one of them
+	# tls_cert = "/etc/telegraf/cert.pem"
+	# tls_key = "/etc/telegraf/key.pem"
+	# tls_allowed_cacerts = ["/etc/telegraf/clientca.pem"]
+	# tls_min_version = "TLS12"
+
+	## Require an Authorization header, either a bearer token or basic auth,
+	## for a proxy in front of the listener to add. Pulumi itself only signs
+	## its deliveries, see secrets.
+	# bearer_token = "${PULUMI_WEBHOOK_TOKEN}"
+	# basic_username = "pulumi"
+	# basic_password = "${PULUMI_WEBHOOK_PASSWORD}"
+
+	## Shared secrets used to verify the Pulumi-Webhook-Signature header,
+	## deliveries signed by none of them are rejected. List more than one
+	## while rotating secrets.
+	# secrets = ["${PULUMI_WEBHOOK_SECRET}"]
+
+	## Also emit every finished update other than previews to the
+	## pulumi_deploy_events measurement, like pulumi_api does
+	# deploy_events = false
+
+	## Deliveries whose Pulumi-Webhook-Id was already handled within the
+	## window, such as Pulumi's retries, are acknowledged but not counted
+	## again. 0 turns deduplication off.
+	# dedup_window = "1h"
+
+	## Reject deliveries of events that ended, or started, longer ago than
+	## this, so a captured delivery can't be replayed later. 0 accepts
+	## events of any age.
+	# max_event_age = "0s"
+
+	## Send the webhooks of some kinds to a measurement of their own, rather
+	## than pulumi_stack_update for stack updates and pulumi_webhooks for the
+	## rest, renaming their tags and fields. Renaming to "" drops them.
+	# [[inputs.pulumi_webhooks.routes]]
+	#   kinds = ["deployment"]
+	#   measurement = "pulumi_deployments"
+	#   [inputs.pulumi_webhooks.routes.rename]
+	#     deployment_id = "id"
+	#     webhook_id = ""
+`
+}
+
+func (p *PulumiWebhooksConfig) Description() string {
+	return "Pulumi Webhook Listener"
+}
+
+func (p *PulumiWebhooksConfig) Gather(acc telegraf.Accumulator) error {
+	return nil
+}
+
+func (p *PulumiWebhooksConfig) Init() error {
+	if p.DedupWindow < 0 {
+		return fmt.Errorf("invalid dedup_window %s, must not be negative", time.Duration(p.DedupWindow))
+	}
+	if p.MaxEventAge < 0 {
+		return fmt.Errorf("invalid max_event_age %s, must not be negative", time.Duration(p.MaxEventAge))
+	}
+	if p.MaxBodySize <= 0 {
+		return fmt.Errorf("invalid max_body_size %d, must be positive", p.MaxBodySize)
+	}
+
+	if (p.BasicUsername == "") != (p.BasicPassword == "") {
+		return fmt.Errorf("basic_username and basic_password must be set together")
+	}
+	if p.BearerToken != "" && p.BasicUsername != "" {
+		return fmt.Errorf("bearer_token and basic_username can't both be set")
+	}
+
+	tlsConfig, err := p.ServerConfig.TLSConfig()
+	if err != nil {
+		return fmt.Errorf("invalid TLS settings: %s", err)
+	}
+	p.tlsConfig = tlsConfig
+
+	if err := p.initRoutes(); err != nil {
+		return err
+	}
+
+	if p.DedupWindow > 0 {
+		p.deliveries = newDeliveries(time.Duration(p.DedupWindow))
+	}
+
+	return nil
+}
+
+func (p *PulumiWebhooksConfig) Start(acc telegraf.Accumulator) error {
+	p.acc = acc
+
+	if len(p.Secrets) == 0 {
+		p.Log.Warn("No secrets configured, webhook signatures will not be verified")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(p.Path, p.handleWebhook)
+
+	p.server = &http.Server{
+		Handler:      mux,
+		ReadTimeout:  time.Duration(p.ReadTimeout),
+		WriteTimeout: time.Duration(p.WriteTimeout),
+	}
+
+	listener, err := net.Listen("tcp", p.ServiceAddress)
+	if err != nil {
+		return fmt.Errorf("error starting server: %s", err)
+	}
+
+	scheme := "http"
+	if p.tlsConfig != nil {
+		listener = tls.NewListener(listener, p.tlsConfig)
+		scheme = "https"
+	}
+
+	go func() {
+		if err := p.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			acc.AddError(fmt.Errorf("error listening: %s", err))
+		}
+	}()
+
+	p.Log.Infof("Listening for Pulumi webhooks on %s://%s%s", scheme, listener.Addr(), p.Path)
+
+	return nil
+}
+
+func (p *PulumiWebhooksConfig) Stop() {
+	if p.server == nil {
+		return
+	}
+
+	if err := p.server.Close(); err != nil {
+		p.Log.Errorf("Error stopping the webhook listener: %s", err)
+	}
+}
+
+func (p *PulumiWebhooksConfig) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !p.authorized(r) {
+		p.Log.Warnf("Rejected webhook from %s with missing or invalid credentials", r.RemoteAddr)
+		if p.BasicUsername != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="pulumi_webhooks"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(p.MaxBodySize)+1))
+	if err != nil {
+		http.Error(w, "error reading body", http.StatusBadRequest)
+		return
+	}
+
+	if int64(len(body)) > int64(p.MaxBodySize) {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if !p.verifySignature(r.Header.Get("Pulumi-Webhook-Signature"), body) {
+		p.Log.Warnf("Rejected webhook from %s with a missing or invalid signature", r.RemoteAddr)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	kind := r.Header.Get("Pulumi-Webhook-Kind")
+	if kind == "" {
+		http.Error(w, "missing Pulumi-Webhook-Kind header", http.StatusBadRequest)
+		return
+	}
+
+	// Only checked once signed, so forged deliveries can't get genuine
+	// ones dropped by taking their IDs first
+	id := r.Header.Get("Pulumi-Webhook-Id")
+	now := time.Now()
+	deduplicated := p.deliveries != nil && id != ""
+	if deduplicated && p.deliveries.seenOrRecord(id, now) {
+		p.Log.Debugf("Ignoring webhook %s, it was already delivered", id)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var payload WebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		p.Log.Debugf("Invalid %s webhook payload: %s", kind, err)
+		if deduplicated {
+			p.deliveries.forget(id)
+		}
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	if p.MaxEventAge > 0 {
+		if eventTime := payload.eventTime(); !eventTime.IsZero() && now.Sub(eventTime) > time.Duration(p.MaxEventAge) {
+			p.Log.Warnf("Rejected %s webhook from %s of an event from %s, older than max_event_age", kind, r.RemoteAddr, eventTime.Format(time.RFC3339))
+			if deduplicated {
+				p.deliveries.forget(id)
+			}
+			http.Error(w, "event too old", http.StatusBadRequest)
+			return
+		}
+	}
+
+	p.addWebhook(kind, id, payload)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// authorized checks the Authorization header against the bearer token or
+// basic auth credentials, if either is set
+func (p *PulumiWebhooksConfig) authorized(r *http.Request) bool {
+	switch {
+	case p.BearerToken != "":
+		return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+p.BearerToken)) == 1
+	case p.BasicUsername != "":
+		username, password, ok := r.BasicAuth()
+		return ok &&
+			subtle.ConstantTimeCompare([]byte(username), []byte(p.BasicUsername)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(p.BasicPassword)) == 1
+	}
+
+	return true
+}
+
+// verifySignature checks the hex HMAC-SHA256 of the body against every
+// configured secret, anything goes when there are none
+func (p *PulumiWebhooksConfig) verifySignature(signature string, body []byte) bool {
+	if len(p.Secrets) == 0 {
+		return true
+	}
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+
+	for _, secret := range p.Secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+
+		if hmac.Equal(mac.Sum(nil), expected) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *PulumiWebhooksConfig) addWebhook(kind string, id string, payload WebhookPayload) {
+	switch kind {
+	case "ping":
+		p.Log.Infof("Received ping webhook: %s", payload.Message)
+		return
+	case "stack_update":
+		p.addStackUpdate(payload)
+		return
+	}
+
+	tags := map[string]string{
+		"kind":         kind,
+		"organization": payload.Organization.GitHubLogin,
+	}
+
+	optionalTags := map[string]string{
+		"project":     payload.ProjectName,
+		"stack":       payload.StackName,
+		"user":        payload.User.Name,
+		"update_kind": payload.UpdateKind,
+		"result":      payload.Result,
+		"status":      payload.Status,
+		"action":      payload.Action,
+	}
+
+	for key, value := range optionalTags {
+		if value != "" {
+			tags[key] = value
+		}
+	}
+
+	fields := map[string]interface{}{
+		"count": 1,
+	}
+
+	if id != "" {
+		fields["webhook_id"] = id
+	}
+
+	if payload.DeploymentID != "" {
+		fields["deployment_id"] = payload.DeploymentID
+	}
+
+	for operation, count := range payload.ResourceChanges {
+		fields["resource_changes_"+operation] = count
+	}
+
+	p.Log.Debugf("Webhook with tags %v and fields %v", tags, fields)
+
+	p.addFields(kind, "pulumi_webhooks", fields, tags)
+}
+
+// Stack updates use the same schema as the updates polled by pulumi_api
+func (p *PulumiWebhooksConfig) addStackUpdate(payload WebhookPayload) {
+	update := pulumi.StackUpdate{
+		Organization:    payload.Organization.GitHubLogin,
+		Project:         payload.ProjectName,
+		Stack:           payload.StackName,
+		Kind:            payload.UpdateKind,
+		Result:          payload.Result,
+		Version:         payload.Version,
+		ResourceChanges: payload.ResourceChanges,
+	}
+
+	if payload.StartTime > 0 {
+		update.StartTime = time.Unix(payload.StartTime, 0)
+	}
+	if payload.EndTime > 0 {
+		update.EndTime = time.Unix(payload.EndTime, 0)
+	}
+
+	p.addFields("stack_update", pulumi.StackUpdateMeasurement, update.Fields(), update.Tags(), update.Time())
+
+	if p.DeployEvents && update.DeployEvent() {
+		p.acc.AddFields(pulumi.DeployEventMeasurement, update.DeployEventFields(), update.Tags(), update.Time())
+	}
+}
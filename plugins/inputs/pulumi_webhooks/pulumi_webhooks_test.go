@@ -0,0 +1,359 @@
+package pulumi_webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/plugins/inputs"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPlugin(acc telegraf.Accumulator) *PulumiWebhooksConfig {
+	p := inputs.Inputs["pulumi_webhooks"]().(*PulumiWebhooksConfig)
+	p.Log = testutil.Logger{}
+	p.acc = acc
+
+	if err := p.Init(); err != nil {
+		panic(err)
+	}
+
+	return p
+}
+
+func deliver(t *testing.T, p *PulumiWebhooksConfig, kind string, fixture string, signature string) *httptest.ResponseRecorder {
+	return deliverAs(t, p, "delivery-1", kind, fixture, signature)
+}
+
+func deliverAs(t *testing.T, p *PulumiWebhooksConfig, id string, kind string, fixture string, signature string) *httptest.ResponseRecorder {
+	body, err := os.ReadFile("testdata/" + fixture)
+	require.NoError(t, err)
+
+	request := httptest.NewRequest(http.MethodPost, "/pulumi", bytes.NewReader(body))
+	request.Header.Set("Pulumi-Webhook-Kind", kind)
+	request.Header.Set("Pulumi-Webhook-Id", id)
+	if signature != "" {
+		request.Header.Set("Pulumi-Webhook-Signature", signature)
+	}
+
+	recorder := httptest.NewRecorder()
+	p.handleWebhook(recorder, request)
+
+	return recorder
+}
+
+func sign(t *testing.T, secret string, fixture string) string {
+	body, err := os.ReadFile("testdata/" + fixture)
+	require.NoError(t, err)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestStackUpdateWebhook(t *testing.T) {
+	var acc testutil.Accumulator
+	p := newTestPlugin(&acc)
+
+	response := deliver(t, p, "stack_update", "stack_update.json", "")
+	require.Equal(t, http.StatusOK, response.Code)
+
+	expected := []telegraf.Metric{
+		testutil.MustMetric(
+			"pulumi_stack_update",
+			map[string]string{
+				"organization": "acme",
+				"project":      "website",
+				"stack":        "production",
+				"kind":         "update",
+				"result":       "succeeded",
+			},
+			map[string]interface{}{
+				"count":                   1,
+				"version":                 int64(42),
+				"duration":                float64(90),
+				"resource_changes_create": 2,
+				"resource_changes_update": 1,
+				"resource_changes_same":   10,
+			},
+			time.Unix(1700000090, 0),
+		),
+	}
+
+	testutil.RequireMetricsEqual(t, expected, acc.GetTelegrafMetrics())
+}
+
+func TestStackUpdateWebhookDeployEvents(t *testing.T) {
+	var acc testutil.Accumulator
+	p := newTestPlugin(&acc)
+	p.DeployEvents = true
+
+	response := deliver(t, p, "stack_update", "stack_update.json", "")
+	require.Equal(t, http.StatusOK, response.Code)
+
+	m, ok := acc.Get("pulumi_deploy_events")
+	require.True(t, ok)
+	require.Equal(t, "production", m.Tags["stack"])
+	require.Equal(t, map[string]interface{}{
+		"title": "website/production update succeeded",
+		"text":  "Update 42 of acme/website/production succeeded after 1m30s: 2 create, 1 update",
+	}, m.Fields)
+	require.Equal(t, time.Unix(1700000090, 0), m.Time)
+}
+
+func TestStackWebhook(t *testing.T) {
+	var acc testutil.Accumulator
+	p := newTestPlugin(&acc)
+
+	response := deliver(t, p, "stack", "stack.json", "")
+	require.Equal(t, http.StatusOK, response.Code)
+
+	expected := []telegraf.Metric{
+		testutil.MustMetric(
+			"pulumi_webhooks",
+			map[string]string{
+				"kind":         "stack",
+				"organization": "acme",
+				"project":      "website",
+				"stack":        "staging",
+				"user":         "Jane Doe",
+				"action":       "created",
+			},
+			map[string]interface{}{
+				"count":      1,
+				"webhook_id": "delivery-1",
+			},
+			time.Unix(0, 0),
+		),
+	}
+
+	testutil.RequireMetricsEqual(t, expected, acc.GetTelegrafMetrics(), testutil.IgnoreTime())
+}
+
+func TestWebhookRoutes(t *testing.T) {
+	var acc testutil.Accumulator
+	p := inputs.Inputs["pulumi_webhooks"]().(*PulumiWebhooksConfig)
+	p.Log = testutil.Logger{}
+	p.acc = &acc
+	p.Routes = []RouteConfig{
+		{
+			Kinds:       []string{"stack", "team"},
+			Measurement: "pulumi_lifecycle",
+			Rename:      map[string]string{"user": "actor", "webhook_id": ""},
+		},
+		{
+			Kinds:  []string{"stack_update"},
+			Rename: map[string]string{"kind": "update_kind"},
+		},
+	}
+	require.NoError(t, p.Init())
+
+	response := deliver(t, p, "stack", "stack.json", "")
+	require.Equal(t, http.StatusOK, response.Code)
+
+	m, ok := acc.Get("pulumi_lifecycle")
+	require.True(t, ok)
+	require.Equal(t, "Jane Doe", m.Tags["actor"])
+	require.NotContains(t, m.Tags, "user")
+	require.Equal(t, map[string]interface{}{"count": 1}, m.Fields)
+
+	// Routes without a measurement only rename
+	response = deliverAs(t, p, "delivery-2", "stack_update", "stack_update.json", "")
+	require.Equal(t, http.StatusOK, response.Code)
+
+	m, ok = acc.Get("pulumi_stack_update")
+	require.True(t, ok)
+	require.Equal(t, "update", m.Tags["update_kind"])
+	require.NotContains(t, m.Tags, "kind")
+}
+
+func TestWebhookSignature(t *testing.T) {
+	var acc testutil.Accumulator
+	p := newTestPlugin(&acc)
+	p.Secrets = []string{"new-secret", "old-secret"}
+
+	response := deliver(t, p, "stack", "stack.json", "")
+	require.Equal(t, http.StatusUnauthorized, response.Code)
+
+	response = deliver(t, p, "stack", "stack.json", sign(t, "wrong-secret", "stack.json"))
+	require.Equal(t, http.StatusUnauthorized, response.Code)
+	require.Empty(t, acc.GetTelegrafMetrics())
+
+	// Either secret is accepted while rotating
+	response = deliver(t, p, "stack", "stack.json", sign(t, "old-secret", "stack.json"))
+	require.Equal(t, http.StatusOK, response.Code)
+
+	response = deliverAs(t, p, "delivery-2", "stack", "stack.json", sign(t, "new-secret", "stack.json"))
+	require.Equal(t, http.StatusOK, response.Code)
+
+	require.Len(t, acc.GetTelegrafMetrics(), 2)
+}
+
+func TestWebhookDeduplication(t *testing.T) {
+	var acc testutil.Accumulator
+	p := newTestPlugin(&acc)
+
+	response := deliver(t, p, "stack_update", "stack_update.json", "")
+	require.Equal(t, http.StatusOK, response.Code)
+
+	// Retries are acknowledged, so Pulumi stops retrying, but not counted
+	response = deliver(t, p, "stack_update", "stack_update.json", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Len(t, acc.GetTelegrafMetrics(), 1)
+
+	response = deliverAs(t, p, "delivery-2", "stack_update", "stack_update.json", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Len(t, acc.GetTelegrafMetrics(), 2)
+
+	// Forgotten once the window has passed
+	p.deliveries.expire(time.Now().Add(time.Duration(p.DedupWindow)))
+	response = deliver(t, p, "stack_update", "stack_update.json", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Len(t, acc.GetTelegrafMetrics(), 3)
+}
+
+func TestWebhookConcurrentDuplicates(t *testing.T) {
+	var acc testutil.Accumulator
+	p := newTestPlugin(&acc)
+
+	// Retries of one delivery arriving together are still counted once
+	codes := make([]int, 20)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = deliver(t, p, "stack_update", "stack_update.json", "").Code
+		}(i)
+	}
+	wg.Wait()
+
+	for _, code := range codes {
+		require.Equal(t, http.StatusOK, code)
+	}
+	require.Len(t, acc.GetTelegrafMetrics(), 1)
+}
+
+func TestWebhookMaxEventAge(t *testing.T) {
+	var acc testutil.Accumulator
+	p := newTestPlugin(&acc)
+	p.MaxEventAge = config.Duration(time.Hour)
+
+	// The fixture's update ended in 2023
+	response := deliver(t, p, "stack_update", "stack_update.json", "")
+	require.Equal(t, http.StatusBadRequest, response.Code)
+	require.Empty(t, acc.GetTelegrafMetrics())
+
+	// A rejected delivery isn't remembered, its retry is let through once
+	// the limit allows
+	p.MaxEventAge = 0
+	response = deliver(t, p, "stack_update", "stack_update.json", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Len(t, acc.GetTelegrafMetrics(), 1)
+	acc.ClearMetrics()
+	p.MaxEventAge = config.Duration(time.Hour)
+
+	// Kinds without a time of their own are let through
+	response = deliverAs(t, p, "delivery-2", "stack", "stack.json", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	require.Len(t, acc.GetTelegrafMetrics(), 1)
+}
+
+func TestWebhookAuth(t *testing.T) {
+	body, err := os.ReadFile("testdata/stack.json")
+	require.NoError(t, err)
+
+	request := func(p *PulumiWebhooksConfig, authorize func(r *http.Request)) int {
+		r := httptest.NewRequest(http.MethodPost, "/pulumi", bytes.NewReader(body))
+		r.Header.Set("Pulumi-Webhook-Kind", "stack")
+		authorize(r)
+
+		recorder := httptest.NewRecorder()
+		p.handleWebhook(recorder, r)
+		return recorder.Code
+	}
+
+	var acc testutil.Accumulator
+	p := newTestPlugin(&acc)
+	p.BearerToken = "token"
+
+	require.Equal(t, http.StatusUnauthorized, request(p, func(r *http.Request) {}))
+	require.Equal(t, http.StatusUnauthorized, request(p, func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }))
+	require.Equal(t, http.StatusOK, request(p, func(r *http.Request) { r.Header.Set("Authorization", "Bearer token") }))
+
+	p = newTestPlugin(&acc)
+	p.BasicUsername, p.BasicPassword = "pulumi", "password"
+
+	require.Equal(t, http.StatusUnauthorized, request(p, func(r *http.Request) { r.SetBasicAuth("pulumi", "wrong") }))
+	require.Equal(t, http.StatusOK, request(p, func(r *http.Request) { r.SetBasicAuth("pulumi", "password") }))
+
+	require.Len(t, acc.GetTelegrafMetrics(), 2)
+}
+
+func TestWebhookMaxBodySize(t *testing.T) {
+	var acc testutil.Accumulator
+	p := newTestPlugin(&acc)
+	p.MaxBodySize = 64
+
+	response := deliver(t, p, "stack", "stack.json", "")
+	require.Equal(t, http.StatusRequestEntityTooLarge, response.Code)
+	require.Empty(t, acc.GetTelegrafMetrics())
+}
+
+func TestInitValidatesConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(p *PulumiWebhooksConfig)
+		err    string
+	}{
+		{"zero max_body_size", func(p *PulumiWebhooksConfig) { p.MaxBodySize = 0 }, "invalid max_body_size 0"},
+		{"username without password", func(p *PulumiWebhooksConfig) { p.BasicUsername = "pulumi" }, "basic_username and basic_password must be set together"},
+		{"token and basic auth", func(p *PulumiWebhooksConfig) {
+			p.BearerToken = "token"
+			p.BasicUsername, p.BasicPassword = "pulumi", "password"
+		}, "bearer_token and basic_username can't both be set"},
+		{"route without kinds", func(p *PulumiWebhooksConfig) {
+			p.Routes = []RouteConfig{{Measurement: "pulumi_deployments"}}
+		}, "route 1 has no kinds"},
+		{"kind routed twice", func(p *PulumiWebhooksConfig) {
+			p.Routes = []RouteConfig{{Kinds: []string{"deployment"}}, {Kinds: []string{"deployment"}}}
+		}, `kind "deployment" is routed more than once`},
+		{"missing certificate", func(p *PulumiWebhooksConfig) {
+			p.TLSCert = "testdata/missing.pem"
+			p.TLSKey = "testdata/missing-key.pem"
+		}, "invalid TLS settings"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := inputs.Inputs["pulumi_webhooks"]().(*PulumiWebhooksConfig)
+			p.Log = testutil.Logger{}
+			tt.modify(p)
+
+			err := p.Init()
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
+
+func TestWebhookRejectsGet(t *testing.T) {
+	var acc testutil.Accumulator
+	p := newTestPlugin(&acc)
+
+	recorder := httptest.NewRecorder()
+	p.handleWebhook(recorder, httptest.NewRequest(http.MethodGet, "/pulumi", nil))
+
+	require.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+}
@@ -0,0 +1,75 @@
+package pulumi_webhooks
+
+import (
+	"fmt"
+	"time"
+)
+
+// RouteConfig sends the webhooks of some kinds to a measurement of their
+// own, with their tags and fields renamed to fit its schema
+type RouteConfig struct {
+	Kinds       []string `toml:"kinds"`
+	Measurement string   `toml:"measurement"`
+
+	// Rename maps tag and field names to new ones, an empty name drops
+	// the tag or field
+	Rename map[string]string `toml:"rename"`
+}
+
+// initRoutes indexes the routes by kind, each kind can only have one
+func (p *PulumiWebhooksConfig) initRoutes() error {
+	p.routes = make(map[string]*RouteConfig)
+
+	for i := range p.Routes {
+		route := &p.Routes[i]
+
+		if len(route.Kinds) == 0 {
+			return fmt.Errorf("route %d has no kinds", i+1)
+		}
+
+		for _, kind := range route.Kinds {
+			if _, ok := p.routes[kind]; ok {
+				return fmt.Errorf("kind %q is routed more than once", kind)
+			}
+			p.routes[kind] = route
+		}
+	}
+
+	return nil
+}
+
+// addFields emits a webhook's metric, to measurement unless its kind is
+// routed elsewhere
+func (p *PulumiWebhooksConfig) addFields(kind string, measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	route, ok := p.routes[kind]
+	if !ok {
+		p.acc.AddFields(measurement, fields, tags, t...)
+		return
+	}
+
+	if route.Measurement != "" {
+		measurement = route.Measurement
+	}
+
+	renamedTags := make(map[string]string, len(tags))
+	for key, value := range tags {
+		if name, ok := route.Rename[key]; ok {
+			key = name
+		}
+		if key != "" {
+			renamedTags[key] = value
+		}
+	}
+
+	renamedFields := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		if name, ok := route.Rename[key]; ok {
+			key = name
+		}
+		if key != "" {
+			renamedFields[key] = value
+		}
+	}
+
+	p.acc.AddFields(measurement, renamedFields, renamedTags, t...)
+}